@@ -6,36 +6,124 @@ import (
 	redsnif "github.com/amyangfei/redsnif/rsniffer"
 	"github.com/koding/multiconfig"
 	"os"
+	"regexp"
 	"time"
 )
 
 type (
 	MainConfig struct {
-		Network Network
-		Redis   Redis
-		Analyze Analyze
+		Network    Network
+		Proxy      Proxy
+		Redis      Redis
+		Analyze    Analyze
+		BigKey     BigKey
+		KeyPattern KeyPattern
+		Channel    Channel
+		Blocking   Blocking
+		Tracking   Tracking
+		Cluster    Cluster
+		Sentinel   Sentinel
+		Error      Error
+		Redact     Redact
+		Sampling   Sampling
+		Pipeline   Pipeline
 	}
 	Network struct {
-		Device      string `required:"true"`
-		Timeout     int    `default:"2000"`
-		Snaplen     int    `default:"1500"`
-		Promiscuous bool   `default:"true"`
-		UseZeroCopy bool   `default:"true"`
+		Device      string   `required:"true"`
+		PcapFile    string   `default:""`
+		Encap       []string // encapsulations to capture: vlan, vxlan, gre
+		Timeout     int      `default:"2000"`
+		Snaplen     int      `default:"1500"`
+		Promiscuous bool     `default:"true"`
+		UseZeroCopy bool     `default:"true"`
+	}
+	Proxy struct {
+		Enable   bool   `default:"false"`
+		Listen   string `default:"unix:/tmp/redsnif.sock"`
+		Upstream string `default:"unix:/var/run/redis.sock"`
 	}
 	Redis struct {
-		Host       string `required:"true"`
-		Port       int    `required:"true"`
-		MaxBufSize int    `default:"3000"`
+		Host        string   `default:"127.0.0.1"`
+		Port        int      `default:"6379"`
+		Targets     []string // endpoints such as "10.0.0.1:6379-6390", override Host and Port
+		MaxBufSize  int      `default:"3000"`
+		SessionIdle int      `default:"600"` // seconds without packet before a session is evicted, 0 never
 	}
 	Analyze struct {
-		ReadHitAnalyze bool  `default:"true"`
-		SaveCmdTypes   []int `required:"true"`
-		SaveDetail     int   `required:"true"`
+		ReadHitAnalyze bool     `default:"true"`
+		ReplStream     bool     `default:"false"`
+		SaveCmdTypes   []int    `required:"true"`
+		SaveDetail     int      `required:"true"`
+		RecordRules    []string // rules in "detail[/condition...]:commands[:type:pattern]" format
+	}
+	BigKey struct {
+		Enable      bool `default:"false"`
+		MaxBytes    int  `default:"10240"`
+		MaxElements int  `default:"5000"`
+		TopN        int  `default:"10"`
+		Window      int  `default:"60"`
+	}
+	KeyPattern struct {
+		Enable        bool     `default:"false"`
+		Rules         []string // rules in "type:pattern" format
+		AutoNormalize bool     `default:"true"`
+		Window        int      `default:"60"`
+	}
+	Channel struct {
+		Enable bool `default:"false"`
+		Window int  `default:"60"`
+	}
+	Blocking struct {
+		Enable bool `default:"false"`
+		Window int  `default:"60"`
+	}
+	Tracking struct {
+		Enable    bool    `default:"false"`
+		Window    int     `default:"60"`
+		StormRate float64 `default:"10000"`
+	}
+	Cluster struct {
+		Enable bool `default:"false"`
+		Window int  `default:"60"`
+	}
+	Sentinel struct {
+		Enable bool `default:"false"`
+		Window int  `default:"60"`
+	}
+	Error struct {
+		Enable bool `default:"false"`
+		Window int  `default:"60"`
+	}
+	Redact struct {
+		Enable   bool     `default:"false"`
+		Mask     string   `default:"***"`
+		HashKey  string   `default:""`
+		Rules    []string // rules in "action:command[:positions]" format
+		Patterns []string // regular expressions scrubbed from recorded values
+	}
+	Pipeline struct {
+		Workers       int  `default:"0"` // 0 analyzes on the capture loop
+		QueueSize     int  `default:"1024"`
+		Block         bool `default:"true"`
+		StatsInterval int  `default:"60"` // seconds, 0 disables
+	}
+	Sampling struct {
+		Enable     bool    `default:"false"`
+		Mode       string  `default:"uniform"`
+		Rate       float64 `default:"0.01"`
+		KeepErrors bool    `default:"true"`
+		KeepSlow   int     `default:"10"` // milliseconds, 0 disables
+		Window     int     `default:"60"`
 	}
 )
 
 var Config *redsnif.SniffConfig
 
+// HubPipeline is nil if results are analyzed on the capture loop
+var HubPipeline *datahub.PipelineConfig
+
+var StatsInterval time.Duration
+
 func initConfig(configFile string) error {
 	m := multiconfig.NewWithPath(configFile)
 	mcfg := new(MainConfig)
@@ -43,18 +131,154 @@ func initConfig(configFile string) error {
 
 	Config = &redsnif.SniffConfig{}
 	Config.Device = mcfg.Network.Device
+	Config.PcapFile = mcfg.Network.PcapFile
+	encap, err := redsnif.ParseEncap(mcfg.Network.Encap)
+	if err != nil {
+		return err
+	}
+	Config.Encap = encap
 	Config.Snaplen = int32(mcfg.Network.Snaplen)
 	Config.Timeout = time.Duration(time.Millisecond * time.Duration(mcfg.Network.Timeout))
 	Config.Promiscuous = mcfg.Network.Promiscuous
 	Config.UseZeroCopy = mcfg.Network.UseZeroCopy
 	Config.Host = mcfg.Redis.Host
 	Config.Port = mcfg.Redis.Port
+	for _, target := range mcfg.Redis.Targets {
+		ep, err := redsnif.ParseEndpoint(target)
+		if err != nil {
+			return err
+		}
+		Config.Targets = append(Config.Targets, ep)
+	}
 	Config.MaxBufSize = mcfg.Redis.MaxBufSize
+	Config.SessionIdle = time.Duration(mcfg.Redis.SessionIdle) * time.Second
+	if mcfg.Proxy.Enable {
+		Config.Proxy = &redsnif.ProxyConfig{
+			Listen:   mcfg.Proxy.Listen,
+			Upstream: mcfg.Proxy.Upstream,
+		}
+	}
 	Config.AzConfig = &redsnif.AnalyzeConfig{
 		ReadHitAnalyze: mcfg.Analyze.ReadHitAnalyze,
+		ReplStream:     mcfg.Analyze.ReplStream,
 		SaveCmdTypes:   mcfg.Analyze.SaveCmdTypes,
 		SaveDetail:     mcfg.Analyze.SaveDetail,
 	}
+	for _, r := range mcfg.Analyze.RecordRules {
+		rule, err := redsnif.ParseRecordRule(r)
+		if err != nil {
+			return err
+		}
+		Config.AzConfig.RecordRules = append(Config.AzConfig.RecordRules, rule)
+	}
+	if mcfg.BigKey.Enable {
+		Config.AzConfig.BigKey = &redsnif.BigKeyConfig{
+			MaxBytes:    mcfg.BigKey.MaxBytes,
+			MaxElements: mcfg.BigKey.MaxElements,
+			TopN:        mcfg.BigKey.TopN,
+			Window:      time.Duration(mcfg.BigKey.Window) * time.Second,
+		}
+	}
+	if mcfg.KeyPattern.Enable {
+		rules := make([]redsnif.PatternRule, 0, len(mcfg.KeyPattern.Rules))
+		for _, r := range mcfg.KeyPattern.Rules {
+			rule, err := redsnif.ParsePatternRule(r)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+		matcher, err := redsnif.NewKeyPatternMatcher(rules, mcfg.KeyPattern.AutoNormalize)
+		if err != nil {
+			return err
+		}
+		Config.AzConfig.KeyPattern = &redsnif.KeyPatternConfig{
+			Matcher: matcher,
+			Window:  time.Duration(mcfg.KeyPattern.Window) * time.Second,
+		}
+	}
+	if mcfg.Channel.Enable {
+		Config.AzConfig.Channel = &redsnif.ChannelConfig{
+			Window: time.Duration(mcfg.Channel.Window) * time.Second,
+		}
+	}
+	if mcfg.Cluster.Enable {
+		Config.AzConfig.Cluster = &redsnif.ClusterConfig{
+			Window: time.Duration(mcfg.Cluster.Window) * time.Second,
+		}
+	}
+	if mcfg.Error.Enable {
+		Config.AzConfig.Error = &redsnif.ErrorConfig{
+			Window: time.Duration(mcfg.Error.Window) * time.Second,
+		}
+	}
+	if mcfg.Redact.Enable {
+		rc := &redsnif.RedactConfig{
+			Mask:    mcfg.Redact.Mask,
+			HashKey: mcfg.Redact.HashKey,
+		}
+		for _, r := range mcfg.Redact.Rules {
+			rule, err := redsnif.ParseRedactRule(r)
+			if err != nil {
+				return err
+			}
+			rc.Rules = append(rc.Rules, rule)
+		}
+		for _, p := range mcfg.Redact.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return err
+			}
+			rc.Patterns = append(rc.Patterns, re)
+		}
+		Config.AzConfig.Redact = rc
+	}
+	StatsInterval = time.Duration(mcfg.Pipeline.StatsInterval) * time.Second
+	if mcfg.Pipeline.Workers > 0 {
+		HubPipeline = &datahub.PipelineConfig{
+			Workers:   mcfg.Pipeline.Workers,
+			QueueSize: mcfg.Pipeline.QueueSize,
+			Block:     mcfg.Pipeline.Block,
+		}
+	}
+	if mcfg.Sampling.Enable {
+		mode, err := redsnif.ParseSampleMode(mcfg.Sampling.Mode)
+		if err != nil {
+			return err
+		}
+		Config.AzConfig.Sampling = &redsnif.SamplingConfig{
+			Mode:       mode,
+			Rate:       mcfg.Sampling.Rate,
+			KeepErrors: mcfg.Sampling.KeepErrors,
+			KeepSlow:   time.Duration(mcfg.Sampling.KeepSlow) * time.Millisecond,
+			Window:     time.Duration(mcfg.Sampling.Window) * time.Second,
+		}
+	}
+	if mcfg.Sentinel.Enable {
+		Config.AzConfig.Sentinel = &redsnif.SentinelConfig{
+			Window: time.Duration(mcfg.Sentinel.Window) * time.Second,
+		}
+	}
+	if mcfg.Tracking.Enable {
+		// invalidated keys are bucketed by the rules of KeyPattern if enabled
+		matcher, err := redsnif.NewKeyPatternMatcher(nil, true)
+		if err != nil {
+			return err
+		}
+		if Config.AzConfig.KeyPattern != nil {
+			matcher = Config.AzConfig.KeyPattern.Matcher
+		}
+		Config.AzConfig.Tracking = &redsnif.TrackingConfig{
+			Matcher:   matcher,
+			Window:    time.Duration(mcfg.Tracking.Window) * time.Second,
+			StormRate: mcfg.Tracking.StormRate,
+		}
+	}
+	if mcfg.Blocking.Enable {
+		Config.AzConfig.Blocking = &redsnif.BlockingConfig{
+			Window: time.Duration(mcfg.Blocking.Window) * time.Second,
+		}
+	}
 
 	return nil
 }
@@ -74,9 +298,13 @@ func main() {
 		panic(err)
 	}
 
+	// timestamps in nanoseconds keep timing of requests replayed from the log
+	// by redreplay
 	hubcfg := &datahub.LogHubConfig{
-		Output: f,
-		Format: &logrus.JSONFormatter{},
+		Output:        f,
+		Format:        &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano},
+		Pipeline:      HubPipeline,
+		StatsInterval: StatsInterval,
 	}
 	lh := datahub.NewLogHubber(Config, hubcfg)
 	if err := lh.Run(); err != nil {
@@ -1,14 +1,17 @@
 package main
 
 import (
-	"encoding/hex"
 	"fmt"
+	"github.com/amyangfei/redsnif/datahub"
 	redsnif "github.com/amyangfei/redsnif/rsniffer"
 	"github.com/koding/multiconfig"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
@@ -18,19 +21,162 @@ type CacheOpRecord struct {
 	err  int64
 }
 
+func (cor *CacheOpRecord) Add(status int) {
+	switch status {
+	case redsnif.KeyHit:
+		cor.hit++
+	case redsnif.KeyMiss:
+		cor.miss++
+	case redsnif.KeyError:
+		cor.err++
+	}
+}
+
+func (cor *CacheOpRecord) Total() int64 {
+	return cor.hit + cor.miss + cor.err
+}
+
 func (cor *CacheOpRecord) Stat() string {
-	total := cor.hit + cor.miss + cor.err
+	total := cor.Total()
+	if total == 0 {
+		return "-\t-\t0"
+	}
 	hitrate := float64(cor.hit) / float64(total)
 	missrate := float64(cor.miss) / float64(total)
-	return fmt.Sprintf(
-		"hitrate: %.3f missrate: %.3f total: %d", hitrate, missrate, total)
+	return fmt.Sprintf("%.3f\t%.3f\t%d", hitrate, missrate, total)
+}
+
+// HitRecord keeps the record of current interval and the cumulative one
+type HitRecord struct {
+	interval   *CacheOpRecord
+	cumulative *CacheOpRecord
+}
+
+func NewHitRecord() *HitRecord {
+	return &HitRecord{
+		interval:   &CacheOpRecord{},
+		cumulative: &CacheOpRecord{},
+	}
+}
+
+func (hr *HitRecord) Add(status int) {
+	hr.interval.Add(status)
+	hr.cumulative.Add(status)
+}
+
+// HitRateAnalyzer collects hit rate of read commands globally, per session and
+// per key pattern, it is fed by the BaseHub so pipelining and transactions are
+// paired correctly. Ended sessions are removed after they are reported.
+type HitRateAnalyzer struct {
+	matcher  *redsnif.KeyPatternMatcher
+	mu       sync.Mutex // guards records, held by Report too
+	global   *HitRecord
+	sessions map[string]*HitRecord
+	clients  map[string]string
+	ended    map[string]bool
+	patterns map[string]*HitRecord
+}
+
+func NewHitRateAnalyzer(matcher *redsnif.KeyPatternMatcher) *HitRateAnalyzer {
+	return &HitRateAnalyzer{
+		matcher:  matcher,
+		global:   NewHitRecord(),
+		sessions: map[string]*HitRecord{},
+		clients:  map[string]string{},
+		ended:    map[string]bool{},
+		patterns: map[string]*HitRecord{},
+	}
+}
+
+func (ha *HitRateAnalyzer) Analyze(hs *datahub.HubSession, cmd *redsnif.Command, reqRD, replyRD *redsnif.RespData, handler datahub.AnalyzeResultHandler) {
+	stats := redsnif.KeyHitAnalyze(cmd, strings.ToUpper(cmd.Name()), replyRD)
+	if stats == nil {
+		return
+	}
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	session, ok := ha.sessions[hs.ID()]
+	if !ok {
+		session = NewHitRecord()
+		ha.sessions[hs.ID()] = session
+		ha.clients[hs.ID()] = hs.Client()
+	} else if ha.ended[hs.ID()] {
+		// address of the ended session is reused before Report
+		delete(ha.ended, hs.ID())
+	}
+	for _, stat := range stats {
+		status := stat["status"].(int)
+		ha.global.Add(status)
+		session.Add(status)
+		pattern := ha.matcher.Match(stat["key"].(string))
+		record, ok := ha.patterns[pattern]
+		if !ok {
+			record = NewHitRecord()
+			ha.patterns[pattern] = record
+		}
+		record.Add(status)
+	}
+}
+
+// SessionEnd marks the session to be removed by the next Report
+func (ha *HitRateAnalyzer) SessionEnd(hs *datahub.HubSession, handler datahub.AnalyzeResultHandler) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	if _, ok := ha.sessions[hs.ID()]; ok {
+		ha.ended[hs.ID()] = true
+	}
+}
+
+// Tick does nothing, hit rate table is printed by Report in report interval
+func (ha *HitRateAnalyzer) Tick(now time.Time, handler datahub.AnalyzeResultHandler) {
 }
 
-type RedisSession struct {
-	sid        string
-	record     *CacheOpRecord
-	lastPacket *redsnif.PacketInfo
-	lastResp   *redsnif.RespData
+func (ha *HitRateAnalyzer) Report(interval time.Duration) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "==== %s, interval %s ====\n", time.Now().Format("2006-01-02 15:04:05"), interval)
+	fmt.Fprintln(w, "SCOPE\tNAME\tHITRATE\tMISSRATE\tTOTAL\tCUM HITRATE\tCUM MISSRATE\tCUM TOTAL")
+	fmt.Fprintf(w, "global\t-\t%s\t%s\n", ha.global.interval.Stat(), ha.global.cumulative.Stat())
+
+	sids := make([]string, 0, len(ha.sessions))
+	for sid, record := range ha.sessions {
+		// only show sessions active in this interval
+		if record.interval.Total() > 0 {
+			sids = append(sids, sid)
+		}
+	}
+	sort.Strings(sids)
+	for _, sid := range sids {
+		record := ha.sessions[sid]
+		fmt.Fprintf(w, "session\t%s(%s)\t%s\t%s\n", sid, ha.clients[sid],
+			record.interval.Stat(), record.cumulative.Stat())
+	}
+
+	patterns := make([]string, 0, len(ha.patterns))
+	for pattern := range ha.patterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		record := ha.patterns[pattern]
+		fmt.Fprintf(w, "pattern\t%s\t%s\t%s\n", pattern,
+			record.interval.Stat(), record.cumulative.Stat())
+	}
+	w.Flush()
+
+	ha.global.interval = &CacheOpRecord{}
+	for sid := range ha.ended {
+		delete(ha.sessions, sid)
+		delete(ha.clients, sid)
+	}
+	ha.ended = map[string]bool{}
+	for _, record := range ha.sessions {
+		record.interval = &CacheOpRecord{}
+	}
+	for _, record := range ha.patterns {
+		record.interval = &CacheOpRecord{}
+	}
 }
 
 type (
@@ -46,18 +192,19 @@ type (
 		UseZeroCopy bool   `default:"true"`
 	}
 	Redis struct {
-		Host       string   `required:"true"`
-		Port       int      `required:"true"`
-		KeyPattern []string `required:"true"`
+		Host          string   `default:"127.0.0.1"`
+		Port          int      `default:"6379"`
+		Targets       []string // endpoints such as "10.0.0.1:6379-6390", override Host and Port
+		MaxBufSize    int      `default:"10240"`
+		KeyPattern    []string `required:"true"`
+		AutoNormalize bool     `default:"false"`
+		Interval      int      `default:"5"`
 	}
 )
 
 var Config *redsnif.SniffConfig
 var MConfig *MainConfig
-
-var GlobalRecord *CacheOpRecord
-var Sessions map[string]*RedisSession
-var Patterns map[string]*CacheOpRecord
+var Matcher *redsnif.KeyPatternMatcher
 
 var quit = make(chan struct{})
 
@@ -69,20 +216,15 @@ func initSignal() chan os.Signal {
 	return c
 }
 
-func handleSignal(c chan os.Signal) {
-	// Block until a signal is received
-	for {
-		s := <-c
-		switch s {
-		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGINT:
-			close(quit)
-			return
-		case syscall.SIGHUP:
-			// TODO reload
-		default:
-			return
-		}
+// handleSignal returns true if the signal asks to quit
+func handleSignal(s os.Signal) bool {
+	switch s {
+	case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGINT:
+		return true
+	case syscall.SIGHUP:
+		// TODO reload
 	}
+	return false
 }
 
 func initConfig(configFile string) error {
@@ -98,108 +240,76 @@ func initConfig(configFile string) error {
 	Config.UseZeroCopy = MConfig.Network.UseZeroCopy
 	Config.Host = MConfig.Redis.Host
 	Config.Port = MConfig.Redis.Port
+	for _, target := range MConfig.Redis.Targets {
+		ep, err := redsnif.ParseEndpoint(target)
+		if err != nil {
+			return err
+		}
+		Config.Targets = append(Config.Targets, ep)
+	}
+	Config.MaxBufSize = MConfig.Redis.MaxBufSize
+	// hit rate is collected by HitRateAnalyzer, no command is recorded
+	Config.AzConfig = &redsnif.AnalyzeConfig{
+		ReadHitAnalyze: false,
+		SaveCmdTypes:   []int{},
+		SaveDetail:     redsnif.RecordCmdOnly,
+	}
 
-	return nil
-}
-
-func initService() error {
-	GlobalRecord = &CacheOpRecord{}
-	Sessions = map[string]*RedisSession{}
-	Patterns = map[string]*CacheOpRecord{}
+	rules := make([]redsnif.PatternRule, 0, len(MConfig.Redis.KeyPattern))
 	for _, pattern := range MConfig.Redis.KeyPattern {
-		Patterns[pattern] = &CacheOpRecord{hit: 0, miss: 0, err: 0}
+		rule, err := redsnif.ParsePatternRule(pattern)
+		if err != nil {
+			// plain prefix such as 'user'
+			rule = redsnif.PatternRule{Type: redsnif.PatternPrefix, Pattern: pattern}
+		}
+		rules = append(rules, rule)
 	}
-	return nil
+	var err error
+	Matcher, err = redsnif.NewKeyPatternMatcher(rules, MConfig.Redis.AutoNormalize)
+	return err
 }
 
-func sniffer() {
-	c := make(chan *redsnif.PacketInfo)
-	go func() {
-		if err := redsnif.PacketSniff(Config, c); err != nil {
-			panic(err)
-		}
-	}()
+// sniffer reports hit rate until quit, the error is returned if capture fails
+func sniffer() error {
+	hub := datahub.NewBaseHub(Config)
+	analyzer := NewHitRateAnalyzer(Matcher)
+	hub.AddAnalyzer(analyzer)
+	ignore := func(fields map[string]interface{}, err error) {}
+
+	c := make(chan *redsnif.RedSession)
+	ec := make(chan error)
+	snf := redsnif.NewSniffer(Config)
+	go snf.Run(redsnif.NewChanSink(c, ec))
+
+	interval := time.Duration(MConfig.Redis.Interval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		info := <-c
-		respData, err := info.GetRespData()
-		if err != nil {
-			panic(err)
-		}
-		if session, ok := Sessions[string(info.SessionID)]; !ok {
-			Sessions[string(info.SessionID)] = &RedisSession{
-				sid:        string(info.SessionID),
-				record:     &CacheOpRecord{hit: 0, miss: 0, err: 0},
-				lastPacket: info,
-				lastResp:   respData,
+		select {
+		case rs := <-c:
+			hub.AnalyzePacketInfo(rs, ignore)
+		case err := <-ec:
+			if hub.HandleSniffError(err, ignore) {
+				analyzer.Report(interval)
+				return err
 			}
-		} else {
-			// last packet contains redis command
-			if session.lastResp.IsArray() {
-				cmd, _ := session.lastResp.GetCommand()
-				// last command is get
-				if strings.ToUpper(cmd.Name()) == "GET" {
-					candidates := make([]*CacheOpRecord, 0)
-					if len(cmd.Args) > 1 {
-						key := cmd.Args[1]
-						for _, prefix := range MConfig.Redis.KeyPattern {
-							if strings.HasPrefix(key, prefix) {
-								candidates = append(candidates, Patterns[prefix])
-							}
-						}
-					}
-					if !respData.IsBulk() {
-						session.record.err++
-						GlobalRecord.err++
-						if len(candidates) > 0 {
-							for _, pattern := range candidates {
-								pattern.err++
-							}
-						}
-					} else if len(respData.Msg.Bytes) == 0 {
-						session.record.miss++
-						GlobalRecord.miss++
-						if len(candidates) > 0 {
-							for _, pattern := range candidates {
-								pattern.miss++
-							}
-						}
-					} else {
-						session.record.hit++
-						GlobalRecord.hit++
-						if len(candidates) > 0 {
-							for _, pattern := range candidates {
-								pattern.hit++
-							}
-						}
-					}
-				}
-			}
-			session.lastPacket = info
-			session.lastResp = respData
+		case <-ticker.C:
+			analyzer.Report(interval)
+			reportCapture(snf, hub)
+		case <-quit:
+			analyzer.Report(interval)
+			reportCapture(snf, hub)
+			return nil
 		}
 	}
 }
 
-func reporter() {
-	ticker := time.NewTicker(5 * time.Second)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				fmt.Printf("global stat: %s\n", GlobalRecord.Stat())
-				for sid, session := range Sessions {
-					fmt.Printf("session: %s, stat: %s \n",
-						hex.EncodeToString([]byte(sid)), session.record.Stat())
-				}
-				for pattern, record := range Patterns {
-					fmt.Printf("pattern: %s, stat: %s \n", pattern, record.Stat())
-				}
-			case <-quit:
-				ticker.Stop()
-				return
-			}
-		}
-	}()
+// reportCapture prints data lost by sniffer, hit rates are less trustworthy
+// if packets are dropped or requests are not paired with replies
+func reportCapture(snf *redsnif.Sniffer, hub *datahub.BaseHub) {
+	cs, hs := snf.Stats(), hub.Stats()
+	fmt.Printf("capture: packets %d, kernel dropped %d, if dropped %d, overflows %d, desyncs %d, unpaired requests %d, unpaired replies %d\n",
+		cs.Packets, cs.Dropped, cs.IfDropped, cs.Overflows, hs.Desyncs, hs.UnpairedRequests, hs.UnpairedReplies)
 }
 
 func main() {
@@ -210,12 +320,27 @@ func main() {
 	if err := initConfig(configFile); err != nil {
 		panic(err)
 	}
-	if err := initService(); err != nil {
-		panic(err)
-	}
-	go sniffer()
-	go reporter()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sniffer()
+	}()
 
 	signalChan := initSignal()
-	handleSignal(signalChan)
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "sniffer error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case s := <-signalChan:
+			if handleSignal(s) {
+				close(quit)
+				// wait for the last report
+				signalChan = nil
+			}
+		}
+	}
 }
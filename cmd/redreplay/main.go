@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	redsnif "github.com/amyangfei/redsnif/rsniffer"
+	"github.com/amyangfei/resp-go/resp"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	device     = flag.String("i", "", "network device to capture, requests are replayed as they are captured")
+	pcapFile   = flag.String("r", "", "replay requests in pcap file")
+	logFile    = flag.String("log", "", "replay requests in JSON event log, which is recorded with request detail")
+	target     = flag.String("target", "", "redis to replay to, \"unix:/path\" or \"tcp:host:port\"")
+	auth       = flag.String("auth", "", "password of target redis, AUTH of source is never replayed")
+	speed      = flag.Float64("speed", 0, "0 replays as fast as possible, 1 keeps the original timing, 2 twice as fast")
+	types      = flag.String("types", "", "comma separated command types to replay: read, write, func, all if empty")
+	skipWrites = flag.Bool("skip-writes", false, "skip write commands, and unknown commands which may write")
+	patterns   = flag.String("patterns", "", "comma separated key pattern rules in \"type:pattern\" format, replay commands with a matching key")
+	timeout    = flag.Duration("timeout", 5*time.Second, "time to wait for replies when a session ends")
+	host       = flag.String("H", "127.0.0.1", "redis host of capture")
+	port       = flag.Int("p", 6379, "redis port of capture")
+	targets    = flag.String("t", "", "comma separated redis endpoints of capture, e.g. \"10.0.0.1:6379-6390,*:6380\", override -H and -p")
+	encap      = flag.String("encap", "", "comma separated encapsulations to capture: vlan, vxlan, gre")
+	snaplen    = flag.Int("s", 1500, "snapshot length of packets")
+	bufSize    = flag.Int("b", 10240, "max buffer size of a redis session")
+)
+
+func initConfig() (*redsnif.SniffConfig, *Filter, error) {
+	cfg := redsnif.DefaultSniffConfig()
+	cfg.Device = *device
+	cfg.PcapFile = *pcapFile
+	cfg.Host = *host
+	cfg.Port = *port
+	if *targets != "" {
+		for _, t := range strings.Split(*targets, ",") {
+			ep, err := redsnif.ParseEndpoint(t)
+			if err != nil {
+				return nil, nil, err
+			}
+			cfg.Targets = append(cfg.Targets, ep)
+		}
+	}
+	if *encap != "" {
+		var err error
+		if cfg.Encap, err = redsnif.ParseEncap(strings.Split(*encap, ",")); err != nil {
+			return nil, nil, err
+		}
+	}
+	cfg.Snaplen = int32(*snaplen)
+	cfg.MaxBufSize = *bufSize
+	cfg.Timeout = 100 * time.Millisecond
+	// requests are decoded from sessions directly, nothing is analyzed
+	cfg.AzConfig = &redsnif.AnalyzeConfig{
+		SaveCmdTypes: []int{},
+		SaveDetail:   redsnif.RecordCmdOnly,
+	}
+
+	filter := &Filter{SkipWrites: *skipWrites}
+	if *types != "" {
+		filter.Types = map[int]bool{}
+		for _, name := range strings.Split(*types, ",") {
+			cmdType, ok := cmdTypes[strings.ToLower(name)]
+			if !ok {
+				return nil, nil, fmt.Errorf("unknown command type %q", name)
+			}
+			filter.Types[cmdType] = true
+		}
+	}
+	if *patterns != "" {
+		rules := make([]redsnif.PatternRule, 0)
+		for _, r := range strings.Split(*patterns, ",") {
+			rule, err := redsnif.ParsePatternRule(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			rules = append(rules, rule)
+		}
+		matcher, err := redsnif.NewKeyPatternMatcher(rules, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		filter.Keys = matcher
+	}
+	return cfg, filter, nil
+}
+
+// replayCapture replays requests of sessions captured by sniffer, a session
+// is closed on target when it ends in capture.
+func replayCapture(cfg *redsnif.SniffConfig, rp *Replayer, quit chan struct{}) error {
+	c := make(chan *redsnif.RedSession)
+	ec := make(chan error)
+	go redsnif.Sniff(cfg, c, ec)
+	for {
+		select {
+		case rs := <-c:
+			replaySession(rs, rp)
+		case err := <-ec:
+			if err == io.EOF {
+				return nil
+			}
+			switch e := err.(type) {
+			case *redsnif.CaptureError:
+				return err
+			case *redsnif.SessionEvent:
+				switch e.Kind {
+				case redsnif.SessionClose, redsnif.SessionReset, redsnif.SessionEvicted:
+					// data left in buffer is replayed first
+					replaySession(e.Session, rp)
+					rp.Close(hex.EncodeToString(e.Session.ID))
+				}
+			}
+		case <-quit:
+			return nil
+		}
+	}
+}
+
+// replaySession replays requests buffered in session, replies are decoded
+// and dropped.
+func replaySession(rs *redsnif.RedSession, rp *Replayer) {
+	request, _, _ := rs.GetRespData()
+	sid := hex.EncodeToString(rs.ID)
+	for _, reqRD := range request {
+		cmd, err := reqRD.GetCommand()
+		if err != nil {
+			rp.stats.Invalid++
+			continue
+		}
+		payload, err := reqRD.RawPayload()
+		if err != nil {
+			rp.stats.Invalid++
+			continue
+		}
+		rp.Send(sid, reqRD.Time, cmd, payload)
+	}
+}
+
+// replayLog replays the request field of results in JSON event log, such as
+// log of LogHubber with RecordRequest detail. Sessions are told by the
+// session field, timing is taken from the capture time of each request.
+// Requests without capture time are sent without waiting.
+func replayLog(path string, rp *Replayer, quit chan struct{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		select {
+		case <-quit:
+			return nil
+		default:
+		}
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			continue
+		}
+		request, ok := fields[redsnif.AnalyzeRequest].(string)
+		if !ok {
+			// results without request, such as events
+			continue
+		}
+		msgs, _, err := resp.Decode([]byte(request))
+		if err != nil || len(msgs) == 0 {
+			rp.stats.Invalid++
+			continue
+		}
+		reqRD := &redsnif.RespData{Msg: msgs[0]}
+		if ts, ok := fields[redsnif.AnalyzeReqTime].(string); ok {
+			reqRD.Time, _ = time.Parse(time.RFC3339Nano, ts)
+		}
+		cmd, err := reqRD.GetCommand()
+		if err != nil {
+			rp.stats.Invalid++
+			continue
+		}
+		sid, _ := fields[redsnif.AnalyzeSession].(string)
+		rp.Send(sid, reqRD.Time, cmd, []byte(request))
+	}
+	return scanner.Err()
+}
+
+func printStats(w io.Writer, stats ReplayStats, elapsed time.Duration) {
+	fmt.Fprintf(w, "requests %d, replayed %d, filtered %d, unreplayable %d, invalid %d, dropped %d\n",
+		stats.Requests, stats.Replayed, stats.Filtered, stats.Unreplayable, stats.Invalid, stats.Dropped)
+	fmt.Fprintf(w, "sessions %d, replies %d, error replies %d, connection errors %d, elapsed %s\n",
+		stats.Sessions, stats.Replies, stats.ErrorReplies, stats.ConnErrors, elapsed)
+}
+
+func main() {
+	flag.Parse()
+	if *target == "" || (*device == "" && *pcapFile == "" && *logFile == "") {
+		fmt.Fprintln(os.Stderr, "-target and one of -i, -r and -log are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	cfg, filter, err := initConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	quit := make(chan struct{})
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		<-sigc
+		close(quit)
+	}()
+
+	rp := NewReplayer(*target, *auth, *speed, *timeout, filter, quit)
+	start := time.Now()
+	if *logFile != "" {
+		err = replayLog(*logFile, rp, quit)
+	} else {
+		err = replayCapture(cfg, rp, quit)
+	}
+	rp.Wait()
+	printStats(os.Stdout, rp.Stats(), time.Since(start))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay error: %v\n", err)
+		os.Exit(1)
+	}
+}
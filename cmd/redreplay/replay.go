@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	redsnif "github.com/amyangfei/redsnif/rsniffer"
+	"github.com/amyangfei/resp-go/resp"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// commands which are not replayed, they change the protocol of connection,
+// authenticate with credentials of the source, or disturb the target
+var unreplayable = map[string]bool{
+	"AUTH":         true,
+	"HELLO":        true,
+	"QUIT":         true,
+	"MONITOR":      true,
+	"SYNC":         true,
+	"PSYNC":        true,
+	"REPLCONF":     true,
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"SHUTDOWN":     true,
+	"REPLICAOF":    true,
+	"SLAVEOF":      true,
+	"FAILOVER":     true,
+	"DEBUG":        true,
+	"CLUSTER":      true,
+	"CLIENT":       true, // CLIENT REPLY OFF leaves requests without reply
+	"WAIT":         true,
+	"WAITAOF":      true,
+	"BGSAVE":       true,
+	"BGREWRITEAOF": true,
+	"SAVE":         true,
+}
+
+// cmdTypes maps names of command type used in flags to its value
+var cmdTypes = map[string]int{
+	"read":  redsnif.RedisCmdRead,
+	"write": redsnif.RedisCmdWrite,
+	"func":  redsnif.RedisCmdFunc,
+}
+
+// Filter decides which commands are replayed
+type Filter struct {
+	Types      map[int]bool               // command types to replay, any type if nil
+	SkipWrites bool                       // skip write commands and unknown commands which may write
+	Keys       *redsnif.KeyPatternMatcher // replay commands with a key matching a rule, any command if nil
+}
+
+// Allow tells whether the command is replayed, commands without key pass the
+// key filter so that context such as SELECT and MULTI is kept.
+func (f *Filter) Allow(cmd *redsnif.Command) bool {
+	cmdType, known := redsnif.RedisCmds[strings.ToUpper(cmd.Name())]
+	if f.Types != nil && !f.Types[cmdType] {
+		return false
+	}
+	if f.SkipWrites && (!known || cmdType == redsnif.RedisCmdWrite) {
+		return false
+	}
+	if f.Keys == nil {
+		return true
+	}
+	keys := cmd.Keys()
+	if len(keys) == 0 {
+		return true
+	}
+	for _, key := range keys {
+		if f.Keys.Match(key) != redsnif.PatternOther {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplayStats counts requests of source and replies of target
+type ReplayStats struct {
+	Requests     int64 // requests read from source
+	Replayed     int64 // requests sent to target
+	Filtered     int64 // requests skipped by Filter
+	Unreplayable int64 // requests skipped as they are unreplayable
+	Invalid      int64 // requests which are not a command
+	Dropped      int64 // requests not sent as the connection failed
+	Sessions     int64 // connections opened to target
+	Replies      int64
+	ErrorReplies int64
+	ConnErrors   int64
+}
+
+// Replayer sends requests to the target redis, each session of source is
+// replayed on its own connection in order. Requests are sent as fast as
+// possible if speed is 0, otherwise inter-arrival time of requests is kept
+// and scaled by speed.
+type Replayer struct {
+	network string
+	address string
+	auth    string
+	speed   float64
+	timeout time.Duration // time to wait for replies when a session closes
+	filter  *Filter
+	stop    chan struct{}
+
+	conns map[string]*replayConn // nil connection if dialing failed
+	first time.Time              // time of the first timed request of source
+	start time.Time              // when the first timed request is replayed
+	wg    sync.WaitGroup
+	stats ReplayStats
+}
+
+func NewReplayer(target, auth string, speed float64, timeout time.Duration, filter *Filter, stop chan struct{}) *Replayer {
+	network, address := redsnif.ParseProxyAddr(target)
+	return &Replayer{
+		network: network,
+		address: address,
+		auth:    auth,
+		speed:   speed,
+		timeout: timeout,
+		filter:  filter,
+		stop:    stop,
+		conns:   map[string]*replayConn{},
+	}
+}
+
+// Send replays the request of session captured at t, payload is the raw
+// request. It blocks until the request is due if timing is kept.
+func (rp *Replayer) Send(session string, t time.Time, cmd *redsnif.Command, payload []byte) {
+	rp.stats.Requests++
+	if unreplayable[strings.ToUpper(cmd.Name())] {
+		rp.stats.Unreplayable++
+		return
+	}
+	if !rp.filter.Allow(cmd) {
+		rp.stats.Filtered++
+		return
+	}
+	rp.wait(t)
+	rc, ok := rp.conns[session]
+	if !ok {
+		rc = rp.dial()
+		rp.conns[session] = rc
+	}
+	if rc == nil {
+		atomic.AddInt64(&rp.stats.Dropped, 1)
+		return
+	}
+	rc.queue <- payload
+}
+
+// wait sleeps until the request captured at t is due
+func (rp *Replayer) wait(t time.Time) {
+	if rp.speed <= 0 || t.IsZero() {
+		return
+	}
+	if rp.first.IsZero() {
+		rp.first, rp.start = t, time.Now()
+		return
+	}
+	due := rp.start.Add(time.Duration(float64(t.Sub(rp.first)) / rp.speed))
+	if d := due.Sub(time.Now()); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-rp.stop:
+		}
+	}
+}
+
+func (rp *Replayer) dial() *replayConn {
+	conn, err := net.Dial(rp.network, rp.address)
+	if err != nil {
+		atomic.AddInt64(&rp.stats.ConnErrors, 1)
+		return nil
+	}
+	rc := &replayConn{conn: conn, queue: make(chan []byte, 1024)}
+	if rp.auth != "" {
+		// the reply is counted by the reader as other replies
+		if _, err := conn.Write(encodeCommand("AUTH", rp.auth)); err != nil {
+			conn.Close()
+			atomic.AddInt64(&rp.stats.ConnErrors, 1)
+			return nil
+		}
+		rc.sent++
+	}
+	atomic.AddInt64(&rp.stats.Sessions, 1)
+	rp.wg.Add(2)
+	go rc.write(rp)
+	go rc.read(rp)
+	return rc
+}
+
+// Close closes the connection of session after replies of sent requests are
+// received, the session is replayed on a new connection if it is seen again.
+func (rp *Replayer) Close(session string) {
+	if rc, ok := rp.conns[session]; ok {
+		if rc != nil {
+			close(rc.queue)
+		}
+		delete(rp.conns, session)
+	}
+}
+
+// Wait closes all sessions and waits for their replies
+func (rp *Replayer) Wait() {
+	for session := range rp.conns {
+		rp.Close(session)
+	}
+	rp.wg.Wait()
+}
+
+// Stats returns the statistics, it should be called after Wait
+func (rp *Replayer) Stats() ReplayStats {
+	return rp.stats
+}
+
+// replayConn is a connection to target, requests are pipelined by the
+// writer and replies are counted by the reader.
+type replayConn struct {
+	conn  net.Conn
+	queue chan []byte
+
+	mu      sync.Mutex
+	sent    int64
+	replied int64
+	closing bool // no more requests will be sent
+}
+
+func (rc *replayConn) write(rp *Replayer) {
+	defer rp.wg.Done()
+	w := bufio.NewWriter(rc.conn)
+	var err error
+	for payload := range rc.queue {
+		if err != nil {
+			atomic.AddInt64(&rp.stats.Dropped, 1)
+			continue
+		}
+		if _, err = w.Write(payload); err == nil && len(rc.queue) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			// the reader stops on the closed connection
+			atomic.AddInt64(&rp.stats.ConnErrors, 1)
+			atomic.AddInt64(&rp.stats.Dropped, 1)
+			rc.conn.Close()
+			continue
+		}
+		atomic.AddInt64(&rp.stats.Replayed, 1)
+		rc.mu.Lock()
+		rc.sent++
+		rc.mu.Unlock()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+
+	rc.mu.Lock()
+	rc.closing = true
+	done := err != nil || rc.replied >= rc.sent
+	rc.mu.Unlock()
+	if done {
+		rc.conn.Close()
+		return
+	}
+	// requests such as blocking commands may never be replied
+	rc.conn.SetReadDeadline(time.Now().Add(rp.timeout))
+}
+
+func (rc *replayConn) read(rp *Replayer) {
+	defer rp.wg.Done()
+	defer rc.conn.Close()
+	buf := make([]byte, 0, 4096)
+	b := make([]byte, 4096)
+	for {
+		n, err := rc.conn.Read(b)
+		buf = append(buf, b[:n]...)
+		msgs, pos, _ := resp.Decode(buf)
+		buf = buf[:copy(buf, buf[pos:])]
+		for _, msg := range msgs {
+			atomic.AddInt64(&rp.stats.Replies, 1)
+			if msg.Type == resp.ErrorHeader {
+				atomic.AddInt64(&rp.stats.ErrorReplies, 1)
+			}
+		}
+
+		rc.mu.Lock()
+		rc.replied += int64(len(msgs))
+		done := rc.closing && rc.replied >= rc.sent
+		rc.mu.Unlock()
+		if done || err != nil {
+			return
+		}
+	}
+}
+
+// encodeCommand encodes args as a RESP array of bulk strings
+func encodeCommand(args ...string) []byte {
+	b := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b = append(b, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	return b
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/amyangfei/redsnif/internal/resptest"
+	redsnif "github.com/amyangfei/redsnif/rsniffer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeRedis starts a RESP server which replies +OK to every command but
+// BLPOP, which blocks forever as no element is ever pushed
+func newFakeRedis(t *testing.T) *resptest.Server {
+	return resptest.NewServer(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "BLPOP" {
+			return ""
+		}
+		return "+OK\r\n"
+	})
+}
+
+func send(t *testing.T, rp *Replayer, session string, args ...string) {
+	cmd, err := redsnif.NewCommand(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp.Send(session, time.Time{}, cmd, encodeCommand(args...))
+}
+
+func TestReplayerSessionOrder(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.Close()
+	rp := NewReplayer("tcp:"+fr.Addr(), "", 0, time.Second, &Filter{}, make(chan struct{}))
+	for i := 0; i < 100; i++ {
+		send(t, rp, "a", "RPUSH", "a", strconv.Itoa(i))
+		send(t, rp, "b", "RPUSH", "b", strconv.Itoa(i))
+	}
+	rp.Wait()
+
+	conns := fr.Commands()
+	if len(conns) != 2 {
+		t.Fatalf("%d connections, want one for each session", len(conns))
+	}
+	for _, cmds := range conns {
+		if len(cmds) != 100 {
+			t.Fatalf("%d commands on connection, want 100", len(cmds))
+		}
+		for i, args := range cmds {
+			want := []string{"RPUSH", cmds[0][1], strconv.Itoa(i)}
+			if !reflect.DeepEqual(args, want) {
+				t.Fatalf("command %d is %q, want %q", i, args, want)
+			}
+		}
+	}
+	stats := rp.Stats()
+	if stats.Sessions != 2 || stats.Replayed != 200 || stats.Replies != 200 || stats.Dropped != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestReplayerFilter(t *testing.T) {
+	matcher, err := redsnif.NewKeyPatternMatcher([]redsnif.PatternRule{{Type: redsnif.PatternPrefix, Pattern: "user:"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := [][]string{
+		{"SELECT", "1"},
+		{"AUTH", "secret"},
+		{"GET", "user:1"},
+		{"GET", "item:1"},
+		{"SET", "user:1", "v"},
+		{"MGET", "item:1", "user:2"},
+		{"SUBSCRIBE", "ch"},
+		{"CLIENT", "REPLY", "OFF"},
+		{"PING"},
+		{"UNKNOWNCMD", "user:1"},
+	}
+	tests := []struct {
+		name     string
+		filter   *Filter
+		replayed []string
+		filtered int64
+	}{
+		{"all", &Filter{},
+			[]string{"SELECT", "GET", "GET", "SET", "MGET", "PING", "UNKNOWNCMD"}, 0},
+		// PING is not in RedisCmds, unknown commands may write
+		{"skip writes", &Filter{SkipWrites: true},
+			[]string{"SELECT", "GET", "GET", "MGET"}, 3},
+		{"read types", &Filter{Types: map[int]bool{redsnif.RedisCmdRead: true}},
+			[]string{"GET", "GET", "MGET"}, 4},
+		{"write types", &Filter{Types: map[int]bool{redsnif.RedisCmdWrite: true}},
+			[]string{"SET"}, 6},
+		// commands without keys keep the context of the session
+		{"key patterns", &Filter{Keys: matcher},
+			[]string{"SELECT", "GET", "SET", "MGET", "PING", "UNKNOWNCMD"}, 1},
+	}
+	for _, tt := range tests {
+		fr := newFakeRedis(t)
+		rp := NewReplayer("tcp:"+fr.Addr(), "", 0, time.Second, tt.filter, make(chan struct{}))
+		for _, args := range commands {
+			send(t, rp, "s", args...)
+		}
+		rp.Wait()
+		fr.Close()
+
+		replayed := make([]string, 0)
+		for _, cmds := range fr.Commands() {
+			for _, args := range cmds {
+				replayed = append(replayed, args[0])
+			}
+		}
+		if !reflect.DeepEqual(replayed, tt.replayed) {
+			t.Errorf("%s: replayed %q, want %q", tt.name, replayed, tt.replayed)
+		}
+		stats := rp.Stats()
+		if stats.Requests != int64(len(commands)) || stats.Unreplayable != 3 || stats.Filtered != tt.filtered ||
+			stats.Replayed != int64(len(tt.replayed)) {
+			t.Errorf("%s: stats %+v", tt.name, stats)
+		}
+	}
+}
+
+func TestInitConfigFilter(t *testing.T) {
+	defer func(typesFlag, patternsFlag string, skip bool) {
+		*types, *patterns, *skipWrites = typesFlag, patternsFlag, skip
+	}(*types, *patterns, *skipWrites)
+
+	*types, *patterns, *skipWrites = "read,WRITE", "prefix:user:", true
+	_, filter, err := initConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.SkipWrites || !reflect.DeepEqual(filter.Types, map[int]bool{redsnif.RedisCmdRead: true, redsnif.RedisCmdWrite: true}) ||
+		filter.Keys == nil || filter.Keys.Match("user:1") == redsnif.PatternOther {
+		t.Errorf("filter %+v", filter)
+	}
+
+	*types, *patterns, *skipWrites = "", "", false
+	if _, filter, err = initConfig(); err != nil || filter.Types != nil || filter.Keys != nil || filter.SkipWrites {
+		t.Errorf("filter %+v, %v, want any command", filter, err)
+	}
+
+	for _, flags := range [][2]string{{"admin", ""}, {"", "user:*"}, {"", "regex:("}} {
+		*types, *patterns = flags[0], flags[1]
+		if _, _, err := initConfig(); err == nil {
+			t.Errorf("-types %q -patterns %q is accepted", flags[0], flags[1])
+		}
+	}
+}
+
+func TestReplayerAuth(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.Close()
+	rp := NewReplayer("tcp:"+fr.Addr(), "pw", 0, time.Second, &Filter{}, make(chan struct{}))
+	send(t, rp, "a", "AUTH", "source")
+	send(t, rp, "a", "GET", "k")
+	send(t, rp, "b", "HELLO", "3", "AUTH", "user", "source")
+	send(t, rp, "b", "SET", "k", "v")
+	rp.Wait()
+
+	conns := fr.Commands()
+	if len(conns) != 2 {
+		t.Fatalf("%d connections, want 2", len(conns))
+	}
+	for _, cmds := range conns {
+		if len(cmds) != 2 || !reflect.DeepEqual(cmds[0], []string{"AUTH", "pw"}) {
+			t.Errorf("commands %q, want AUTH of target first", cmds)
+		}
+	}
+	// replies of AUTH are counted, the connection closes after all replies
+	if stats := rp.Stats(); stats.Replies != 4 || stats.Replayed != 2 || stats.Unreplayable != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestReplayerWaitTimeout(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.Close()
+	rp := NewReplayer("tcp:"+fr.Addr(), "", 0, 100*time.Millisecond, &Filter{}, make(chan struct{}))
+	send(t, rp, "a", "GET", "k")
+	send(t, rp, "a", "BLPOP", "q", "0")
+	send(t, rp, "b", "GET", "k")
+
+	done := make(chan struct{})
+	go func() {
+		rp.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait does not return for the unanswered blocking command")
+	}
+	if stats := rp.Stats(); stats.Replayed != 3 || stats.Replies != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestReplayLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Now()
+	record := func(session string, offset time.Duration, args ...string) string {
+		line, _ := json.Marshal(map[string]interface{}{
+			redsnif.AnalyzeCmd:     args[0],
+			redsnif.AnalyzeRequest: string(encodeCommand(args...)),
+			redsnif.AnalyzeSession: session,
+			redsnif.AnalyzeReqTime: start.Add(offset).Format(time.RFC3339Nano),
+			// write time of log entry is not the capture time
+			"time": time.Now().Format(time.RFC3339Nano),
+		})
+		return string(line)
+	}
+	lines := []string{
+		record("s1", 0, "SET", "k", "v"),
+		`{"event":"session","kind":"open","session":"s2"}`,
+		record("s2", 100*time.Millisecond, "GET", "k"),
+		"not json",
+		`{"request":"+OK\r\n","session":"s1"}`,
+		record("s1", 200*time.Millisecond, "DEL", "k"),
+	}
+	path := filepath.Join(dir, "events.log")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fr := newFakeRedis(t)
+	defer fr.Close()
+	rp := NewReplayer("tcp:"+fr.Addr(), "", 1, time.Second, &Filter{}, make(chan struct{}))
+	begin := time.Now()
+	if err := replayLog(path, rp, make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+	rp.Wait()
+
+	// timing of the log is kept with speed 1
+	if elapsed := time.Since(begin); elapsed < 150*time.Millisecond {
+		t.Errorf("replayed in %s, want about 200ms", elapsed)
+	}
+	conns := fr.Commands()
+	want := [][][]string{
+		{{"SET", "k", "v"}, {"DEL", "k"}},
+		{{"GET", "k"}},
+	}
+	if !reflect.DeepEqual(conns, want) {
+		t.Errorf("replayed %q, want %q", conns, want)
+	}
+	if stats := rp.Stats(); stats.Requests != 3 || stats.Invalid != 1 || stats.Sessions != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/amyangfei/redsnif/datahub"
+	redsnif "github.com/amyangfei/redsnif/rsniffer"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	device   = flag.String("i", "eth0", "network device to capture")
+	pcapFile = flag.String("r", "", "read packets from pcap file and print a summary (batch mode)")
+	host     = flag.String("H", "127.0.0.1", "redis host")
+	port     = flag.Int("p", 6379, "redis port")
+	targets  = flag.String("t", "", "comma separated redis endpoints, e.g. \"10.0.0.1:6379-6390,*:6380\", override -H and -p")
+	encap    = flag.String("encap", "", "comma separated encapsulations to capture: vlan, vxlan, gre")
+	proxy    = flag.String("proxy", "", "relay traffic instead of capturing, listen on \"unix:/path\" or \"tcp:host:port\"")
+	upstream = flag.String("upstream", "unix:/var/run/redis.sock", "redis address the proxy forwards to")
+	snaplen  = flag.Int("s", 1500, "snapshot length of packets")
+	bufSize  = flag.Int("b", 10240, "max buffer size of a redis session")
+	topN     = flag.Int("n", 10, "rows shown in each table")
+	interval = flag.Duration("d", time.Second, "refresh interval")
+	patterns = flag.String("patterns", "", "comma separated key pattern rules in \"type:pattern\" format")
+)
+
+const usageKeys = "keys: c sort by count, e sort by errors, l sort by latency, q quit"
+
+func initConfig() (*redsnif.SniffConfig, *redsnif.KeyPatternMatcher, error) {
+	cfg := redsnif.DefaultSniffConfig()
+	cfg.Device = *device
+	cfg.PcapFile = *pcapFile
+	cfg.Host = *host
+	cfg.Port = *port
+	if *targets != "" {
+		for _, target := range strings.Split(*targets, ",") {
+			ep, err := redsnif.ParseEndpoint(target)
+			if err != nil {
+				return nil, nil, err
+			}
+			cfg.Targets = append(cfg.Targets, ep)
+		}
+	}
+	if *encap != "" {
+		var err error
+		if cfg.Encap, err = redsnif.ParseEncap(strings.Split(*encap, ",")); err != nil {
+			return nil, nil, err
+		}
+	}
+	if *proxy != "" {
+		cfg.Proxy = &redsnif.ProxyConfig{Listen: *proxy, Upstream: *upstream}
+	}
+	cfg.Snaplen = int32(*snaplen)
+	cfg.MaxBufSize = *bufSize
+	cfg.Timeout = 100 * time.Millisecond
+	// every command is analyzed by TopAnalyzer, none is recorded
+	cfg.AzConfig = &redsnif.AnalyzeConfig{
+		SaveCmdTypes: []int{},
+		SaveDetail:   redsnif.RecordCmdOnly,
+	}
+
+	rules := make([]redsnif.PatternRule, 0)
+	if *patterns != "" {
+		for _, r := range strings.Split(*patterns, ",") {
+			rule, err := redsnif.ParsePatternRule(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+	matcher, err := redsnif.NewKeyPatternMatcher(rules, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, matcher, nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, usageKeys)
+	}
+	flag.Parse()
+	cfg, matcher, err := initConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	hub := datahub.NewBaseHub(cfg)
+	analyzer := NewTopAnalyzer(matcher)
+	hub.AddAnalyzer(analyzer)
+	ignore := func(fields map[string]interface{}, err error) {}
+
+	c := make(chan *redsnif.RedSession)
+	ec := make(chan error)
+	go redsnif.Sniff(cfg, c, ec)
+
+	if cfg.PcapFile != "" {
+		runBatch(hub, analyzer, c, ec, ignore)
+		return
+	}
+	runLive(hub, analyzer, c, ec, ignore)
+}
+
+// runBatch analyzes all packets in pcap file and prints the summary
+func runBatch(hub *datahub.BaseHub, ta *TopAnalyzer, c chan *redsnif.RedSession, ec chan error, handler datahub.AnalyzeResultHandler) {
+	for {
+		select {
+		case rs := <-c:
+			hub.AnalyzePacketInfo(rs, handler)
+		case err := <-ec:
+			if err == io.EOF {
+				elapsed := ta.Span()
+				render(os.Stdout, ta, elapsed, sortCount, *topN,
+					fmt.Sprintf("file: %s, duration: %s", *pcapFile, elapsed))
+				return
+			}
+			if hub.HandleSniffError(err, handler) {
+				fmt.Fprintf(os.Stderr, "sniffer error: %v\n", err)
+				return
+			}
+		}
+	}
+}
+
+// runLive refreshes the screen every interval until quit
+func runLive(hub *datahub.BaseHub, ta *TopAnalyzer, c chan *redsnif.RedSession, ec chan error, handler datahub.AnalyzeResultHandler) {
+	var keys chan byte
+	if isTerminal(os.Stdin) {
+		if restore, err := setCbreak(); err == nil {
+			defer restore()
+			keys = readKeys()
+		}
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	sortMode := sortCount
+	status := usageKeys
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case rs := <-c:
+			hub.AnalyzePacketInfo(rs, handler)
+		case err := <-ec:
+			if hub.HandleSniffError(err, handler) {
+				status = fmt.Sprintf("sniffer error: %v", err)
+			}
+		case now := <-ticker.C:
+			fmt.Print(clearScreen)
+			render(os.Stdout, ta, now.Sub(last), sortMode, *topN, status)
+			ta.Reset()
+			last = now
+		case k, ok := <-keys:
+			if !ok {
+				keys = nil
+				continue
+			}
+			switch k {
+			case 'c':
+				sortMode = sortCount
+			case 'e':
+				sortMode = sortErrors
+			case 'l':
+				sortMode = sortLatency
+			case 'q':
+				return
+			}
+		case <-sigc:
+			return
+		}
+	}
+}
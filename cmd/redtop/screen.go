@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	sortCount = iota + 1
+	sortErrors
+	sortLatency
+)
+
+var sortNames = map[int]string{
+	sortCount:   "count",
+	sortErrors:  "errors",
+	sortLatency: "latency",
+}
+
+const (
+	clearScreen = "\033[H\033[2J"
+)
+
+// isTerminal reports whether f is a character device
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// setCbreak switches the terminal to read key presses without waiting for
+// newline, the returned function restores the terminal.
+func setCbreak() (func(), error) {
+	cmd := exec.Command("stty", "cbreak", "-echo")
+	cmd.Stdin = os.Stdin
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	return func() {
+		cmd := exec.Command("stty", "-cbreak", "echo")
+		cmd.Stdin = os.Stdin
+		cmd.Run()
+	}, nil
+}
+
+// readKeys sends every key pressed to the returned channel
+func readKeys() chan byte {
+	c := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(c)
+				return
+			}
+			if n > 0 {
+				c <- buf[0]
+			}
+		}
+	}()
+	return c
+}
+
+func rate(count int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count) / elapsed.Seconds()
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
+
+// render writes the whole screen of statistic in elapsed duration
+func render(out io.Writer, ta *TopAnalyzer, elapsed time.Duration, sortMode, topN int, status string) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	ps := ta.total.samples.Percentiles(50, 90, 99, 100)
+	fmt.Fprintf(w, "redtop - %s  sort by %s  %s\n", time.Now().Format("15:04:05"), sortNames[sortMode], status)
+	fmt.Fprintf(w, "cmds/s: %.1f  errors/s: %.1f  error rate: %.2f%%  latency(ms) p50: %s p90: %s p99: %s max: %s\n\n",
+		rate(ta.total.count, elapsed), rate(ta.total.errors, elapsed), ta.total.ErrorRate()*100,
+		ms(ps[0]), ms(ps[1]), ms(ps[2]), ms(ps[3]))
+
+	fmt.Fprintln(w, "COMMAND\tCMDS/S\tERR%\tP50(ms)\tP99(ms)\tMAX(ms)")
+	for _, es := range topEntries(ta.cmds, sortMode, topN) {
+		ps := es.samples.Percentiles(50, 99, 100)
+		fmt.Fprintf(w, "%s\t%.1f\t%.2f\t%s\t%s\t%s\n", es.name, rate(es.count, elapsed),
+			es.ErrorRate()*100, ms(ps[0]), ms(ps[1]), ms(ps[2]))
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "CLIENT\tCMDS/S\tERR%\tAVG(ms)")
+	for _, es := range topEntries(ta.clients, sortMode, topN) {
+		fmt.Fprintf(w, "%s\t%.1f\t%.2f\t%s\n", es.name, rate(es.count, elapsed),
+			es.ErrorRate()*100, ms(es.LatencyAvg()))
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "KEY\tCMDS/S\tERR%\tAVG(ms)")
+	for _, es := range topEntries(ta.keys, sortMode, topN) {
+		fmt.Fprintf(w, "%s\t%.1f\t%.2f\t%s\n", es.name, rate(es.count, elapsed),
+			es.ErrorRate()*100, ms(es.LatencyAvg()))
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "PATTERN\tCMDS/S\tERR%\tHIT%\tAVG(ms)")
+	for _, es := range topEntries(ta.patterns, sortMode, topN) {
+		fmt.Fprintf(w, "%s\t%.1f\t%.2f\t%.2f\t%s\n", es.name, rate(es.count, elapsed),
+			es.ErrorRate()*100, es.HitRate()*100, ms(es.LatencyAvg()))
+	}
+	w.Flush()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"github.com/amyangfei/redsnif/datahub"
+	redsnif "github.com/amyangfei/redsnif/rsniffer"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxLatencySamples = 4096
+
+// latencySamples keeps a uniform sample of latencies with reservoir sampling
+type latencySamples struct {
+	seen    int64
+	samples []time.Duration
+}
+
+func (ls *latencySamples) Add(latency time.Duration) {
+	ls.seen++
+	if len(ls.samples) < maxLatencySamples {
+		ls.samples = append(ls.samples, latency)
+		return
+	}
+	if idx := rand.Int63n(ls.seen); idx < maxLatencySamples {
+		ls.samples[idx] = latency
+	}
+}
+
+// Percentiles returns latencies at given percentiles, e.g. 50, 99
+func (ls *latencySamples) Percentiles(ps ...float64) []time.Duration {
+	result := make([]time.Duration, len(ps))
+	if len(ls.samples) == 0 {
+		return result
+	}
+	sorted := make([]time.Duration, len(ls.samples))
+	copy(sorted, ls.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, p := range ps {
+		idx := int(float64(len(sorted)-1) * p / 100)
+		result[i] = sorted[idx]
+	}
+	return result
+}
+
+type entryStat struct {
+	name       string
+	count      int64
+	errors     int64
+	hit        int64
+	miss       int64
+	latencySum time.Duration
+	latencies  int64
+	samples    *latencySamples // only kept for commands
+}
+
+func (es *entryStat) add(isErr bool, latency time.Duration) {
+	es.count++
+	if isErr {
+		es.errors++
+	}
+	if latency >= 0 {
+		es.latencySum += latency
+		es.latencies++
+		if es.samples != nil {
+			es.samples.Add(latency)
+		}
+	}
+}
+
+func (es *entryStat) ErrorRate() float64 {
+	if es.count == 0 {
+		return 0
+	}
+	return float64(es.errors) / float64(es.count)
+}
+
+func (es *entryStat) HitRate() float64 {
+	if es.hit+es.miss == 0 {
+		return 0
+	}
+	return float64(es.hit) / float64(es.hit+es.miss)
+}
+
+func (es *entryStat) LatencyAvg() time.Duration {
+	if es.latencies == 0 {
+		return 0
+	}
+	return es.latencySum / time.Duration(es.latencies)
+}
+
+// sortKey returns the value compared by sort mode
+func (es *entryStat) sortKey(mode int) float64 {
+	switch mode {
+	case sortErrors:
+		return float64(es.errors)
+	case sortLatency:
+		if es.samples != nil {
+			return float64(es.samples.Percentiles(99)[0])
+		}
+		return float64(es.LatencyAvg())
+	}
+	return float64(es.count)
+}
+
+// sortedEntry is an entry with its sort key, which is computed once as
+// percentiles sort the latency samples
+type sortedEntry struct {
+	es  *entryStat
+	key float64
+}
+
+func topEntries(entries map[string]*entryStat, mode, n int) []*entryStat {
+	sorted := make([]sortedEntry, 0, len(entries))
+	for _, es := range entries {
+		sorted = append(sorted, sortedEntry{es: es, key: es.sortKey(mode)})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].key != sorted[j].key {
+			return sorted[i].key > sorted[j].key
+		}
+		return sorted[i].es.name < sorted[j].es.name
+	})
+	if n > 0 && len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	list := make([]*entryStat, len(sorted))
+	for i, se := range sorted {
+		list[i] = se.es
+	}
+	return list
+}
+
+// TopAnalyzer aggregates traffic by command, client, key and key pattern
+type TopAnalyzer struct {
+	matcher  *redsnif.KeyPatternMatcher
+	mu       sync.Mutex // guards statistics, held by render too
+	total    *entryStat
+	cmds     map[string]*entryStat
+	clients  map[string]*entryStat
+	keys     map[string]*entryStat
+	patterns map[string]*entryStat
+	first    time.Time // capture time of the first command
+	last     time.Time // capture time of the last reply
+}
+
+func NewTopAnalyzer(matcher *redsnif.KeyPatternMatcher) *TopAnalyzer {
+	ta := &TopAnalyzer{matcher: matcher}
+	ta.Reset()
+	return ta
+}
+
+func (ta *TopAnalyzer) Reset() {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	ta.total = &entryStat{name: "total", samples: &latencySamples{}}
+	ta.cmds = map[string]*entryStat{}
+	ta.clients = map[string]*entryStat{}
+	ta.keys = map[string]*entryStat{}
+	ta.patterns = map[string]*entryStat{}
+	ta.first = time.Time{}
+	ta.last = time.Time{}
+}
+
+func entry(entries map[string]*entryStat, name string, withSamples bool) *entryStat {
+	es, ok := entries[name]
+	if !ok {
+		es = &entryStat{name: name}
+		if withSamples {
+			es.samples = &latencySamples{}
+		}
+		entries[name] = es
+	}
+	return es
+}
+
+func (ta *TopAnalyzer) Analyze(hs *datahub.HubSession, cmd *redsnif.Command, reqRD, replyRD *redsnif.RespData, handler datahub.AnalyzeResultHandler) {
+	cmdName := strings.ToUpper(cmd.Name())
+	isErr := replyRD.IsError()
+	latency := redsnif.ServiceLatency(cmd, reqRD, replyRD)
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	if ta.first.IsZero() || (!reqRD.Time.IsZero() && reqRD.Time.Before(ta.first)) {
+		ta.first = reqRD.Time
+	}
+	if replyRD.Time.After(ta.last) {
+		ta.last = replyRD.Time
+	}
+
+	ta.total.add(isErr, latency)
+	entry(ta.cmds, cmdName, true).add(isErr, latency)
+	entry(ta.clients, hs.Client(), false).add(isErr, latency)
+
+	patterns := map[string]*entryStat{}
+	for _, key := range cmd.Keys() {
+		entry(ta.keys, key, false).add(isErr, latency)
+		pattern := ta.matcher.Match(key)
+		if _, ok := patterns[pattern]; !ok {
+			patterns[pattern] = entry(ta.patterns, pattern, false)
+			patterns[pattern].add(isErr, latency)
+		}
+	}
+	for _, stat := range redsnif.KeyHitAnalyze(cmd, cmdName, replyRD) {
+		ps := patterns[ta.matcher.Match(stat["key"].(string))]
+		if ps == nil {
+			continue
+		}
+		switch stat["status"] {
+		case redsnif.KeyHit:
+			ps.hit++
+		case redsnif.KeyMiss:
+			ps.miss++
+		}
+	}
+}
+
+// Span returns capture time from the first command to the last reply
+func (ta *TopAnalyzer) Span() time.Duration {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	return ta.last.Sub(ta.first)
+}
+
+// Tick does nothing, the screen is refreshed by the main loop
+func (ta *TopAnalyzer) Tick(now time.Time, handler datahub.AnalyzeResultHandler) {
+}
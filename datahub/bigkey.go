@@ -0,0 +1,224 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// elements taken by one member of write commands, e.g. HSET has field and value
+var bigKeyWriteArity = map[string]int{
+	"SET":    1,
+	"SETEX":  1,
+	"APPEND": 1,
+	"HSET":   2,
+	"HMSET":  2,
+	"LPUSH":  1,
+	"RPUSH":  1,
+	"SADD":   1,
+	"ZADD":   2,
+}
+
+// options of ZADD given before score and member pairs
+var zaddOptions = map[string]bool{
+	"NX":   true,
+	"XX":   true,
+	"GT":   true,
+	"LT":   true,
+	"CH":   true,
+	"INCR": true,
+}
+
+type BigKeyRecord struct {
+	Key      string
+	Cmd      string
+	Client   string
+	Bytes    int
+	Elements int
+}
+
+// BigKeyAnalyzer reports replies and writes over configured thresholds, and
+// keeps the top N largest keys seen in each window.
+type BigKeyAnalyzer struct {
+	cfg         *rsniffer.BigKeyConfig
+	mu          sync.Mutex // guards window and largest keys
+	windowStart time.Time
+	largest     map[string]*BigKeyRecord
+}
+
+func NewBigKeyAnalyzer(cfg *rsniffer.BigKeyConfig) *BigKeyAnalyzer {
+	return &BigKeyAnalyzer{
+		cfg:         cfg,
+		windowStart: time.Now(),
+		largest:     map[string]*BigKeyRecord{},
+	}
+}
+
+func (ba *BigKeyAnalyzer) Analyze(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	if replyRD.IsError() {
+		return
+	}
+	cmdName := strings.ToUpper(cmd.Name())
+	keys := cmd.Keys()
+	if len(keys) == 0 {
+		return
+	}
+
+	// size of value written by request
+	if arity, ok := bigKeyWriteArity[cmdName]; ok {
+		values := cmd.Args[2:]
+		if cmdName == "SETEX" && len(values) > 0 {
+			// SETEX key seconds value
+			values = values[1:]
+		} else if cmdName == "SET" && len(values) > 1 {
+			// ignore SET options such as EX, NX
+			values = values[:1]
+		} else if cmdName == "ZADD" {
+			// ignore ZADD options such as NX, CH
+			for len(values) > 0 && zaddOptions[strings.ToUpper(values[0])] {
+				values = values[1:]
+			}
+		}
+		size := 0
+		for _, v := range values {
+			size += len(v)
+		}
+		ba.record(hs, &BigKeyRecord{
+			Key:      keys[0],
+			Cmd:      cmdName,
+			Client:   hs.Client(),
+			Bytes:    size,
+			Elements: len(values) / arity,
+		}, "request", handler)
+	} else if cmdName == "MSET" {
+		for i := 2; i < len(cmd.Args); i += 2 {
+			ba.record(hs, &BigKeyRecord{
+				Key:      cmd.Args[i-1],
+				Cmd:      cmdName,
+				Client:   hs.Client(),
+				Bytes:    len(cmd.Args[i]),
+				Elements: 1,
+			}, "request", handler)
+		}
+	}
+
+	// size of value in reply
+	if rsniffer.RedisCmds[cmdName] != rsniffer.RedisCmdRead {
+		return
+	}
+	if cmdName == "MGET" && replyRD.IsArray() {
+		for idx, key := range keys {
+			if idx >= len(replyRD.Msg.Array) {
+				break
+			}
+			elem := &rsniffer.RespData{Msg: replyRD.Msg.Array[idx]}
+			ba.record(hs, &BigKeyRecord{
+				Key:      key,
+				Cmd:      cmdName,
+				Client:   hs.Client(),
+				Bytes:    elem.Size(),
+				Elements: 1,
+			}, "reply", handler)
+		}
+	} else if replyRD.IsBulk() || replyRD.IsArray() {
+		ba.record(hs, &BigKeyRecord{
+			Key:      keys[0],
+			Cmd:      cmdName,
+			Client:   hs.Client(),
+			Bytes:    replyRD.Size(),
+			Elements: replyRD.Elements(),
+		}, "reply", handler)
+	}
+}
+
+func (ba *BigKeyAnalyzer) record(hs *HubSession, rec *BigKeyRecord, source string, handler AnalyzeResultHandler) {
+	if (ba.cfg.MaxBytes > 0 && rec.Bytes > ba.cfg.MaxBytes) ||
+		(ba.cfg.MaxElements > 0 && rec.Elements > ba.cfg.MaxElements) {
+		handler(map[string]interface{}{
+			rsniffer.AnalyzeEvent:    rsniffer.EventBigKey,
+			rsniffer.AnalyzeSession:  hs.ID(),
+			rsniffer.AnalyzeClient:   rec.Client,
+			rsniffer.AnalyzeCmd:      rec.Cmd,
+			rsniffer.AnalyzeKey:      rec.Key,
+			rsniffer.AnalyzeBytes:    rec.Bytes,
+			rsniffer.AnalyzeElements: rec.Elements,
+			rsniffer.AnalyzeSource:   source,
+		}, nil)
+	}
+	if ba.cfg.TopN <= 0 {
+		return
+	}
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	if old, ok := ba.largest[rec.Key]; !ok || rec.Bytes > old.Bytes {
+		ba.largest[rec.Key] = rec
+	}
+	// avoid unlimited growth in a window, keys out of top N are useless
+	if len(ba.largest) > ba.cfg.TopN*8 {
+		top := ba.top()
+		ba.largest = make(map[string]*BigKeyRecord, len(top))
+		for _, r := range top {
+			ba.largest[r.Key] = r
+		}
+	}
+}
+
+func (ba *BigKeyAnalyzer) top() []*BigKeyRecord {
+	records := make([]*BigKeyRecord, 0, len(ba.largest))
+	for _, rec := range ba.largest {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Bytes != records[j].Bytes {
+			return records[i].Bytes > records[j].Bytes
+		}
+		return records[i].Elements > records[j].Elements
+	})
+	if len(records) > ba.cfg.TopN {
+		records = records[:ba.cfg.TopN]
+	}
+	return records
+}
+
+// TopKeys returns the largest keys seen in current window
+func (ba *BigKeyAnalyzer) TopKeys() []*BigKeyRecord {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	return ba.top()
+}
+
+func (ba *BigKeyAnalyzer) Tick(now time.Time, handler AnalyzeResultHandler) {
+	if ba.cfg.TopN <= 0 || ba.cfg.Window <= 0 {
+		return
+	}
+	ba.mu.Lock()
+	if now.Sub(ba.windowStart) < ba.cfg.Window {
+		ba.mu.Unlock()
+		return
+	}
+	windowStart := ba.windowStart
+	top := ba.top()
+	ba.windowStart = now
+	ba.largest = map[string]*BigKeyRecord{}
+	ba.mu.Unlock()
+
+	if len(top) > 0 {
+		list := make([]map[string]interface{}, 0, len(top))
+		for _, rec := range top {
+			list = append(list, map[string]interface{}{
+				rsniffer.AnalyzeKey:      rec.Key,
+				rsniffer.AnalyzeCmd:      rec.Cmd,
+				rsniffer.AnalyzeClient:   rec.Client,
+				rsniffer.AnalyzeBytes:    rec.Bytes,
+				rsniffer.AnalyzeElements: rec.Elements,
+			})
+		}
+		handler(map[string]interface{}{
+			rsniffer.AnalyzeEvent:  rsniffer.EventBigKeyTop,
+			rsniffer.AnalyzeWindow: now.Sub(windowStart).String(),
+			rsniffer.AnalyzeTop:    list,
+		}, nil)
+	}
+}
@@ -0,0 +1,41 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"testing"
+)
+
+func TestBigKeyWriteSize(t *testing.T) {
+	tests := []struct {
+		args     []string
+		bytes    int
+		elements int
+	}{
+		{[]string{"SET", "k", "value"}, 5, 1},
+		{[]string{"SET", "k", "value", "EX", "10", "NX"}, 5, 1},
+		{[]string{"SETEX", "k", "10", "value"}, 5, 1},
+		{[]string{"APPEND", "k", "abc"}, 3, 1},
+		{[]string{"HSET", "k", "f1", "v1", "f2", "v2"}, 8, 2},
+		{[]string{"RPUSH", "k", "a", "bb", "ccc"}, 6, 3},
+		{[]string{"ZADD", "k", "1", "m1", "2", "m2"}, 6, 2},
+		{[]string{"ZADD", "k", "NX", "1", "m1"}, 3, 1},
+		{[]string{"ZADD", "k", "xx", "ch", "gt", "1.5", "m1", "2", "m2"}, 8, 2},
+		{[]string{"ZADD", "k", "INCR", "10", "m1"}, 4, 1},
+		{[]string{"ZADD", "k", "LT", "CH"}, 0, 0},
+	}
+	for _, tt := range tests {
+		ba := NewBigKeyAnalyzer(&rsniffer.BigKeyConfig{TopN: 1})
+		hub := NewBaseHub(rsniffer.DefaultSniffConfig())
+		hub.AddAnalyzer(ba)
+		ts := newTestSession(t, hub, "s1")
+		ts.send("+OK\r\n", tt.args...)
+		top := ba.TopKeys()
+		if len(top) != 1 {
+			t.Errorf("%q: %d keys recorded, want 1", tt.args, len(top))
+			continue
+		}
+		if top[0].Bytes != tt.bytes || top[0].Elements != tt.elements {
+			t.Errorf("%q: %d bytes and %d elements, want %d and %d", tt.args, top[0].Bytes, top[0].Elements, tt.bytes, tt.elements)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"sync"
+	"time"
+)
+
+// QueueWaitStat is the wait statistic of consumers blocked on a key
+type QueueWaitStat struct {
+	Served    int64 // blocking commands served by the key
+	Timeouts  int64 // blocking commands on the key timed out
+	WaitSum   time.Duration
+	WaitMax   time.Duration
+	Waits     int64           // served commands with known wait time
+	Consumers map[string]bool // clients blocked on the key
+}
+
+func (qs *QueueWaitStat) WaitAvg() time.Duration {
+	if qs.Waits == 0 {
+		return 0
+	}
+	return qs.WaitSum / time.Duration(qs.Waits)
+}
+
+func (qs *QueueWaitStat) TimeoutRate() float64 {
+	if qs.Served+qs.Timeouts == 0 {
+		return 0
+	}
+	return float64(qs.Timeouts) / float64(qs.Served+qs.Timeouts)
+}
+
+// BlockingAnalyzer aggregates how long consumers of each queue, the key of
+// blocking commands such as BLPOP, wait until served and how often they time
+// out in a window.
+type BlockingAnalyzer struct {
+	cfg         *rsniffer.BlockingConfig
+	mu          sync.Mutex // guards window and stats
+	windowStart time.Time
+	stats       map[string]*QueueWaitStat
+}
+
+func NewBlockingAnalyzer(cfg *rsniffer.BlockingConfig) *BlockingAnalyzer {
+	return &BlockingAnalyzer{
+		cfg:         cfg,
+		windowStart: time.Now(),
+		stats:       map[string]*QueueWaitStat{},
+	}
+}
+
+func (ba *BlockingAnalyzer) stat(key string) *QueueWaitStat {
+	qs, ok := ba.stats[key]
+	if !ok {
+		qs = &QueueWaitStat{Consumers: map[string]bool{}}
+		ba.stats[key] = qs
+	}
+	return qs
+}
+
+func (ba *BlockingAnalyzer) Analyze(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	if !cmd.IsBlocking() || replyRD.IsError() {
+		return
+	}
+	keys := cmd.Keys()
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	for _, key := range keys {
+		ba.stat(key).Consumers[hs.Client()] = true
+	}
+	if rsniffer.BlockingTimeout(cmd, replyRD) {
+		for _, key := range keys {
+			ba.stat(key).Timeouts++
+		}
+		return
+	}
+	wait := rsniffer.BlockingWait(cmd, reqRD, replyRD)
+	for _, key := range rsniffer.BlockingServedKeys(cmd, replyRD) {
+		qs := ba.stat(key)
+		qs.Served++
+		if wait >= 0 {
+			qs.Waits++
+			qs.WaitSum += wait
+			if wait > qs.WaitMax {
+				qs.WaitMax = wait
+			}
+		}
+	}
+}
+
+func (ba *BlockingAnalyzer) Tick(now time.Time, handler AnalyzeResultHandler) {
+	if ba.cfg.Window <= 0 {
+		return
+	}
+	ba.mu.Lock()
+	if now.Sub(ba.windowStart) < ba.cfg.Window {
+		ba.mu.Unlock()
+		return
+	}
+	elapsed := now.Sub(ba.windowStart)
+	stats := ba.stats
+	ba.windowStart = now
+	ba.stats = map[string]*QueueWaitStat{}
+	ba.mu.Unlock()
+
+	for key, qs := range stats {
+		handler(map[string]interface{}{
+			rsniffer.AnalyzeEvent:  rsniffer.EventBlocking,
+			rsniffer.AnalyzeKey:    key,
+			rsniffer.AnalyzeWindow: elapsed.String(),
+			"served":               qs.Served,
+			"timeouts":             qs.Timeouts,
+			"timeout_rate":         qs.TimeoutRate(),
+			"consumers":            len(qs.Consumers),
+			"wait_avg":             int64(qs.WaitAvg() / time.Microsecond),
+			"wait_max":             int64(qs.WaitMax / time.Microsecond),
+		}, nil)
+	}
+}
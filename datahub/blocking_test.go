@@ -0,0 +1,56 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"testing"
+	"time"
+)
+
+func TestBlockingQueueWait(t *testing.T) {
+	ba := NewBlockingAnalyzer(&rsniffer.BlockingConfig{Window: time.Second})
+	hub := NewBaseHub(rsniffer.DefaultSniffConfig())
+	hub.AddAnalyzer(ba)
+	s1 := newTestSession(t, hub, "s1")
+	s2 := newTestSession(t, hub, "s2")
+	s2.rs.ClientAddr = "10.0.0.3:5555"
+
+	s1.send("*2\r\n$2\r\nq2\r\n$1\r\nx\r\n", "BLPOP", "q1", "q2", "0")
+	s2.send("*-1\r\n", "BRPOP", "q1", "1")
+	s2.send("*2\r\n$2\r\nq1\r\n$1\r\ny\r\n", "BRPOP", "q1", "1")
+	s1.send("*-1\r\n", "XREAD", "BLOCK", "100", "STREAMS", "st", "$")
+	// not blocking without BLOCK option
+	s1.send("*-1\r\n", "XREAD", "STREAMS", "st", "0")
+	s1.send("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", "BLPOP", "q3", "0")
+
+	tests := map[string]struct {
+		served    int64
+		timeouts  int64
+		consumers int
+	}{
+		"q1": {1, 1, 2},
+		"q2": {1, 0, 1},
+		"st": {0, 1, 1},
+	}
+	reported := 0
+	hub.Tick(time.Now().Add(2*time.Second), func(fields map[string]interface{}, err error) {
+		if fields[rsniffer.AnalyzeEvent] != rsniffer.EventBlocking {
+			return
+		}
+		reported++
+		key, _ := fields[rsniffer.AnalyzeKey].(string)
+		want, ok := tests[key]
+		if !ok {
+			t.Errorf("queue %q is reported", key)
+			return
+		}
+		if fields["served"] != want.served || fields["timeouts"] != want.timeouts || fields["consumers"] != want.consumers {
+			t.Errorf("queue %s: %v", key, fields)
+		}
+		if want.served > 0 && fields["wait_max"].(int64) <= 0 {
+			t.Errorf("queue %s: no wait time, %v", key, fields)
+		}
+	})
+	if reported != len(tests) {
+		t.Errorf("%d queues reported, want %d", reported, len(tests))
+	}
+}
@@ -0,0 +1,252 @@
+package datahub
+
+import (
+	"fmt"
+	"github.com/amyangfei/redsnif/rsniffer"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upper bounds of payload size buckets, the last bucket has no upper bound
+var channelSizeBounds = []int{64, 256, 1024, 4096, 16384, 65536}
+
+func sizeBucketName(idx int) string {
+	if idx < len(channelSizeBounds) {
+		return fmt.Sprintf("<=%d", channelSizeBounds[idx])
+	}
+	return fmt.Sprintf(">%d", channelSizeBounds[len(channelSizeBounds)-1])
+}
+
+type channelKey struct {
+	kind int // rsniffer.SubChannel, rsniffer.SubPattern ...
+	name string
+}
+
+type ChannelStat struct {
+	Publishes    int64            // PUBLISH commands to the channel, or matching the pattern
+	Receivers    int64            // sum of receivers replied by PUBLISH
+	ZeroReceiver int64            // PUBLISH received by no subscriber
+	Deliveries   int64            // messages pushed to captured subscribers
+	Bytes        int64            // payload bytes published
+	BytesMax     int              // the largest payload published
+	Sizes        []int64          // payload size distribution, bounded by channelSizeBounds
+	Subscribers  map[string]int64 // deliveries to each subscriber connection
+}
+
+func newChannelStat() *ChannelStat {
+	return &ChannelStat{
+		Sizes:       make([]int64, len(channelSizeBounds)+1),
+		Subscribers: map[string]int64{},
+	}
+}
+
+func (cs *ChannelStat) addSize(size int) {
+	cs.Bytes += int64(size)
+	if size > cs.BytesMax {
+		cs.BytesMax = size
+	}
+	idx := 0
+	for idx < len(channelSizeBounds) && size > channelSizeBounds[idx] {
+		idx++
+	}
+	cs.Sizes[idx]++
+}
+
+// ChannelAnalyzer aggregates publishes and deliveries of each pub/sub channel
+// and pattern, and emits a summary of each of them in a window. Patterns no
+// session subscribes to are dropped when the window rolls.
+type ChannelAnalyzer struct {
+	cfg         *rsniffer.ChannelConfig
+	mu          sync.Mutex // guards window, stats, patterns and subscribers
+	windowStart time.Time
+	stats       map[channelKey]*ChannelStat
+	patterns    map[string]*regexp.Regexp  // patterns seen in PSUBSCRIBE and pmessage
+	subscribers map[string]map[string]bool // patterns subscribed by each session
+}
+
+func NewChannelAnalyzer(cfg *rsniffer.ChannelConfig) *ChannelAnalyzer {
+	return &ChannelAnalyzer{
+		cfg:         cfg,
+		windowStart: time.Now(),
+		stats:       map[channelKey]*ChannelStat{},
+		patterns:    map[string]*regexp.Regexp{},
+		subscribers: map[string]map[string]bool{},
+	}
+}
+
+func (ca *ChannelAnalyzer) stat(kind int, name string) *ChannelStat {
+	key := channelKey{kind, name}
+	cs, ok := ca.stats[key]
+	if !ok {
+		cs = newChannelStat()
+		ca.stats[key] = cs
+	}
+	return cs
+}
+
+func (ca *ChannelAnalyzer) addPattern(pattern string) {
+	if _, ok := ca.patterns[pattern]; ok {
+		return
+	}
+	// invalid pattern is kept as nil so that it is not compiled again
+	re, _ := rsniffer.CompileGlob(pattern)
+	ca.patterns[pattern] = re
+}
+
+// subscribe keeps the patterns subscribed by session, which are taken from
+// the subscriptions of session tracked by hub
+func (ca *ChannelAnalyzer) subscribe(hs *HubSession) {
+	patterns := hs.Subscriptions(rsniffer.SubPattern)
+	if len(patterns) == 0 {
+		delete(ca.subscribers, hs.ID())
+		return
+	}
+	subs := make(map[string]bool, len(patterns))
+	for _, pattern := range patterns {
+		subs[pattern] = true
+	}
+	ca.subscribers[hs.ID()] = subs
+}
+
+func (ca *ChannelAnalyzer) Analyze(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	cmdName := strings.ToUpper(cmd.Name())
+	switch cmdName {
+	case "PSUBSCRIBE":
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		for _, pattern := range cmd.Args[1:] {
+			ca.addPattern(pattern)
+		}
+		ca.subscribe(hs)
+		return
+	case "PUNSUBSCRIBE", "UNSUBSCRIBE", "RESET":
+		// unsubscribing the last channel leaves patterns as well
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		ca.subscribe(hs)
+		return
+	}
+	if (cmdName != "PUBLISH" && cmdName != "SPUBLISH") || len(cmd.Args) != 3 || !replyRD.IsInteger() {
+		return
+	}
+	kind := rsniffer.SubChannel
+	if cmdName == "SPUBLISH" {
+		kind = rsniffer.SubShardChannel
+	}
+	channel, size, receivers := cmd.Args[1], len(cmd.Args[2]), replyRD.Msg.Integer
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	stats := []*ChannelStat{ca.stat(kind, channel)}
+	if kind == rsniffer.SubChannel {
+		for pattern, re := range ca.patterns {
+			if re != nil && re.MatchString(channel) {
+				stats = append(stats, ca.stat(rsniffer.SubPattern, pattern))
+			}
+		}
+	}
+	for _, cs := range stats {
+		cs.Publishes++
+		cs.Receivers += receivers
+		if receivers == 0 {
+			cs.ZeroReceiver++
+		}
+		cs.addSize(size)
+	}
+}
+
+func (ca *ChannelAnalyzer) AnalyzePush(hs *HubSession, push *rsniffer.PushMessage, handler AnalyzeResultHandler) {
+	if push.Kind == "invalidate" {
+		// RESP3 invalidation is not a pub/sub message
+		return
+	}
+	kind := rsniffer.SubChannel
+	if push.Kind == "smessage" {
+		kind = rsniffer.SubShardChannel
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	cs := ca.stat(kind, push.Channel)
+	cs.Deliveries++
+	cs.Subscribers[hs.Client()]++
+	if push.Pattern != "" {
+		// PSUBSCRIBE of the session may not be captured
+		ca.addPattern(push.Pattern)
+		if _, ok := ca.subscribers[hs.ID()]; !ok {
+			ca.subscribers[hs.ID()] = map[string]bool{}
+		}
+		ca.subscribers[hs.ID()][push.Pattern] = true
+		ps := ca.stat(rsniffer.SubPattern, push.Pattern)
+		ps.Deliveries++
+		ps.Subscribers[hs.Client()]++
+	}
+}
+
+func (ca *ChannelAnalyzer) SessionEnd(hs *HubSession, handler AnalyzeResultHandler) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	delete(ca.subscribers, hs.ID())
+}
+
+// prunePatterns drops patterns no session subscribes to
+func (ca *ChannelAnalyzer) prunePatterns() {
+	subscribed := make(map[string]bool, len(ca.patterns))
+	for _, subs := range ca.subscribers {
+		for pattern := range subs {
+			subscribed[pattern] = true
+		}
+	}
+	for pattern := range ca.patterns {
+		if !subscribed[pattern] {
+			delete(ca.patterns, pattern)
+		}
+	}
+}
+
+func (ca *ChannelAnalyzer) Tick(now time.Time, handler AnalyzeResultHandler) {
+	if ca.cfg.Window <= 0 {
+		return
+	}
+	ca.mu.Lock()
+	if now.Sub(ca.windowStart) < ca.cfg.Window {
+		ca.mu.Unlock()
+		return
+	}
+	elapsed := now.Sub(ca.windowStart)
+	stats := ca.stats
+	ca.windowStart = now
+	ca.stats = map[channelKey]*ChannelStat{}
+	ca.prunePatterns()
+	ca.mu.Unlock()
+
+	for key, cs := range stats {
+		sizes := make(map[string]int64)
+		for idx, count := range cs.Sizes {
+			if count > 0 {
+				sizes[sizeBucketName(idx)] = count
+			}
+		}
+		var bytesAvg int64
+		if cs.Publishes > 0 {
+			bytesAvg = cs.Bytes / cs.Publishes
+		}
+		handler(map[string]interface{}{
+			rsniffer.AnalyzeEvent:   rsniffer.EventChannel,
+			rsniffer.AnalyzeKind:    rsniffer.SubKindNames[key.kind],
+			rsniffer.AnalyzeChannel: key.name,
+			rsniffer.AnalyzeWindow:  elapsed.String(),
+			"publishes":             cs.Publishes,
+			"publish_rate":          float64(cs.Publishes) / elapsed.Seconds(),
+			"receivers":             cs.Receivers,
+			"zero_receiver":         cs.ZeroReceiver,
+			"no_subscriber":         cs.Publishes > 0 && cs.Receivers == 0,
+			"deliveries":            cs.Deliveries,
+			"subscribers":           cs.Subscribers,
+			rsniffer.AnalyzeBytes:   cs.Bytes,
+			"bytes_avg":             bytesAvg,
+			"bytes_max":             cs.BytesMax,
+			"sizes":                 sizes,
+		}, nil)
+	}
+}
@@ -0,0 +1,67 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func subscribeReply(kind, channel string, count int) string {
+	return "*3\r\n" + "$" + strconv.Itoa(len(kind)) + "\r\n" + kind + "\r\n" +
+		"$" + strconv.Itoa(len(channel)) + "\r\n" + channel + "\r\n:" + strconv.Itoa(count) + "\r\n"
+}
+
+func channelPatterns(ca *ChannelAnalyzer) []string {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	patterns := make([]string, 0, len(ca.patterns))
+	for pattern := range ca.patterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+func TestChannelPatternPrune(t *testing.T) {
+	ca := NewChannelAnalyzer(&rsniffer.ChannelConfig{Window: time.Second})
+	hub := NewBaseHub(rsniffer.DefaultSniffConfig())
+	hub.AddAnalyzer(ca)
+	s1 := newTestSession(t, hub, "s1")
+	s2 := newTestSession(t, hub, "s2")
+	tick := time.Now()
+	roll := func() {
+		tick = tick.Add(2 * time.Second)
+		hub.Tick(tick, s1.handle)
+	}
+
+	s1.send(subscribeReply("psubscribe", "news.*", 1)+subscribeReply("psubscribe", "old.*", 2), "PSUBSCRIBE", "news.*", "old.*")
+	s2.send(subscribeReply("psubscribe", "old.*", 1), "PSUBSCRIBE", "old.*")
+	// pattern of a subscriber whose PSUBSCRIBE is not captured
+	s2.receive("*4\r\n$8\r\npmessage\r\n$5\r\nlog.*\r\n$5\r\nlog.a\r\n$1\r\nx\r\n")
+	roll()
+	if got := channelPatterns(ca); !reflect.DeepEqual(got, []string{"log.*", "news.*", "old.*"}) {
+		t.Fatalf("patterns %q", got)
+	}
+
+	s1.send(subscribeReply("punsubscribe", "old.*", 1), "PUNSUBSCRIBE", "old.*")
+	roll()
+	if got := channelPatterns(ca); !reflect.DeepEqual(got, []string{"log.*", "news.*", "old.*"}) {
+		t.Fatalf("patterns %q, old.* is still subscribed by s2", got)
+	}
+
+	hub.HandleSessionEvent(&rsniffer.SessionEvent{Kind: rsniffer.SessionClose, Session: s2.rs}, s2.handle)
+	roll()
+	if got := channelPatterns(ca); !reflect.DeepEqual(got, []string{"news.*"}) {
+		t.Fatalf("patterns %q, want patterns of closed session dropped", got)
+	}
+
+	// unsubscribing the last channel leaves patterns too
+	s1.send(subscribeReply("unsubscribe", "", 0), "UNSUBSCRIBE")
+	roll()
+	if got := channelPatterns(ca); len(got) != 0 {
+		t.Fatalf("patterns %q, want none", got)
+	}
+}
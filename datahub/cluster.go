@@ -0,0 +1,152 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterClientStat is the redirections and cluster errors of a client, a
+// client keeps being redirected by MOVED probably has a stale slot map.
+type ClusterClientStat struct {
+	Requests   int64            // commands with keys
+	Asking     int64            // ASKING commands
+	Errors     map[string]int64 // cluster errors by kind, such as rsniffer.ClusterMoved
+	MovedSlots map[int]bool     // slots redirected by MOVED
+}
+
+// ClusterAnalyzer aggregates commands of each hash slot and each node, and
+// redirections and cluster errors of each client in a window.
+type ClusterAnalyzer struct {
+	cfg         *rsniffer.ClusterConfig
+	mu          sync.Mutex // guards window and stats
+	windowStart time.Time
+	slots       map[int]int64    // commands of each slot
+	nodes       map[string]int64 // commands of each node
+	nodeSlots   map[string]map[int]bool
+	clients     map[string]*ClusterClientStat
+}
+
+func NewClusterAnalyzer(cfg *rsniffer.ClusterConfig) *ClusterAnalyzer {
+	ca := &ClusterAnalyzer{cfg: cfg}
+	ca.reset(time.Now())
+	return ca
+}
+
+func (ca *ClusterAnalyzer) reset(now time.Time) {
+	ca.windowStart = now
+	ca.slots = map[int]int64{}
+	ca.nodes = map[string]int64{}
+	ca.nodeSlots = map[string]map[int]bool{}
+	ca.clients = map[string]*ClusterClientStat{}
+}
+
+func (ca *ClusterAnalyzer) client(name string) *ClusterClientStat {
+	cs, ok := ca.clients[name]
+	if !ok {
+		cs = &ClusterClientStat{
+			Errors:     map[string]int64{},
+			MovedSlots: map[int]bool{},
+		}
+		ca.clients[name] = cs
+	}
+	return cs
+}
+
+func (ca *ClusterAnalyzer) Analyze(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	node := hs.Server()
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.nodes[node]++
+	if strings.ToUpper(cmd.Name()) == "ASKING" {
+		ca.client(hs.Client()).Asking++
+		return
+	}
+	slots := rsniffer.CommandSlots(cmd)
+	if len(slots) == 0 {
+		return
+	}
+	cs := ca.client(hs.Client())
+	cs.Requests++
+	if replyRD.IsError() {
+		if ce := rsniffer.ParseClusterError(replyRD.Msg.Error); ce != nil {
+			cs.Errors[ce.Kind]++
+			if ce.Kind == rsniffer.ClusterMoved {
+				cs.MovedSlots[ce.Slot] = true
+			}
+			// the command is not executed by this node
+			return
+		}
+	}
+	if len(slots) > 1 {
+		return
+	}
+	ca.slots[slots[0]]++
+	served, ok := ca.nodeSlots[node]
+	if !ok {
+		served = map[int]bool{}
+		ca.nodeSlots[node] = served
+	}
+	served[slots[0]] = true
+}
+
+func (ca *ClusterAnalyzer) Tick(now time.Time, handler AnalyzeResultHandler) {
+	if ca.cfg.Window <= 0 {
+		return
+	}
+	ca.mu.Lock()
+	if now.Sub(ca.windowStart) < ca.cfg.Window {
+		ca.mu.Unlock()
+		return
+	}
+	elapsed := now.Sub(ca.windowStart)
+	slots, nodes, nodeSlots, clients := ca.slots, ca.nodes, ca.nodeSlots, ca.clients
+	ca.reset(now)
+	ca.mu.Unlock()
+
+	for slot, count := range slots {
+		handler(map[string]interface{}{
+			rsniffer.AnalyzeEvent:  rsniffer.EventCluster,
+			rsniffer.AnalyzeKind:   "slot",
+			rsniffer.AnalyzeSlot:   slot,
+			rsniffer.AnalyzeWindow: elapsed.String(),
+			rsniffer.AnalyzeRate:   float64(count) / elapsed.Seconds(),
+			"commands":             count,
+		}, nil)
+	}
+	for node, count := range nodes {
+		handler(map[string]interface{}{
+			rsniffer.AnalyzeEvent:  rsniffer.EventCluster,
+			rsniffer.AnalyzeKind:   "node",
+			rsniffer.AnalyzeNode:   node,
+			rsniffer.AnalyzeWindow: elapsed.String(),
+			rsniffer.AnalyzeRate:   float64(count) / elapsed.Seconds(),
+			"commands":             count,
+			"slots":                len(nodeSlots[node]),
+		}, nil)
+	}
+	for client, cs := range clients {
+		redirects := cs.Errors[rsniffer.ClusterMoved] + cs.Errors[rsniffer.ClusterAsk]
+		if len(cs.Errors) == 0 && cs.Asking == 0 {
+			continue
+		}
+		var ratio float64
+		if cs.Requests > 0 {
+			ratio = float64(redirects) / float64(cs.Requests)
+		}
+		handler(map[string]interface{}{
+			rsniffer.AnalyzeEvent:  rsniffer.EventCluster,
+			rsniffer.AnalyzeKind:   "client",
+			rsniffer.AnalyzeClient: client,
+			rsniffer.AnalyzeWindow: elapsed.String(),
+			rsniffer.AnalyzeRate:   float64(redirects) / elapsed.Seconds(),
+			"requests":             cs.Requests,
+			"redirects":            redirects,
+			"redirect_ratio":       ratio,
+			"asking":               cs.Asking,
+			"errors":               cs.Errors,
+			"moved_slots":          len(cs.MovedSlots),
+		}, nil)
+	}
+}
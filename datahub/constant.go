@@ -1,6 +1,9 @@
 package datahub
 
 const (
-	RedisMulti  = 1 << 0
-	RedisPubsub = 1 << 1
+	RedisMulti     = 1 << 0
+	RedisPubsub    = 1 << 1
+	RedisReplyOff  = 1 << 2 // CLIENT REPLY OFF, no reply until CLIENT REPLY ON
+	RedisReplySkip = 1 << 3 // CLIENT REPLY SKIP, the reply of next command is skipped
+	RedisMonitor   = 1 << 4 // MONITOR, replies are a stream of monitored commands
 )
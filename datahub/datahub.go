@@ -1,9 +1,12 @@
 package datahub
 
 import (
+	"encoding/hex"
 	"fmt"
 	"github.com/amyangfei/redsnif/rsniffer"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -22,54 +25,328 @@ type HubConfig struct {
 
 type AnalyzeResultHandler func(map[string]interface{}, error)
 
+// Analyzer is fed with every paired request and reply of hub sessions, Tick
+// is called periodically so that windowed analyzers could emit their summary.
+//
+// Analyzers must be safe for concurrent use. Workers of Pipeline call Analyze
+// and the optional methods below for different sessions at the same time,
+// and Tick concurrently with them, so an analyzer guards its own state and
+// should not hold its lock while calling handler. Calls for one session are
+// always made in order from the same worker.
+type Analyzer interface {
+	Analyze(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler)
+	Tick(now time.Time, handler AnalyzeResultHandler)
+}
+
+// PushAnalyzer is an optional interface of Analyzer, it is fed with messages
+// pushed by redis to subscribed sessions.
+type PushAnalyzer interface {
+	AnalyzePush(hs *HubSession, push *rsniffer.PushMessage, handler AnalyzeResultHandler)
+}
+
+// SessionAnalyzer is an optional interface of Analyzer, SessionEnd is called
+// when a hub session is closed, reset or evicted so that state kept for the
+// session could be released.
+type SessionAnalyzer interface {
+	SessionEnd(hs *HubSession, handler AnalyzeResultHandler)
+}
+
 type BaseHub struct {
-	snifcfg  *rsniffer.SniffConfig
-	sessions map[string]*HubSession
+	snifcfg       *rsniffer.SniffConfig
+	sessions      map[string]*HubSession
+	analyzers     []Analyzer
+	sessionEvents map[int]int64 // lifecycle events handled by kind
+	sniffErrors   int64         // non fatal errors from sniffer
+	decodeErrors  int64         // errors decoding buffered data of sessions
+	unpairedReqs  int64         // requests dropped without reply
+	unpairedReps  int64         // replies without request
+	sampler       *Sampler      // sampler of per command results, nil if not sampled
+	mu            sync.Mutex    // guards sessions and counters
+	azMu          sync.Mutex    // guards the list of analyzers, which guard their own state
 }
 
 type HubSession struct {
 	sid            string
+	client         string
+	server         string
 	queuedRequest  []*rsniffer.RespData
 	queuedReply    []*rsniffer.RespData
 	flags          int // REDIS_MULTI | REDIS_PUBSUB ...
 	multiQueuedReq []*rsniffer.RespData
+	multiStart     time.Time                   // time of MULTI request
+	multiErrors    int                         // commands rejected when queued in transaction
+	watched        map[string]bool             // keys watched by WATCH
+	noReply        map[*rsniffer.RespData]bool // queued requests redis doesn't reply, see CLIENT REPLY
+	subscriptions  map[int]map[string]bool     // subscribed channels and patterns by kind
+	subPending     int                         // confirmations left of the head (un)subscribe request
+	pubsubSince    time.Time                   // when the session entered pub/sub mode
+	pushCount      int64                       // messages pushed since pubsubSince
+	syncStart      time.Time                   // when the replica connection starts to sync
 }
 
 func NewBaseHub(snifcfg *rsniffer.SniffConfig) *BaseHub {
-	return &BaseHub{
-		snifcfg:  snifcfg,
-		sessions: map[string]*HubSession{},
+	hub := &BaseHub{
+		snifcfg:       snifcfg,
+		sessions:      map[string]*HubSession{},
+		analyzers:     make([]Analyzer, 0),
+		sessionEvents: map[int]int64{},
+	}
+	if snifcfg.AzConfig != nil && snifcfg.AzConfig.BigKey != nil {
+		hub.AddAnalyzer(NewBigKeyAnalyzer(snifcfg.AzConfig.BigKey))
+	}
+	if snifcfg.AzConfig != nil && snifcfg.AzConfig.KeyPattern != nil {
+		hub.AddAnalyzer(NewPatternAnalyzer(snifcfg.AzConfig.KeyPattern))
+	}
+	if snifcfg.AzConfig != nil && snifcfg.AzConfig.Channel != nil {
+		hub.AddAnalyzer(NewChannelAnalyzer(snifcfg.AzConfig.Channel))
+	}
+	if snifcfg.AzConfig != nil && snifcfg.AzConfig.Blocking != nil {
+		hub.AddAnalyzer(NewBlockingAnalyzer(snifcfg.AzConfig.Blocking))
+	}
+	if snifcfg.AzConfig != nil && snifcfg.AzConfig.Tracking != nil {
+		hub.AddAnalyzer(NewTrackingAnalyzer(snifcfg.AzConfig.Tracking))
+	}
+	if snifcfg.AzConfig != nil && snifcfg.AzConfig.Cluster != nil {
+		hub.AddAnalyzer(NewClusterAnalyzer(snifcfg.AzConfig.Cluster))
+	}
+	if snifcfg.AzConfig != nil && snifcfg.AzConfig.Sentinel != nil {
+		hub.AddAnalyzer(NewSentinelAnalyzer(snifcfg.AzConfig.Sentinel))
+	}
+	if snifcfg.AzConfig != nil && snifcfg.AzConfig.Error != nil {
+		hub.AddAnalyzer(NewErrorAnalyzer(snifcfg.AzConfig.Error))
+	}
+	if snifcfg.AzConfig != nil && snifcfg.AzConfig.Sampling != nil {
+		hub.sampler = NewSampler(snifcfg.AzConfig.Sampling)
 	}
+	return hub
 }
 
-func (hub *BaseHub) AnalyzePacketInfo(rs *rsniffer.RedSession, handler AnalyzeResultHandler) {
-	request, reply, err := rs.GetRespData()
-	if err != nil {
-		handler(nil, fmt.Errorf("get respdata error: %v", err))
-		return
+// AddAnalyzer registers an analyzer which will be fed with every paired
+// request and reply.
+func (hub *BaseHub) AddAnalyzer(az Analyzer) {
+	hub.azMu.Lock()
+	defer hub.azMu.Unlock()
+	analyzers := make([]Analyzer, len(hub.analyzers), len(hub.analyzers)+1)
+	copy(analyzers, hub.analyzers)
+	hub.analyzers = append(analyzers, az)
+}
+
+// getAnalyzers returns the registered analyzers, the list is never modified
+// in place so it could be iterated without lock.
+func (hub *BaseHub) getAnalyzers() []Analyzer {
+	hub.azMu.Lock()
+	defer hub.azMu.Unlock()
+	return hub.analyzers
+}
+
+// Tick should be called periodically by hub runners.
+func (hub *BaseHub) Tick(now time.Time, handler AnalyzeResultHandler) {
+	for _, az := range hub.getAnalyzers() {
+		az.Tick(now, handler)
+	}
+	if hub.sampler != nil {
+		hub.sampler.Tick(now, handler)
 	}
+}
+
+// ID returns the hex encoded redis session id
+func (hs *HubSession) ID() string {
+	return hs.sid
+}
+
+// Client returns the client address of the session
+func (hs *HubSession) Client() string {
+	return hs.client
+}
 
-	if _, ok := hub.sessions[string(rs.ID)]; !ok {
-		hub.sessions[string(rs.ID)] = &HubSession{
+// Server returns the redis server address of the session
+func (hs *HubSession) Server() string {
+	return hs.server
+}
+
+// Subscriptions returns the subscribed channels or patterns of kind, such as
+// rsniffer.SubChannel
+func (hs *HubSession) Subscriptions(kind int) []string {
+	subs := make([]string, 0, len(hs.subscriptions[kind]))
+	for ch := range hs.subscriptions[kind] {
+		subs = append(subs, ch)
+	}
+	return subs
+}
+
+// applySubscribe updates subscriptions with a (un)subscribe confirmation, the
+// session enters pub/sub mode with the first subscription and leaves when no
+// subscription is left.
+func (hs *HubSession) applySubscribe(sr *rsniffer.SubscribeReply, ts time.Time) {
+	subs, ok := hs.subscriptions[sr.Kind]
+	if !ok {
+		subs = map[string]bool{}
+		hs.subscriptions[sr.Kind] = subs
+	}
+	if sr.Subscribe {
+		subs[sr.Channel] = true
+	} else {
+		delete(subs, sr.Channel)
+	}
+	// count replied by redis is authoritative, channels and patterns share a
+	// count while shard channels have their own
+	if sr.Count == 0 {
+		if sr.Kind == rsniffer.SubShardChannel {
+			delete(hs.subscriptions, rsniffer.SubShardChannel)
+		} else {
+			delete(hs.subscriptions, rsniffer.SubChannel)
+			delete(hs.subscriptions, rsniffer.SubPattern)
+		}
+	}
+	total := 0
+	for _, subs := range hs.subscriptions {
+		total += len(subs)
+	}
+	if total > 0 && hs.flags&RedisPubsub == 0 {
+		hs.flags |= RedisPubsub
+		hs.pubsubSince = ts
+		hs.pushCount = 0
+	} else if total == 0 {
+		hs.flags &= ^RedisPubsub
+	}
+}
+
+// resetPubsub leaves pub/sub mode, e.g. after RESET command
+func (hs *HubSession) resetPubsub() {
+	hs.subscriptions = map[int]map[string]bool{}
+	hs.subPending = 0
+	hs.flags &= ^RedisPubsub
+}
+
+// fanInRate returns messages per second pushed to the session since it
+// entered pub/sub mode
+func (hs *HubSession) fanInRate(now time.Time) float64 {
+	elapsed := now.Sub(hs.pubsubSince)
+	if hs.pubsubSince.IsZero() || elapsed < time.Second {
+		elapsed = time.Second
+	}
+	return float64(hs.pushCount) / elapsed.Seconds()
+}
+
+// tagHandler tags every result of the session with its redis server, and
+// results recording the request with the session so that requests could be
+// replayed per connection, see cmd/redreplay
+func (hs *HubSession) tagHandler(handler AnalyzeResultHandler) AnalyzeResultHandler {
+	return func(fields map[string]interface{}, err error) {
+		if len(fields) > 0 {
+			fields[rsniffer.AnalyzeServer] = hs.server
+		}
+		if _, ok := fields[rsniffer.AnalyzeRequest]; ok {
+			fields[rsniffer.AnalyzeSession] = hs.sid
+		}
+		handler(fields, err)
+	}
+}
+
+// session returns the hub session of rs, it is created if not exists. A hub
+// session is only touched by the goroutine analyzing rs, but the map of hub
+// sessions is shared.
+func (hub *BaseHub) session(rs *rsniffer.RedSession) *HubSession {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hs, ok := hub.sessions[string(rs.ID)]
+	if !ok {
+		hs = &HubSession{
+			sid:            hex.EncodeToString(rs.ID),
+			client:         rs.Client(),
+			server:         rs.Server(),
 			queuedRequest:  make([]*rsniffer.RespData, 0),
 			queuedReply:    make([]*rsniffer.RespData, 0),
 			multiQueuedReq: make([]*rsniffer.RespData, 0),
+			subscriptions:  map[int]map[string]bool{},
+			watched:        map[string]bool{},
+			noReply:        map[*rsniffer.RespData]bool{},
 		}
+		hub.sessions[string(rs.ID)] = hs
 	}
-	hs := hub.sessions[string(rs.ID)]
+	return hs
+}
+
+func (hub *BaseHub) AnalyzePacketInfo(rs *rsniffer.RedSession, handler AnalyzeResultHandler) {
+	request, reply, err := rs.GetRespData()
+	if se, ok := err.(*rsniffer.SessionEvent); ok {
+		// data decoded before the dropped data is still analyzed
+		defer hub.HandleSessionEvent(se, handler)
+	} else if err != nil {
+		hub.mu.Lock()
+		hub.decodeErrors++
+		hub.mu.Unlock()
+		handler(nil, fmt.Errorf("get respdata error: %v", err))
+		return
+	}
+
+	hs := hub.session(rs)
+	handler = hs.tagHandler(handler)
 	if request != nil && len(request) > 0 {
+		for _, reqRD := range request {
+			if !hs.expectReply(reqRD) {
+				hs.noReply[reqRD] = true
+			}
+		}
 		hs.queuedRequest = append(hs.queuedRequest, request...)
 	}
 	if reply != nil && len(reply) > 0 {
 		hs.queuedReply = append(hs.queuedReply, reply...)
 	}
 
-	// the length of queuedRequest should be always no smaller than the count of queuedReply
-	replyCount := len(hs.queuedReply)
-	for i := 0; i < replyCount; i++ {
-		var reqRD, replyRD *rsniffer.RespData
+	// every reply answers the first queued request, except messages pushed to
+	// subscribed session, replication stream of replica, monitored commands of
+	// monitor session and confirmations of (un)subscribe requests, which are
+	// replied once for each channel. Requests without reply are drained
+	// when they reach the head of queue.
+	for {
+		hub.drainNoReply(hs, handler)
+		if len(hs.queuedReply) == 0 {
+			break
+		}
+		replyRD := hs.queuedReply[0]
+		if replyRD.Repl > 0 {
+			hs.queuedReply = hs.queuedReply[1:]
+			hub.analyzeRepl(hs, replyRD, handler)
+			continue
+		}
+		if hs.isMonitorLine(replyRD) {
+			// monitored commands answer no request
+			hs.queuedReply = hs.queuedReply[1:]
+			continue
+		}
+		if push := rsniffer.ParsePushMessage(replyRD); push != nil &&
+			(replyRD.Push || hs.flags&RedisPubsub > 0 || len(hs.queuedRequest) == 0) {
+			hs.queuedReply = hs.queuedReply[1:]
+			hub.analyzePush(hs, push, handler)
+			continue
+		}
+		if replyRD.Push && rsniffer.ParseSubscribeReply(replyRD) == nil {
+			// other RESP3 push frames answer no request either
+			hs.queuedReply = hs.queuedReply[1:]
+			continue
+		}
+		if len(hs.queuedRequest) == 0 {
+			// request is not captured, e.g. sniffer starts in the middle of a session
+			hs.queuedReply = hs.queuedReply[1:]
+			hub.mu.Lock()
+			hub.unpairedReps++
+			hub.mu.Unlock()
+			handler(nil, fmt.Errorf("reply without request"))
+			continue
+		}
+		if sr := rsniffer.ParseSubscribeReply(replyRD); sr != nil {
+			hs.queuedReply = hs.queuedReply[1:]
+			if hub.analyzeSubscribe(hs, hs.queuedRequest[0], replyRD, sr) {
+				reqRD := hs.queuedRequest[0]
+				hs.queuedRequest = hs.queuedRequest[1:]
+				hub.analyzePair(hs, reqRD, replyRD, handler)
+			}
+			continue
+		}
+		var reqRD *rsniffer.RespData
 		reqRD, hs.queuedRequest = hs.queuedRequest[0], hs.queuedRequest[1:]
-		replyRD, hs.queuedReply = hs.queuedReply[0], hs.queuedReply[1:]
+		hs.queuedReply = hs.queuedReply[1:]
 
 		// client request itself to redis with error
 		cmd, err := reqRD.GetCommand()
@@ -77,50 +354,119 @@ func (hub *BaseHub) AnalyzePacketInfo(rs *rsniffer.RedSession, handler AnalyzeRe
 			handler(nil, err)
 			continue
 		}
-		// client request to redis with error
-		if replyRD.IsError() {
-			fields, err := rsniffer.RespErrorAnalyze(reqRD, replyRD, hub.snifcfg.AzConfig)
-			handler(fields, err)
-			continue
-		}
-		// start a transaction
 		cmdName := strings.ToUpper(cmd.Name())
-		if cmdName == "MULTI" && replyRD.IsString() && replyRD.Msg.Status == "OK" {
-			hs.multiQueuedReq = make([]*rsniffer.RespData, 0)
-			hs.flags |= RedisMulti
-			continue
+		// RESET leaves pub/sub and monitor mode, discards transaction and
+		// unwatches keys
+		if cmdName == "RESET" && replyRD.IsString() {
+			hs.resetPubsub()
+			hs.resetTransaction()
+			hs.watched = map[string]bool{}
+			hs.flags &= ^RedisMonitor
 		}
-		// redis session is in transaction
-		if hs.flags&RedisMulti > 0 {
-			if cmdName == "DISCARD" {
-				// discard a transaction
-				handler(map[string]interface{}{rsniffer.AnalyzeMesg: "transaction discard"}, nil)
-				hs.flags &= ^RedisMulti
-				continue
-			} else if cmdName == "EXEC" {
-				// exec a transaction
-				if !replyRD.IsArray() || len(replyRD.Msg.Array) != len(hs.multiQueuedReq) {
-					hs.flags &= ^RedisMulti
-					handler(nil, fmt.Errorf("multi result count doesn't match queued requests"))
-					continue
-				}
-				for j := 0; j < len(hs.multiQueuedReq); j++ {
-					tReq := hs.multiQueuedReq[j]
-					tReply := &rsniffer.RespData{Msg: replyRD.Msg.Array[j]}
-					fields, err := rsniffer.RespDataAnalyze(tReq, tReply, hub.snifcfg.AzConfig)
-					handler(fields, err)
-				}
-				hs.flags &= ^RedisMulti
-				continue
-			} else {
-				// redis command queued
-				hs.multiQueuedReq = append(hs.multiQueuedReq, reqRD)
-				continue
-			}
+		if cmdName == "MONITOR" && replyRD.IsString() {
+			hub.startMonitor(hs, handler)
+		}
+		if cmdName == "PSYNC" {
+			hub.analyzeSync(hs, replyRD, handler)
+		}
+		if hub.analyzeTransaction(hs, cmdName, cmd, reqRD, replyRD, handler) {
+			continue
 		}
 
 		// normal request and reply
-		fields, err := rsniffer.RespDataAnalyze(reqRD, replyRD, hub.snifcfg.AzConfig)
+		hub.analyzePair(hs, reqRD, replyRD, handler)
+	}
+}
+
+func (hub *BaseHub) analyzePair(hs *HubSession, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	var fields map[string]interface{}
+	var err error
+	cmd, cmdErr := reqRD.GetCommand()
+	if replyRD.IsError() {
+		fields, err = rsniffer.RespErrorAnalyze(reqRD, replyRD, hub.snifcfg.AzConfig)
+	} else {
+		fields, err = rsniffer.RespDataAnalyze(reqRD, replyRD, hub.snifcfg.AzConfig)
+	}
+	// analyzers are fed below even if the result is sampled out
+	if hub.sample(hs, cmd, reqRD, replyRD, fields) {
+		// error replied by redis is reported as an event, not a sniffer error
+		if re, ok := err.(*rsniffer.ReplyError); ok {
+			hub.reportReplyError(hs, cmd, re, handler)
+			err = nil
+		}
 		handler(fields, err)
 	}
+	if cmdErr == nil {
+		hub.runAnalyzers(hs, cmd, reqRD, replyRD, handler)
+	}
+}
+
+// analyzeSubscribe applies a (un)subscribe confirmation of request reqRD,
+// it returns true when the last confirmation of reqRD is received.
+func (hub *BaseHub) analyzeSubscribe(hs *HubSession, reqRD, replyRD *rsniffer.RespData, sr *rsniffer.SubscribeReply) bool {
+	cmd, err := reqRD.GetCommand()
+	if err != nil || rsniffer.SubscribeCmds[strings.ToUpper(cmd.Name())] == 0 {
+		// the (un)subscribe request is not captured
+		hs.applySubscribe(sr, replyRD.Time)
+		return false
+	}
+	if hs.subPending <= 0 {
+		hs.subPending = len(cmd.Args) - 1
+		if hs.subPending == 0 {
+			// unsubscribe from all, redis replies once even if nothing is subscribed
+			hs.subPending = len(hs.subscriptions[sr.Kind])
+			if hs.subPending == 0 {
+				hs.subPending = 1
+			}
+		}
+	}
+	hs.applySubscribe(sr, replyRD.Time)
+	hs.subPending--
+	return hs.subPending == 0
+}
+
+// analyzePush reports a message pushed to subscribed session, fan-in rate is
+// the messages per second received by the session in pub/sub mode.
+func (hub *BaseHub) analyzePush(hs *HubSession, push *rsniffer.PushMessage, handler AnalyzeResultHandler) {
+	hub.runPushAnalyzers(hs, push, handler)
+	if push.IsInvalidation() {
+		// invalidations are summarized by TrackingAnalyzer
+		return
+	}
+	hs.pushCount++
+	fields := map[string]interface{}{
+		rsniffer.AnalyzeEvent:   rsniffer.EventPubsubMsg,
+		rsniffer.AnalyzeSession: hs.ID(),
+		rsniffer.AnalyzeClient:  hs.Client(),
+		rsniffer.AnalyzeKind:    push.Kind,
+		rsniffer.AnalyzeChannel: push.Channel,
+		rsniffer.AnalyzeBytes:   len(push.Payload),
+		rsniffer.AnalyzeRate:    hs.fanInRate(push.Time),
+	}
+	if push.Pattern != "" {
+		fields[rsniffer.AnalyzePattern] = push.Pattern
+	}
+	handler(fields, nil)
+}
+
+func (hub *BaseHub) runPushAnalyzers(hs *HubSession, push *rsniffer.PushMessage, handler AnalyzeResultHandler) {
+	for _, az := range hub.getAnalyzers() {
+		if pa, ok := az.(PushAnalyzer); ok {
+			pa.AnalyzePush(hs, push, handler)
+		}
+	}
+}
+
+func (hub *BaseHub) runSessionAnalyzers(hs *HubSession, handler AnalyzeResultHandler) {
+	for _, az := range hub.getAnalyzers() {
+		if sa, ok := az.(SessionAnalyzer); ok {
+			sa.SessionEnd(hs, handler)
+		}
+	}
+}
+
+func (hub *BaseHub) runAnalyzers(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	for _, az := range hub.getAnalyzers() {
+		az.Analyze(hs, cmd, reqRD, replyRD, handler)
+	}
 }
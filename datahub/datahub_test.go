@@ -0,0 +1,101 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// encodeArgs encodes a command as RESP array of bulk strings
+func encodeArgs(args ...string) string {
+	s := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		s += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	return s
+}
+
+// testSession feeds request and reply pairs of one redis session to hub and
+// keeps the results
+type testSession struct {
+	t       *testing.T
+	hub     *BaseHub
+	rs      *rsniffer.RedSession
+	now     time.Time
+	results []map[string]interface{}
+	errs    []error
+}
+
+func newTestSession(t *testing.T, hub *BaseHub, id string) *testSession {
+	return &testSession{
+		t:   t,
+		hub: hub,
+		rs: &rsniffer.RedSession{
+			ID:         []byte(id),
+			ClientAddr: "10.0.0.1:5555",
+			ServerAddr: "10.0.0.2:6379",
+			RBuf:       make([]byte, 8192),
+			WBuf:       make([]byte, 8192),
+		},
+		now: time.Unix(1500000000, 0),
+	}
+}
+
+func (ts *testSession) handle(fields map[string]interface{}, err error) {
+	if err != nil {
+		ts.errs = append(ts.errs, err)
+	}
+	if fields != nil {
+		ts.results = append(ts.results, fields)
+	}
+}
+
+// send feeds a request and its raw reply, the reply arrives a millisecond
+// after the request
+func (ts *testSession) send(reply string, args ...string) {
+	if err := ts.rs.AppendRequestData([]byte(encodeArgs(args...)), ts.now); err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.now = ts.now.Add(time.Millisecond)
+	if reply != "" {
+		if err := ts.rs.AppendReplyData([]byte(reply), ts.now); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+	ts.hub.AnalyzePacketInfo(ts.rs, ts.handle)
+}
+
+// pipeline feeds pipelined requests and then their raw replies
+func (ts *testSession) pipeline(replies string, requests ...[]string) {
+	payload := ""
+	for _, args := range requests {
+		payload += encodeArgs(args...)
+	}
+	if err := ts.rs.AppendRequestData([]byte(payload), ts.now); err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.hub.AnalyzePacketInfo(ts.rs, ts.handle)
+	ts.receive(replies)
+}
+
+// receive feeds a raw reply which answers no request, such as a message
+// pushed to subscriber
+func (ts *testSession) receive(reply string) {
+	ts.now = ts.now.Add(time.Millisecond)
+	if err := ts.rs.AppendReplyData([]byte(reply), ts.now); err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.hub.AnalyzePacketInfo(ts.rs, ts.handle)
+}
+
+// events returns results of the event kind
+func (ts *testSession) events(event string) []map[string]interface{} {
+	events := make([]map[string]interface{}, 0)
+	for _, fields := range ts.results {
+		if fields[rsniffer.AnalyzeEvent] == event {
+			events = append(events, fields)
+		}
+	}
+	return events
+}
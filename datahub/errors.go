@@ -0,0 +1,125 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportReplyError emits an error replied by redis as a reply_error event, so
+// that it is not mixed up with errors of the sniffer itself. The message may
+// quote keys or values, it is scrubbed by the redaction patterns.
+func (hub *BaseHub) reportReplyError(hs *HubSession, cmd *rsniffer.Command, re *rsniffer.ReplyError, handler AnalyzeResultHandler) {
+	var rc *rsniffer.RedactConfig
+	if hub.snifcfg.AzConfig != nil {
+		rc = hub.snifcfg.AzConfig.Redact
+	}
+	fields := map[string]interface{}{
+		rsniffer.AnalyzeEvent:   rsniffer.EventReplyErr,
+		rsniffer.AnalyzeSession: hs.ID(),
+		rsniffer.AnalyzeClient:  hs.Client(),
+		rsniffer.AnalyzeErrCode: re.Code,
+		rsniffer.AnalyzeMesg:    rc.Scrub(re.Msg),
+	}
+	if cmd != nil {
+		fields[rsniffer.AnalyzeCmd] = strings.ToUpper(cmd.Name())
+	}
+	if re.Code == rsniffer.ErrCodeCustom {
+		fields["prefix"] = re.Prefix
+	}
+	handler(fields, nil)
+}
+
+// ErrorStat is the commands and error replies of a command or a client
+type ErrorStat struct {
+	Commands int64
+	Errors   int64
+	Codes    map[string]int64 // error replies by code
+}
+
+// ErrorAnalyzer aggregates error replies of each command and each client by
+// error code in a window.
+type ErrorAnalyzer struct {
+	cfg         *rsniffer.ErrorConfig
+	mu          sync.Mutex // guards window and stats
+	windowStart time.Time
+	commands    map[string]*ErrorStat
+	clients     map[string]*ErrorStat
+}
+
+func NewErrorAnalyzer(cfg *rsniffer.ErrorConfig) *ErrorAnalyzer {
+	return &ErrorAnalyzer{
+		cfg:         cfg,
+		windowStart: time.Now(),
+		commands:    map[string]*ErrorStat{},
+		clients:     map[string]*ErrorStat{},
+	}
+}
+
+func errorStat(stats map[string]*ErrorStat, name string) *ErrorStat {
+	es, ok := stats[name]
+	if !ok {
+		es = &ErrorStat{Codes: map[string]int64{}}
+		stats[name] = es
+	}
+	return es
+}
+
+func (ea *ErrorAnalyzer) Analyze(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	var code string
+	if replyRD.IsError() {
+		code = rsniffer.ClassifyReplyError(replyRD.Msg.Error).Code
+	}
+	ea.mu.Lock()
+	defer ea.mu.Unlock()
+	stats := []*ErrorStat{
+		errorStat(ea.commands, strings.ToUpper(cmd.Name())),
+		errorStat(ea.clients, hs.Client()),
+	}
+	for _, es := range stats {
+		es.Commands++
+		if code != "" {
+			es.Errors++
+			es.Codes[code]++
+		}
+	}
+}
+
+func (ea *ErrorAnalyzer) Tick(now time.Time, handler AnalyzeResultHandler) {
+	if ea.cfg.Window <= 0 {
+		return
+	}
+	ea.mu.Lock()
+	if now.Sub(ea.windowStart) < ea.cfg.Window {
+		ea.mu.Unlock()
+		return
+	}
+	elapsed := now.Sub(ea.windowStart)
+	commands, clients := ea.commands, ea.clients
+	ea.windowStart = now
+	ea.commands = map[string]*ErrorStat{}
+	ea.clients = map[string]*ErrorStat{}
+	ea.mu.Unlock()
+
+	report := func(kind, nameField string, stats map[string]*ErrorStat) {
+		for name, es := range stats {
+			if es.Errors == 0 {
+				continue
+			}
+			handler(map[string]interface{}{
+				rsniffer.AnalyzeEvent:  rsniffer.EventErrorRate,
+				rsniffer.AnalyzeKind:   kind,
+				nameField:              name,
+				rsniffer.AnalyzeWindow: elapsed.String(),
+				rsniffer.AnalyzeRate:   float64(es.Errors) / elapsed.Seconds(),
+				"commands":             es.Commands,
+				"errors":               es.Errors,
+				"error_ratio":          float64(es.Errors) / float64(es.Commands),
+				"codes":                es.Codes,
+			}, nil)
+		}
+	}
+	report("command", rsniffer.AnalyzeCmd, commands)
+	report("client", rsniffer.AnalyzeClient, clients)
+}
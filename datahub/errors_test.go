@@ -0,0 +1,109 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestReportReplyError(t *testing.T) {
+	rc := &rsniffer.RedactConfig{Patterns: []*regexp.Regexp{regexp.MustCompile(`[a-z]+@example\.com`)}}
+	tests := []struct {
+		rc    *rsniffer.RedactConfig
+		reply string
+		code  string
+		msg   string
+	}{
+		{nil, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+			rsniffer.ErrCodeWrongType, "WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{nil, "-ERR no such key bob@example.com\r\n", rsniffer.ErrCodeErr, "ERR no such key bob@example.com"},
+		{rc, "-ERR no such key bob@example.com\r\n", rsniffer.ErrCodeErr, "ERR no such key " + rsniffer.DefaultRedactMask},
+	}
+	for _, tt := range tests {
+		cfg := rsniffer.DefaultSniffConfig()
+		cfg.AzConfig.Redact = tt.rc
+		ts := newTestSession(t, NewBaseHub(cfg), "s1")
+		ts.send(tt.reply, "GET", "bob@example.com")
+		if len(ts.errs) > 0 {
+			t.Errorf("%q: errors %v", tt.reply, ts.errs)
+		}
+		events := ts.events(rsniffer.EventReplyErr)
+		if len(events) != 1 {
+			t.Errorf("%q: %d reply errors, want 1", tt.reply, len(events))
+			continue
+		}
+		if events[0][rsniffer.AnalyzeErrCode] != tt.code || events[0][rsniffer.AnalyzeMesg] != tt.msg ||
+			events[0][rsniffer.AnalyzeCmd] != "GET" {
+			t.Errorf("%q: reply error %v", tt.reply, events[0])
+		}
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	ea := NewErrorAnalyzer(&rsniffer.ErrorConfig{Window: time.Second})
+	hub := NewBaseHub(rsniffer.DefaultSniffConfig())
+	hub.AddAnalyzer(ea)
+	s1 := newTestSession(t, hub, "s1")
+	s2 := newTestSession(t, hub, "s2")
+	s2.rs.ClientAddr = "10.0.0.3:5555"
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	s1.send(wrongType, "GET", "h")
+	s1.send("$1\r\nv\r\n", "GET", "k")
+	s1.send("-OOM command not allowed when used memory > 'maxmemory'.\r\n", "SET", "k", "v")
+	s2.send(wrongType, "GET", "h")
+	s2.send("+OK\r\n", "SET", "k", "v")
+	s2.send("$1\r\nv\r\n", "GET", "k")
+
+	tests := []struct {
+		kind     string
+		name     string
+		commands int64
+		errors   int64
+		codes    map[string]int64
+	}{
+		{"command", "GET", 4, 2, map[string]int64{rsniffer.ErrCodeWrongType: 2}},
+		{"command", "SET", 2, 1, map[string]int64{rsniffer.ErrCodeOOM: 1}},
+		{"client", "10.0.0.1:5555", 3, 2, map[string]int64{rsniffer.ErrCodeWrongType: 1, rsniffer.ErrCodeOOM: 1}},
+		{"client", "10.0.0.3:5555", 3, 1, map[string]int64{rsniffer.ErrCodeWrongType: 1}},
+	}
+	reported := map[string]map[string]interface{}{}
+	now := time.Now().Add(2 * time.Second)
+	hub.Tick(now, func(fields map[string]interface{}, err error) {
+		if fields[rsniffer.AnalyzeEvent] != rsniffer.EventErrorRate {
+			return
+		}
+		name, _ := fields[rsniffer.AnalyzeCmd].(string)
+		if fields[rsniffer.AnalyzeKind] == "client" {
+			name, _ = fields[rsniffer.AnalyzeClient].(string)
+		}
+		reported[fields[rsniffer.AnalyzeKind].(string)+" "+name] = fields
+	})
+	if len(reported) != len(tests) {
+		t.Errorf("%d error rates reported, want %d: %v", len(reported), len(tests), reported)
+	}
+	for _, tt := range tests {
+		fields, ok := reported[tt.kind+" "+tt.name]
+		if !ok {
+			t.Errorf("no error rate of %s %s", tt.kind, tt.name)
+			continue
+		}
+		if fields["commands"] != tt.commands || fields["errors"] != tt.errors || !reflect.DeepEqual(fields["codes"], tt.codes) ||
+			fields["error_ratio"] != float64(tt.errors)/float64(tt.commands) {
+			t.Errorf("error rate of %s %s: %v", tt.kind, tt.name, fields)
+		}
+	}
+
+	// the window is reset, commands without error are not reported
+	s1.send("$1\r\nv\r\n", "GET", "k")
+	reported = map[string]map[string]interface{}{}
+	hub.Tick(now.Add(2*time.Second), func(fields map[string]interface{}, err error) {
+		if fields[rsniffer.AnalyzeEvent] == rsniffer.EventErrorRate {
+			reported[fields[rsniffer.AnalyzeKind].(string)] = fields
+		}
+	})
+	if len(reported) != 0 {
+		t.Errorf("error rates %v reported without errors", reported)
+	}
+}
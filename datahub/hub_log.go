@@ -4,22 +4,29 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/amyangfei/redsnif/rsniffer"
 	"io"
+	"time"
 )
 
 type LogHubber struct {
-	logger *logrus.Logger
-	hub    *BaseHub
+	logger        *logrus.Logger
+	hub           *BaseHub
+	pipeline      *PipelineConfig
+	statsInterval time.Duration
 }
 
 type LogHubConfig struct {
-	Output io.Writer
-	Format logrus.Formatter
+	Output        io.Writer
+	Format        logrus.Formatter
+	Pipeline      *PipelineConfig // analyze on sharded workers, on the capture loop if nil
+	StatsInterval time.Duration   // interval of stats event of sniffer and hub, 0 disables
 }
 
 func NewLogHubber(snifcfg *rsniffer.SniffConfig, hubcfg *LogHubConfig) *LogHubber {
 	lh := &LogHubber{
-		logger: logrus.New(),
-		hub:    NewBaseHub(snifcfg),
+		logger:        logrus.New(),
+		hub:           NewBaseHub(snifcfg),
+		pipeline:      hubcfg.Pipeline,
+		statsInterval: hubcfg.StatsInterval,
 	}
 	lh.logger.Out = hubcfg.Output
 	lh.logger.Formatter = hubcfg.Format
@@ -27,30 +34,57 @@ func NewLogHubber(snifcfg *rsniffer.SniffConfig, hubcfg *LogHubConfig) *LogHubbe
 }
 
 func (lh *LogHubber) Run() error {
+	if lh.pipeline != nil {
+		p := NewPipeline(lh.hub, lh.pipeline)
+		if lh.statsInterval > 0 {
+			p.ReportStats(lh.statsInterval)
+		}
+		// logrus logger is safe for concurrent use
+		return p.Run(lh.logResult)
+	}
 	c := make(chan *rsniffer.RedSession)
 	ec := make(chan error)
-	go rsniffer.PacketSniff(lh.hub.snifcfg, c, ec)
+	sniffer := rsniffer.NewSniffer(lh.hub.snifcfg)
+	reporter := NewStatsReporter(lh.statsInterval, sniffer, lh.hub, nil)
+	go sniffer.Run(rsniffer.NewChanSink(c, ec))
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
+		case now := <-ticker.C:
+			lh.hub.Tick(now, lh.logResult)
+			reporter.Tick(now, lh.logResult)
 		case err := <-ec:
-			// ignore redis session close error
-			if err != rsniffer.RedSessionCloseErr {
+			if err == io.EOF {
+				// pcap file is finished
+				if lh.statsInterval > 0 {
+					lh.logResult(reporter.Fields(), nil)
+				}
+				return nil
+			}
+			// only capture failure stops the hub
+			if lh.hub.HandleSniffError(err, lh.logResult) {
 				return err
 			}
 		case rs := <-c:
 			lh.AnalyzePacketInfoWrapper(rs)
 		}
 	}
-	return nil
 }
 
 func (lh *LogHubber) AnalyzePacketInfoWrapper(rs *rsniffer.RedSession) {
-	lh.hub.AnalyzePacketInfo(rs, func(fields map[string]interface{}, err error) {
-		if fields != nil {
-			lh.logger.WithFields(fields).Info("log_hub basic")
-		}
-		if err != nil {
-			lh.logger.Errorf("log_hub basic error: %v", err)
+	lh.hub.AnalyzePacketInfo(rs, lh.logResult)
+}
+
+func (lh *LogHubber) logResult(fields map[string]interface{}, err error) {
+	if fields != nil {
+		msg := "log_hub basic"
+		if event, ok := fields[rsniffer.AnalyzeEvent].(string); ok {
+			msg = "log_hub " + event
 		}
-	})
+		lh.logger.WithFields(fields).Info(msg)
+	}
+	if err != nil {
+		lh.logger.Errorf("log_hub sniffer error: %v", err)
+	}
 }
@@ -0,0 +1,104 @@
+package datahub
+
+import (
+	"encoding/hex"
+	"github.com/amyangfei/redsnif/rsniffer"
+)
+
+// resetQueues drops queued requests and replies after data of the session is
+// dropped by sniffer, as they can't be paired any more.
+func (hs *HubSession) resetQueues() {
+	hs.queuedRequest = make([]*rsniffer.RespData, 0)
+	hs.queuedReply = make([]*rsniffer.RespData, 0)
+	hs.noReply = map[*rsniffer.RespData]bool{}
+	hs.subPending = 0
+	hs.resetTransaction()
+}
+
+// HandleSessionEvent reports a lifecycle event of redis session and counts it
+// by kind. Hub session is removed when the session ends and analyzers are told
+// by SessionAnalyzer, and its queues are reset when data is dropped by
+// overflow or desync.
+func (hub *BaseHub) HandleSessionEvent(se *rsniffer.SessionEvent, handler AnalyzeResultHandler) {
+	hub.mu.Lock()
+	hub.sessionEvents[se.Kind]++
+	hub.mu.Unlock()
+	rs := se.Session
+	if rs == nil {
+		return
+	}
+	fields := map[string]interface{}{
+		rsniffer.AnalyzeEvent:   rsniffer.EventSession,
+		rsniffer.AnalyzeKind:    rsniffer.SessionEventNames[se.Kind],
+		rsniffer.AnalyzeSession: hex.EncodeToString(rs.ID),
+		rsniffer.AnalyzeClient:  rs.Client(),
+		rsniffer.AnalyzeServer:  rs.Server(),
+	}
+	if se.Err != nil {
+		fields[rsniffer.AnalyzeMesg] = se.Err.Error()
+	}
+	handler(fields, nil)
+
+	hub.mu.Lock()
+	hs, ok := hub.sessions[string(rs.ID)]
+	switch se.Kind {
+	case rsniffer.SessionClose, rsniffer.SessionReset, rsniffer.SessionEvicted:
+		delete(hub.sessions, string(rs.ID))
+		if ok {
+			// requests whose reply is never captured
+			hub.unpairedReqs += int64(len(hs.queuedRequest))
+		}
+	case rsniffer.SessionOverflow, rsniffer.SessionDesync:
+		if ok {
+			hub.unpairedReqs += int64(len(hs.queuedRequest))
+		}
+	}
+	hub.mu.Unlock()
+	if !ok {
+		return
+	}
+	switch se.Kind {
+	case rsniffer.SessionClose, rsniffer.SessionReset, rsniffer.SessionEvicted:
+		hub.runSessionAnalyzers(hs, handler)
+	case rsniffer.SessionOverflow, rsniffer.SessionDesync:
+		hs.resetQueues()
+	}
+}
+
+// SessionEventCounts returns lifecycle events handled by kind name
+func (hub *BaseHub) SessionEventCounts() map[string]int64 {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	counts := make(map[string]int64)
+	for kind, count := range hub.sessionEvents {
+		counts[rsniffer.SessionEventNames[kind]] = count
+	}
+	return counts
+}
+
+// HandleSniffError handles an error from sniffer other than io.EOF, session
+// lifecycle events are handled by HandleSessionEvent and other errors are
+// counted and passed to handler. It returns true if the error is a capture
+// failure and sniffer has stopped.
+func (hub *BaseHub) HandleSniffError(err error, handler AnalyzeResultHandler) bool {
+	if rsniffer.IsFatal(err) {
+		return true
+	}
+	if se, ok := err.(*rsniffer.SessionEvent); ok {
+		hub.HandleSessionEvent(se, handler)
+		return false
+	}
+	hub.mu.Lock()
+	hub.sniffErrors++
+	hub.mu.Unlock()
+	handler(nil, err)
+	return false
+}
+
+// SniffErrors returns errors from sniffer which are neither fatal nor session
+// lifecycle events, such as failure of proxy to dial upstream
+func (hub *BaseHub) SniffErrors() int64 {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return hub.sniffErrors
+}
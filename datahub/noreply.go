@@ -0,0 +1,57 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"strings"
+)
+
+// expectReply tracks reply mode switched by CLIENT REPLY and tells whether
+// redis replies the request, requests must be checked in order.
+func (hs *HubSession) expectReply(reqRD *rsniffer.RespData) bool {
+	cmd, err := reqRD.GetCommand()
+	if err == nil && strings.ToUpper(cmd.Name()) == "REPLCONF" && len(cmd.Args) > 1 &&
+		strings.ToUpper(cmd.Args[1]) == "ACK" {
+		// replica acknowledges replication offset to master
+		return false
+	}
+	if err == nil && strings.ToUpper(cmd.Name()) == "CLIENT" && len(cmd.Args) == 3 &&
+		strings.ToUpper(cmd.Args[1]) == "REPLY" {
+		switch strings.ToUpper(cmd.Args[2]) {
+		case "ON":
+			hs.flags &= ^(RedisReplyOff | RedisReplySkip)
+			return true
+		case "OFF":
+			hs.flags |= RedisReplyOff
+			hs.flags &= ^RedisReplySkip
+			return false
+		case "SKIP":
+			if hs.flags&RedisReplyOff == 0 {
+				hs.flags |= RedisReplySkip
+			}
+			return false
+		}
+	}
+	if hs.flags&RedisReplyOff > 0 {
+		return false
+	}
+	if hs.flags&RedisReplySkip > 0 {
+		hs.flags &= ^RedisReplySkip
+		return false
+	}
+	return true
+}
+
+// drainNoReply reports requests at the head of queue which redis doesn't
+// reply, they are not fed to analyzers as there is no reply.
+func (hub *BaseHub) drainNoReply(hs *HubSession, handler AnalyzeResultHandler) {
+	for len(hs.queuedRequest) > 0 && hs.noReply[hs.queuedRequest[0]] {
+		reqRD := hs.queuedRequest[0]
+		hs.queuedRequest = hs.queuedRequest[1:]
+		delete(hs.noReply, reqRD)
+		fields, err := rsniffer.NoReplyAnalyze(reqRD, hub.snifcfg.AzConfig)
+		cmd, _ := reqRD.GetCommand()
+		if hub.sample(hs, cmd, reqRD, nil, fields) {
+			handler(fields, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"reflect"
+	"testing"
+)
+
+func TestClientReplyPairing(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests [][]string
+		replies  string
+		// commands reported in order, "!" is appended if not replied
+		want []string
+	}{
+		{"skip",
+			[][]string{{"CLIENT", "REPLY", "SKIP"}, {"SET", "a", "1"}, {"GET", "a"}},
+			"$1\r\n1\r\n",
+			[]string{"CLIENT!", "SET!", "GET"}},
+		{"skip twice",
+			[][]string{{"CLIENT", "REPLY", "SKIP"}, {"CLIENT", "REPLY", "SKIP"}, {"SET", "a", "1"}, {"GET", "a"}},
+			"$1\r\n1\r\n",
+			[]string{"CLIENT!", "CLIENT!", "SET!", "GET"}},
+		{"off and on",
+			[][]string{{"CLIENT", "REPLY", "OFF"}, {"SET", "b", "1"}, {"CLIENT", "REPLY", "SKIP"}, {"SET", "c", "1"},
+				{"CLIENT", "REPLY", "ON"}, {"GET", "b"}},
+			"+OK\r\n$1\r\n1\r\n",
+			[]string{"CLIENT!", "SET!", "CLIENT!", "SET!", "CLIENT", "GET"}},
+		{"on",
+			[][]string{{"CLIENT", "REPLY", "ON"}, {"SET", "a", "1"}},
+			"+OK\r\n+OK\r\n",
+			[]string{"CLIENT", "SET"}},
+		// REPLCONF is not reported, ACK is not replied by master
+		{"replica ack",
+			[][]string{{"REPLCONF", "ACK", "100"}, {"GET", "a"}},
+			"$1\r\n1\r\n",
+			[]string{"GET"}},
+	}
+	for _, tt := range tests {
+		cfg := rsniffer.DefaultSniffConfig()
+		cfg.AzConfig.SaveCmdTypes = []int{rsniffer.RedisCmdRead, rsniffer.RedisCmdWrite, rsniffer.RedisCmdFunc}
+		ts := newTestSession(t, NewBaseHub(cfg), "s1")
+		ts.pipeline(tt.replies, tt.requests...)
+		got := make([]string, 0, len(ts.results))
+		for _, fields := range ts.results {
+			name, _ := fields[rsniffer.AnalyzeCmd].(string)
+			if fields[rsniffer.AnalyzeNoReply] == true {
+				name += "!"
+			} else if fields[rsniffer.AnalyzeLatency] == nil {
+				t.Errorf("%s: %s is reported without latency", tt.name, name)
+			}
+			got = append(got, name)
+		}
+		if !reflect.DeepEqual(got, tt.want) || len(ts.errs) > 0 {
+			t.Errorf("%s: reported %q with errors %v, want %q", tt.name, got, ts.errs, tt.want)
+		}
+		if hs := ts.hub.sessions["s1"]; len(hs.queuedRequest) > 0 || len(hs.queuedReply) > 0 || len(hs.noReply) > 0 {
+			t.Errorf("%s: requests or replies are left in queue", tt.name)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PatternStat struct {
+	Count      int64 // commands touching keys of the pattern
+	Hit        int64
+	Miss       int64
+	Err        int64
+	Bytes      int64 // payload bytes of requests and replies
+	LatencySum time.Duration
+	LatencyMax time.Duration
+	Latencies  int64 // commands with known latency
+}
+
+func (ps *PatternStat) HitRate() float64 {
+	if ps.Hit+ps.Miss+ps.Err == 0 {
+		return 0
+	}
+	return float64(ps.Hit) / float64(ps.Hit+ps.Miss+ps.Err)
+}
+
+func (ps *PatternStat) LatencyAvg() time.Duration {
+	if ps.Latencies == 0 {
+		return 0
+	}
+	return ps.LatencySum / time.Duration(ps.Latencies)
+}
+
+// PatternAnalyzer buckets every key into a pattern and aggregates hit rate,
+// QPS, latency and bytes of each pattern in a window.
+type PatternAnalyzer struct {
+	cfg         *rsniffer.KeyPatternConfig
+	mu          sync.Mutex // guards window and stats
+	windowStart time.Time
+	stats       map[string]*PatternStat
+}
+
+func NewPatternAnalyzer(cfg *rsniffer.KeyPatternConfig) *PatternAnalyzer {
+	return &PatternAnalyzer{
+		cfg:         cfg,
+		windowStart: time.Now(),
+		stats:       map[string]*PatternStat{},
+	}
+}
+
+func (pa *PatternAnalyzer) stat(pattern string) *PatternStat {
+	ps, ok := pa.stats[pattern]
+	if !ok {
+		ps = &PatternStat{}
+		pa.stats[pattern] = ps
+	}
+	return ps
+}
+
+func (pa *PatternAnalyzer) Analyze(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	keys := cmd.Keys()
+	if len(keys) == 0 {
+		return
+	}
+	cmdName := strings.ToUpper(cmd.Name())
+	latency := rsniffer.ServiceLatency(cmd, reqRD, replyRD)
+	bytes := int64(reqRD.Size() + replyRD.Size())
+
+	var hits []map[string]interface{}
+	if !replyRD.IsError() && rsniffer.RedisCmds[cmdName] == rsniffer.RedisCmdRead {
+		hits = rsniffer.KeyHitAnalyze(cmd, cmdName, replyRD)
+	}
+	matched := make([]string, len(keys))
+	for i, key := range keys {
+		matched[i] = pa.cfg.Matcher.Match(key)
+	}
+
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	patterns := make(map[string]*PatternStat)
+	for _, pattern := range matched {
+		if _, ok := patterns[pattern]; !ok {
+			patterns[pattern] = pa.stat(pattern)
+		}
+	}
+	for _, ps := range patterns {
+		ps.Count++
+		ps.Bytes += bytes
+		if latency >= 0 {
+			ps.Latencies++
+			ps.LatencySum += latency
+			if latency > ps.LatencyMax {
+				ps.LatencyMax = latency
+			}
+		}
+	}
+
+	if replyRD.IsError() {
+		for _, ps := range patterns {
+			ps.Err++
+		}
+		return
+	}
+	for _, stat := range hits {
+		ps := patterns[pa.cfg.Matcher.Match(stat["key"].(string))]
+		switch stat["status"] {
+		case rsniffer.KeyHit:
+			ps.Hit++
+		case rsniffer.KeyMiss:
+			ps.Miss++
+		}
+	}
+}
+
+func (pa *PatternAnalyzer) Tick(now time.Time, handler AnalyzeResultHandler) {
+	if pa.cfg.Window <= 0 {
+		return
+	}
+	pa.mu.Lock()
+	if now.Sub(pa.windowStart) < pa.cfg.Window {
+		pa.mu.Unlock()
+		return
+	}
+	elapsed := now.Sub(pa.windowStart)
+	stats := pa.stats
+	pa.windowStart = now
+	pa.stats = map[string]*PatternStat{}
+	pa.mu.Unlock()
+
+	for pattern, ps := range stats {
+		handler(map[string]interface{}{
+			rsniffer.AnalyzeEvent:   rsniffer.EventPattern,
+			rsniffer.AnalyzePattern: pattern,
+			rsniffer.AnalyzeWindow:  elapsed.String(),
+			"count":                 ps.Count,
+			"qps":                   float64(ps.Count) / elapsed.Seconds(),
+			"hit":                   ps.Hit,
+			"miss":                  ps.Miss,
+			"error":                 ps.Err,
+			"hitrate":               ps.HitRate(),
+			rsniffer.AnalyzeBytes:   ps.Bytes,
+			"latency_avg":           int64(ps.LatencyAvg() / time.Microsecond),
+			"latency_max":           int64(ps.LatencyMax / time.Microsecond),
+		}, nil)
+	}
+}
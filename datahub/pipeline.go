@@ -0,0 +1,116 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"io"
+	"sync"
+	"time"
+)
+
+type PipelineConfig struct {
+	Workers   int  // analysis workers, sessions are sharded among them
+	QueueSize int  // sessions queued for each worker
+	Block     bool // capture waits when a queue is full instead of leaving data in session buffer
+}
+
+// Pipeline decouples capture and analysis, sessions are decoded, paired and
+// analyzed on workers sharded by session so that output of a session is
+// analyzed in order. Analyzers of the hub are shared by workers, so they must
+// be safe for concurrent use.
+type Pipeline struct {
+	hub      *BaseHub
+	sniffer  *rsniffer.Sniffer
+	shards   *rsniffer.Shards
+	reporter *StatsReporter // nil if statistics are not reported
+}
+
+func NewPipeline(hub *BaseHub, cfg *PipelineConfig) *Pipeline {
+	return &Pipeline{
+		hub:     hub,
+		sniffer: rsniffer.NewSniffer(hub.snifcfg),
+		shards:  rsniffer.NewShards(cfg.Workers, cfg.QueueSize, cfg.Block),
+	}
+}
+
+// ReportStats reports statistics of the pipeline as a stats event in
+// interval, and once more when all packets of pcap file are analyzed.
+func (p *Pipeline) ReportStats(interval time.Duration) {
+	p.reporter = NewStatsReporter(interval, p.sniffer, p.hub, p)
+}
+
+// Run starts sniffer and workers, handler is called by workers concurrently
+// so it must be safe for concurrent use. It returns nil when all packets of
+// pcap file are analyzed, or the error if capture fails.
+func (p *Pipeline) Run(handler AnalyzeResultHandler) error {
+	go p.sniffer.Run(p.shards)
+	var wg sync.WaitGroup
+	for i := 0; i < p.shards.Len(); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p.work(i, handler)
+		}(i)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.hub.Tick(now, handler)
+			if p.reporter != nil {
+				p.reporter.Tick(now, handler)
+			}
+		case err := <-p.shards.Errors():
+			if err == io.EOF {
+				// sniffer stops sending, drain the queues
+				p.shards.Close()
+				wg.Wait()
+				if p.reporter != nil {
+					handler(p.reporter.Fields(), nil)
+				}
+				return nil
+			}
+			if p.hub.HandleSniffError(err, handler) {
+				// sniffer stops sending after a fatal error as well
+				p.shards.Close()
+				wg.Wait()
+				return err
+			}
+		}
+	}
+}
+
+func (p *Pipeline) work(i int, handler AnalyzeResultHandler) {
+	for {
+		d, ok := p.shards.Next(i)
+		if !ok {
+			return
+		}
+		if d.Event == nil {
+			p.hub.AnalyzePacketInfo(d.Session, handler)
+			continue
+		}
+		switch d.Event.Kind {
+		case rsniffer.SessionClose, rsniffer.SessionReset, rsniffer.SessionEvicted:
+			// data left in buffer, e.g. the session is not queued as the
+			// queue is full
+			p.hub.AnalyzePacketInfo(d.Session, handler)
+		}
+		p.hub.HandleSessionEvent(d.Event, handler)
+	}
+}
+
+// Sniffer returns the sniffer of the pipeline, see rsniffer.Sniffer.Stats
+func (p *Pipeline) Sniffer() *rsniffer.Sniffer {
+	return p.sniffer
+}
+
+// Stats returns counts of sessions queued to workers
+func (p *Pipeline) Stats() rsniffer.ShardStats {
+	return p.shards.Stats()
+}
+
+// Backlog returns sessions and events waiting for workers
+func (p *Pipeline) Backlog() int {
+	return p.shards.Backlog()
+}
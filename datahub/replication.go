@@ -0,0 +1,97 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"strings"
+	"time"
+)
+
+// startMonitor enters monitor mode, every status reply after it is a
+// monitored command instead of a reply of the session's request.
+func (hub *BaseHub) startMonitor(hs *HubSession, handler AnalyzeResultHandler) {
+	hs.flags |= RedisMonitor
+	handler(map[string]interface{}{
+		rsniffer.AnalyzeEvent:   rsniffer.EventMonitor,
+		rsniffer.AnalyzeSession: hs.ID(),
+		rsniffer.AnalyzeClient:  hs.Client(),
+	}, nil)
+}
+
+// isMonitorLine tells whether a reply is a monitored command of a session in
+// monitor mode, RESET reply leaves monitor mode and answers its request.
+func (hs *HubSession) isMonitorLine(replyRD *rsniffer.RespData) bool {
+	return hs.flags&RedisMonitor > 0 && replyRD.IsString() && replyRD.Msg.Status != "RESET"
+}
+
+// analyzeSync reports the reply of PSYNC, "+FULLRESYNC <replid> <offset>" or
+// "+CONTINUE [<replid>]".
+func (hub *BaseHub) analyzeSync(hs *HubSession, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	hs.syncStart = replyRD.Time
+	if !hub.snifcfg.AzConfig.ReplStream || !replyRD.IsString() {
+		return
+	}
+	parts := strings.Fields(replyRD.Msg.Status)
+	if len(parts) == 0 {
+		return
+	}
+	fields := map[string]interface{}{
+		rsniffer.AnalyzeEvent:   rsniffer.EventReplSync,
+		rsniffer.AnalyzeSession: hs.ID(),
+		rsniffer.AnalyzeClient:  hs.Client(),
+	}
+	switch strings.ToUpper(parts[0]) {
+	case "FULLRESYNC":
+		fields[rsniffer.AnalyzeKind] = "full"
+		if len(parts) == 3 {
+			fields["replid"] = parts[1]
+			fields[rsniffer.AnalyzeOffset] = parts[2]
+		}
+	case "CONTINUE":
+		fields[rsniffer.AnalyzeKind] = "partial"
+		if len(parts) == 2 {
+			fields["replid"] = parts[1]
+		}
+	default:
+		return
+	}
+	handler(fields, nil)
+}
+
+// analyzeRepl deals with frames of replication stream, the RDB transfer of
+// full resync and commands propagated by master are reported if ReplStream
+// is enabled.
+func (hub *BaseHub) analyzeRepl(hs *HubSession, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	switch replyRD.Repl {
+	case rsniffer.ReplRDB:
+		if len(hs.queuedRequest) > 0 {
+			// SYNC is replied with RDB payload directly
+			reqRD := hs.queuedRequest[0]
+			if cmd, err := reqRD.GetCommand(); err == nil && strings.ToUpper(cmd.Name()) == "SYNC" {
+				hs.queuedRequest = hs.queuedRequest[1:]
+				hs.syncStart = reqRD.Time
+			}
+		}
+		if !hub.snifcfg.AzConfig.ReplStream {
+			return
+		}
+		fields := map[string]interface{}{
+			rsniffer.AnalyzeEvent:   rsniffer.EventReplRDB,
+			rsniffer.AnalyzeSession: hs.ID(),
+			rsniffer.AnalyzeClient:  hs.Client(),
+			rsniffer.AnalyzeBytes:   replyRD.Msg.Integer,
+		}
+		if !hs.syncStart.IsZero() {
+			fields[rsniffer.AnalyzeDuration] = int64(replyRD.Time.Sub(hs.syncStart) / time.Microsecond)
+		}
+		handler(fields, nil)
+	case rsniffer.ReplCmd:
+		if !hub.snifcfg.AzConfig.ReplStream {
+			return
+		}
+		fields, err := rsniffer.PropagatedAnalyze(replyRD, hub.snifcfg.AzConfig)
+		cmd, _ := replyRD.GetCommand()
+		if hub.sample(hs, cmd, replyRD, nil, fields) {
+			handler(fields, err)
+		}
+	}
+}
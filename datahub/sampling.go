@@ -0,0 +1,124 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Sampler decides which per command results are emitted, sampled out
+// commands are counted and reported in summaries. It is safe for concurrent
+// use.
+type Sampler struct {
+	cfg         *rsniffer.SamplingConfig
+	mu          sync.Mutex // guards rand and counts
+	rand        *rand.Rand
+	windowStart time.Time
+	kept        int64 // kept by sampling in window
+	forced      int64 // kept by overrides of errors and slow commands in window
+	dropped     int64 // sampled out in window
+	totalKept   int64
+	totalDrops  int64
+}
+
+func NewSampler(cfg *rsniffer.SamplingConfig) *Sampler {
+	return &Sampler{
+		cfg:         cfg,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		windowStart: time.Now(),
+	}
+}
+
+// sampled tells whether a command is kept by the sampling mode
+func (s *Sampler) sampled(hs *HubSession, cmd *rsniffer.Command) bool {
+	switch s.cfg.Mode {
+	case rsniffer.SampleSession:
+		return rsniffer.HashSampled(hs.ID(), s.cfg.Rate)
+	case rsniffer.SampleKey:
+		if cmd != nil {
+			if keys := cmd.Keys(); len(keys) > 0 {
+				return rsniffer.HashSampled(keys[0], s.cfg.Rate)
+			}
+		}
+	}
+	// commands without keys are sampled uniformly in key mode
+	return s.rand.Float64() < s.cfg.Rate
+}
+
+// forceKeep tells whether a command is kept regardless of sampling
+func (s *Sampler) forceKeep(cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData) bool {
+	if replyRD == nil {
+		return false
+	}
+	if s.cfg.KeepErrors && replyRD.IsError() {
+		return true
+	}
+	if s.cfg.KeepSlow > 0 && cmd != nil {
+		return rsniffer.ServiceLatency(cmd, reqRD, replyRD) >= s.cfg.KeepSlow
+	}
+	return false
+}
+
+// Keep decides whether the result of a command is emitted, kept results are
+// tagged with the sample rate. replyRD is nil for commands without reply.
+func (s *Sampler) Keep(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, fields map[string]interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.forceKeep(cmd, reqRD, replyRD):
+		s.forced++
+		fields[rsniffer.AnalyzeSampleRate] = 1.0
+	case s.sampled(hs, cmd):
+		s.kept++
+		fields[rsniffer.AnalyzeSampleRate] = s.cfg.Rate
+	default:
+		s.dropped++
+		s.totalDrops++
+		return false
+	}
+	s.totalKept++
+	return true
+}
+
+// Counts returns commands kept and sampled out since the sampler starts
+func (s *Sampler) Counts() (kept, dropped int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.totalKept, s.totalDrops
+}
+
+func (s *Sampler) Tick(now time.Time, handler AnalyzeResultHandler) {
+	if s.cfg.Window <= 0 {
+		return
+	}
+	s.mu.Lock()
+	if now.Sub(s.windowStart) < s.cfg.Window {
+		s.mu.Unlock()
+		return
+	}
+	windowStart, kept, forced, dropped := s.windowStart, s.kept, s.forced, s.dropped
+	s.windowStart = now
+	s.kept, s.forced, s.dropped = 0, 0, 0
+	s.mu.Unlock()
+
+	if kept+forced+dropped > 0 {
+		handler(map[string]interface{}{
+			rsniffer.AnalyzeEvent:      rsniffer.EventSampling,
+			rsniffer.AnalyzeWindow:     now.Sub(windowStart).String(),
+			rsniffer.AnalyzeSampleRate: s.cfg.Rate,
+			"kept":                     kept,
+			"forced":                   forced,
+			"dropped":                  dropped,
+		}, nil)
+	}
+}
+
+// sample applies sampling to the result of a command, ok is false if it is
+// sampled out. Results without fields are always kept.
+func (hub *BaseHub) sample(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, fields map[string]interface{}) bool {
+	if hub.sampler == nil || len(fields) == 0 {
+		return true
+	}
+	return hub.sampler.Keep(hs, cmd, reqRD, replyRD, fields)
+}
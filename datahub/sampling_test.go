@@ -0,0 +1,90 @@
+package datahub
+
+import (
+	"errors"
+	"github.com/amyangfei/redsnif/rsniffer"
+	"github.com/amyangfei/resp-go/resp"
+	"testing"
+	"time"
+)
+
+func TestSamplerKeep(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	okReply := &resp.Message{Type: resp.StringHeader, Status: "OK"}
+	errReply := &resp.Message{Type: resp.ErrorHeader, Error: errors.New("ERR failed")}
+	tests := []struct {
+		name    string
+		cfg     rsniffer.SamplingConfig
+		args    []string
+		reply   *resp.Message // nil for command without reply
+		latency time.Duration
+		keep    bool
+		rate    interface{}
+		forced  bool
+	}{
+		{"kept", rsniffer.SamplingConfig{Mode: rsniffer.SampleUniform, Rate: 1},
+			[]string{"GET", "k"}, okReply, time.Millisecond, true, 1.0, false},
+		{"dropped", rsniffer.SamplingConfig{Mode: rsniffer.SampleUniform, Rate: 0},
+			[]string{"GET", "k"}, okReply, time.Millisecond, false, nil, false},
+		{"error dropped", rsniffer.SamplingConfig{Mode: rsniffer.SampleUniform, Rate: 0},
+			[]string{"GET", "k"}, errReply, time.Millisecond, false, nil, false},
+		{"error kept", rsniffer.SamplingConfig{Mode: rsniffer.SampleUniform, Rate: 0, KeepErrors: true},
+			[]string{"GET", "k"}, errReply, time.Millisecond, true, 1.0, true},
+		{"slow kept", rsniffer.SamplingConfig{Mode: rsniffer.SampleUniform, Rate: 0, KeepSlow: 10 * time.Millisecond},
+			[]string{"GET", "k"}, okReply, 10 * time.Millisecond, true, 1.0, true},
+		{"fast dropped", rsniffer.SamplingConfig{Mode: rsniffer.SampleUniform, Rate: 0, KeepSlow: 10 * time.Millisecond},
+			[]string{"GET", "k"}, okReply, 9 * time.Millisecond, false, nil, false},
+		// waiting of blocking commands is not latency
+		{"blocking dropped", rsniffer.SamplingConfig{Mode: rsniffer.SampleUniform, Rate: 0, KeepSlow: 10 * time.Millisecond},
+			[]string{"BLPOP", "q", "0"}, okReply, time.Second, false, nil, false},
+		{"no reply dropped", rsniffer.SamplingConfig{Mode: rsniffer.SampleUniform, Rate: 0, KeepErrors: true, KeepSlow: time.Millisecond},
+			[]string{"SET", "k", "v"}, nil, 0, false, nil, false},
+		{"key kept", rsniffer.SamplingConfig{Mode: rsniffer.SampleKey, Rate: 0.5},
+			[]string{"GET", "k"}, okReply, time.Millisecond, rsniffer.HashSampled("k", 0.5), 0.5, false},
+		{"session kept", rsniffer.SamplingConfig{Mode: rsniffer.SampleSession, Rate: 0.5},
+			[]string{"GET", "k"}, okReply, time.Millisecond, rsniffer.HashSampled("s1", 0.5), 0.5, false},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg
+		cfg.Window = time.Second
+		s := NewSampler(&cfg)
+		hs := &HubSession{sid: "s1"}
+		cmd, _ := rsniffer.NewCommand(tt.args...)
+		reqRD := &rsniffer.RespData{Time: start}
+		var replyRD *rsniffer.RespData
+		if tt.reply != nil {
+			replyRD = &rsniffer.RespData{Msg: tt.reply, Time: start.Add(tt.latency)}
+		}
+		// decisions of key and session modes are stable
+		for i := 0; i < 3; i++ {
+			fields := map[string]interface{}{rsniffer.AnalyzeCmd: tt.args[0]}
+			if keep := s.Keep(hs, cmd, reqRD, replyRD, fields); keep != tt.keep {
+				t.Errorf("%s: Keep = %v, want %v", tt.name, keep, tt.keep)
+			}
+			if tt.keep && fields[rsniffer.AnalyzeSampleRate] != tt.rate {
+				t.Errorf("%s: sample rate %v, want %v", tt.name, fields[rsniffer.AnalyzeSampleRate], tt.rate)
+			}
+		}
+
+		kept, dropped := s.Counts()
+		wantKept, wantDropped := int64(0), int64(3)
+		if tt.keep {
+			wantKept, wantDropped = 3, 0
+		}
+		if kept != wantKept || dropped != wantDropped {
+			t.Errorf("%s: counts %d and %d, want %d and %d", tt.name, kept, dropped, wantKept, wantDropped)
+		}
+
+		var summary map[string]interface{}
+		s.Tick(s.windowStart.Add(time.Second), func(fields map[string]interface{}, err error) {
+			summary = fields
+		})
+		forced := int64(0)
+		if tt.forced {
+			forced = 3
+		}
+		if summary == nil || summary["kept"] != wantKept-forced || summary["forced"] != forced || summary["dropped"] != wantDropped {
+			t.Errorf("%s: summary %v", tt.name, summary)
+		}
+	}
+}
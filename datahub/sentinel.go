@@ -0,0 +1,265 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"net"
+	"sync"
+	"time"
+)
+
+// SentinelClientStat is the requests of a client to sentinel in a window
+type SentinelClientStat struct {
+	Resolves    map[string]int64 // get-master-addr-by-name by master name
+	Unknown     int64            // resolves of master unknown to sentinel
+	Discoveries map[string]int64 // SENTINEL sentinels and replicas by subcommand
+}
+
+// sentinelMaster is a master monitored by sentinel, as replied to clients
+type sentinelMaster struct {
+	addr      string
+	instances map[string]int // replicas and sentinels known to sentinel
+	down      map[string]int // replicas and sentinels considered down
+}
+
+// failover is the latest failover of a master, clients resolving the master
+// are expected to reconnect to the new master.
+type failover struct {
+	*rsniffer.SwitchMaster
+	resolved    map[string]bool // clients resolved the new master
+	reconnected map[string]bool // client hosts reconnected to the new master
+}
+
+// SentinelAnalyzer reports which clients resolve masters through sentinel and
+// how often, failovers notified by +switch-master, and how quickly clients
+// resolve and reconnect to the new master after a failover. Reconnections
+// are seen only if the new master is sniffed too.
+type SentinelAnalyzer struct {
+	cfg         *rsniffer.SentinelConfig
+	mu          sync.Mutex // guards window, stats, masters and failovers
+	windowStart time.Time
+	stats       map[string]*SentinelClientStat
+	hosts       map[string]map[string]bool // client hosts resolving each master
+	masters     map[string]*sentinelMaster // by master name
+	failovers   map[string]*failover       // by master name
+	newMasters  map[string]*failover       // by address of new master
+}
+
+func NewSentinelAnalyzer(cfg *rsniffer.SentinelConfig) *SentinelAnalyzer {
+	return &SentinelAnalyzer{
+		cfg:         cfg,
+		windowStart: time.Now(),
+		stats:       map[string]*SentinelClientStat{},
+		hosts:       map[string]map[string]bool{},
+		masters:     map[string]*sentinelMaster{},
+		failovers:   map[string]*failover{},
+		newMasters:  map[string]*failover{},
+	}
+}
+
+func (sa *SentinelAnalyzer) master(name string) *sentinelMaster {
+	sm, ok := sa.masters[name]
+	if !ok {
+		sm = &sentinelMaster{instances: map[string]int{}, down: map[string]int{}}
+		sa.masters[name] = sm
+	}
+	return sm
+}
+
+func (sa *SentinelAnalyzer) stat(client string) *SentinelClientStat {
+	ss, ok := sa.stats[client]
+	if !ok {
+		ss = &SentinelClientStat{
+			Resolves:    map[string]int64{},
+			Discoveries: map[string]int64{},
+		}
+		sa.stats[client] = ss
+	}
+	return ss
+}
+
+// clientHost returns host of client address, sessions of a client to
+// sentinel and to redis share the host only.
+func clientHost(client string) string {
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		return client
+	}
+	return host
+}
+
+func (sa *SentinelAnalyzer) Analyze(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	sa.mu.Lock()
+	events := sa.analyze(hs, cmd, reqRD, replyRD)
+	sa.mu.Unlock()
+	for _, fields := range events {
+		handler(fields, nil)
+	}
+}
+
+// analyze updates state with a paired command and returns events to emit
+func (sa *SentinelAnalyzer) analyze(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData) []map[string]interface{} {
+	events := make([]map[string]interface{}, 0)
+	if fields := sa.checkReconnect(hs, reqRD); fields != nil {
+		events = append(events, fields)
+	}
+	sub, master := rsniffer.SentinelSubcommand(cmd)
+	if sub == "" || replyRD.IsError() {
+		return events
+	}
+	switch sub {
+	case "get-master-addr-by-name":
+		ss := sa.stat(hs.Client())
+		addr := rsniffer.ParseMasterAddr(replyRD)
+		if addr == "" {
+			ss.Unknown++
+			return events
+		}
+		ss.Resolves[master]++
+		sa.master(master).addr = addr
+		hosts, ok := sa.hosts[master]
+		if !ok {
+			hosts = map[string]bool{}
+			sa.hosts[master] = hosts
+		}
+		hosts[clientHost(hs.Client())] = true
+		fo, ok := sa.failovers[master]
+		if !ok || fo.To != addr || fo.resolved[hs.Client()] {
+			return events
+		}
+		fo.resolved[hs.Client()] = true
+		events = append(events, map[string]interface{}{
+			rsniffer.AnalyzeEvent:    rsniffer.EventSentinel,
+			rsniffer.AnalyzeKind:     "resolve",
+			rsniffer.AnalyzeClient:   hs.Client(),
+			"master":                 master,
+			"addr":                   addr,
+			rsniffer.AnalyzeDuration: int64(replyRD.Time.Sub(fo.Time) / time.Microsecond),
+		})
+	case "sentinels", "replicas":
+		sa.stat(hs.Client()).Discoveries[sub]++
+		entries := rsniffer.ParseSentinelEntries(replyRD)
+		if entries == nil {
+			return events
+		}
+		sm := sa.master(master)
+		sm.instances[sub], sm.down[sub] = len(entries), 0
+		for _, entry := range entries {
+			if rsniffer.SentinelEntryDown(entry) {
+				sm.down[sub]++
+			}
+		}
+	}
+	return events
+}
+
+// checkReconnect returns the event of the first request of a client host to
+// the new master after failover, if the host resolved the master before.
+func (sa *SentinelAnalyzer) checkReconnect(hs *HubSession, reqRD *rsniffer.RespData) map[string]interface{} {
+	fo, ok := sa.newMasters[hs.Server()]
+	if !ok {
+		return nil
+	}
+	host := clientHost(hs.Client())
+	if !sa.hosts[fo.Master][host] || fo.reconnected[host] || reqRD.Time.Before(fo.Time) {
+		return nil
+	}
+	fo.reconnected[host] = true
+	return map[string]interface{}{
+		rsniffer.AnalyzeEvent:    rsniffer.EventSentinel,
+		rsniffer.AnalyzeKind:     "reconnect",
+		rsniffer.AnalyzeClient:   hs.Client(),
+		"master":                 fo.Master,
+		"addr":                   fo.To,
+		rsniffer.AnalyzeDuration: int64(reqRD.Time.Sub(fo.Time) / time.Microsecond),
+	}
+}
+
+func (sa *SentinelAnalyzer) AnalyzePush(hs *HubSession, push *rsniffer.PushMessage, handler AnalyzeResultHandler) {
+	sm := rsniffer.ParseSwitchMaster(push)
+	if sm == nil {
+		return
+	}
+	sa.mu.Lock()
+	if fo, ok := sa.failovers[sm.Master]; ok && fo.To == sm.To && fo.From == sm.From {
+		// every sentinel subscriber receives the same notification
+		sa.mu.Unlock()
+		return
+	}
+	if prev, ok := sa.failovers[sm.Master]; ok {
+		delete(sa.newMasters, prev.To)
+	}
+	fo := &failover{
+		SwitchMaster: sm,
+		resolved:     map[string]bool{},
+		reconnected:  map[string]bool{},
+	}
+	sa.failovers[sm.Master] = fo
+	sa.newMasters[sm.To] = fo
+	clients := len(sa.hosts[sm.Master])
+	sa.mu.Unlock()
+
+	handler(map[string]interface{}{
+		rsniffer.AnalyzeEvent: rsniffer.EventSentinel,
+		rsniffer.AnalyzeKind:  "switch_master",
+		"master":              sm.Master,
+		"from":                sm.From,
+		"to":                  sm.To,
+		"clients":             clients,
+	}, nil)
+}
+
+func (sa *SentinelAnalyzer) Tick(now time.Time, handler AnalyzeResultHandler) {
+	if sa.cfg.Window <= 0 {
+		return
+	}
+	sa.mu.Lock()
+	if now.Sub(sa.windowStart) < sa.cfg.Window {
+		sa.mu.Unlock()
+		return
+	}
+	elapsed := now.Sub(sa.windowStart)
+	events := make([]map[string]interface{}, 0, len(sa.stats)+len(sa.masters))
+	for client, ss := range sa.stats {
+		var resolves int64
+		for _, count := range ss.Resolves {
+			resolves += count
+		}
+		events = append(events, map[string]interface{}{
+			rsniffer.AnalyzeEvent:  rsniffer.EventSentinel,
+			rsniffer.AnalyzeKind:   "client",
+			rsniffer.AnalyzeClient: client,
+			rsniffer.AnalyzeWindow: elapsed.String(),
+			rsniffer.AnalyzeRate:   float64(resolves) / elapsed.Seconds(),
+			"resolves":             ss.Resolves,
+			"unknown":              ss.Unknown,
+			"discoveries":          ss.Discoveries,
+		})
+	}
+	for name, sm := range sa.masters {
+		// instances of masters are updated after the window
+		instances, down := make(map[string]int), make(map[string]int)
+		for sub, n := range sm.instances {
+			instances[sub] = n
+		}
+		for sub, n := range sm.down {
+			down[sub] = n
+		}
+		events = append(events, map[string]interface{}{
+			rsniffer.AnalyzeEvent:  rsniffer.EventSentinel,
+			rsniffer.AnalyzeKind:   "master",
+			rsniffer.AnalyzeWindow: elapsed.String(),
+			"master":               name,
+			"addr":                 sm.addr,
+			"instances":            instances,
+			"down":                 down,
+			"clients":              len(sa.hosts[name]),
+		})
+	}
+	sa.windowStart = now
+	sa.stats = map[string]*SentinelClientStat{}
+	sa.mu.Unlock()
+
+	for _, fields := range events {
+		handler(fields, nil)
+	}
+}
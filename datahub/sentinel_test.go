@@ -0,0 +1,96 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sentinelSession(t *testing.T, hub *BaseHub, id, client, server string, start time.Time) *testSession {
+	ts := newTestSession(t, hub, id)
+	ts.rs.ClientAddr, ts.rs.ServerAddr = client, server
+	ts.now = start
+	return ts
+}
+
+func masterAddrReply(host, port string) string {
+	return "*2\r\n$" + strconv.Itoa(len(host)) + "\r\n" + host + "\r\n$" + strconv.Itoa(len(port)) + "\r\n" + port + "\r\n"
+}
+
+func switchMasterPush(payload string) string {
+	return "*3\r\n$7\r\nmessage\r\n$14\r\n+switch-master\r\n$" + strconv.Itoa(len(payload)) + "\r\n" + payload + "\r\n"
+}
+
+func TestSentinelFailover(t *testing.T) {
+	sa := NewSentinelAnalyzer(&rsniffer.SentinelConfig{Window: time.Second})
+	hub := NewBaseHub(rsniffer.DefaultSniffConfig())
+	hub.AddAnalyzer(sa)
+	start := time.Unix(1500000000, 0)
+	events := make([]map[string]interface{}, 0)
+	collect := func(fields map[string]interface{}, err error) {
+		if fields[rsniffer.AnalyzeEvent] == rsniffer.EventSentinel {
+			events = append(events, fields)
+		}
+	}
+
+	client := sentinelSession(t, hub, "c1", "10.0.0.1:5000", "10.0.0.9:26379", start)
+	client.send(masterAddrReply("10.0.0.2", "6379"), "SENTINEL", "get-master-addr-by-name", "mymaster")
+	client.send("*-1\r\n", "SENTINEL", "get-master-addr-by-name", "other")
+
+	// every sentinel notifies its subscribers of the failover
+	for _, id := range []string{"sub1", "sub2"} {
+		sub := sentinelSession(t, hub, id, "10.0.0.5:4000", "10.0.0.9:26379", start.Add(time.Second))
+		sub.receive(switchMasterPush("mymaster 10.0.0.2 6379 10.0.0.3 6379"))
+		events = append(events, sub.events(rsniffer.EventSentinel)...)
+	}
+
+	client.now = start.Add(3 * time.Second)
+	client.send(masterAddrReply("10.0.0.3", "6379"), "SENTINEL", "get-master-addr-by-name", "mymaster")
+	client.send(masterAddrReply("10.0.0.3", "6379"), "SENTINEL", "get-master-addr-by-name", "mymaster")
+	events = append(events, client.events(rsniffer.EventSentinel)...)
+
+	// hosts which never resolved the master are not counted as reconnected
+	for _, c := range []struct{ id, client string }{
+		{"r1", "10.0.0.1:5001"},
+		{"r2", "10.0.0.1:5002"},
+		{"r3", "10.0.0.7:5000"},
+	} {
+		ts := sentinelSession(t, hub, c.id, c.client, "10.0.0.3:6379", start.Add(5*time.Second))
+		ts.send("+OK\r\n", "SET", "k", "v")
+		events = append(events, ts.events(rsniffer.EventSentinel)...)
+	}
+	hub.Tick(time.Now().Add(2*time.Second), collect)
+
+	want := []struct {
+		kind     string
+		client   interface{}
+		duration interface{}
+	}{
+		{"switch_master", nil, nil},
+		// durations since the push received at 1.001s
+		{"resolve", "10.0.0.1:5000", int64(2000000)},
+		{"reconnect", "10.0.0.1:5001", int64(3999000)},
+		{"client", "10.0.0.1:5000", nil},
+		{"master", nil, nil},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("%d sentinel events, want %d: %v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		ev := events[i]
+		if ev[rsniffer.AnalyzeKind] != w.kind || ev[rsniffer.AnalyzeClient] != w.client || ev[rsniffer.AnalyzeDuration] != w.duration {
+			t.Errorf("event %d: %v, want %s of %v in %v", i, ev, w.kind, w.client, w.duration)
+		}
+	}
+	if sw := events[0]; sw["from"] != "10.0.0.2:6379" || sw["to"] != "10.0.0.3:6379" || sw["clients"] != 1 {
+		t.Errorf("switch master %v", sw)
+	}
+	if cl := events[3]; !reflect.DeepEqual(cl["resolves"], map[string]int64{"mymaster": 3}) || cl["unknown"] != int64(1) {
+		t.Errorf("client summary %v", cl)
+	}
+	if m := events[4]; m["master"] != "mymaster" || m["addr"] != "10.0.0.3:6379" || m["clients"] != 1 {
+		t.Errorf("master summary %v", m)
+	}
+}
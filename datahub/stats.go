@@ -0,0 +1,101 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"time"
+)
+
+// HubStats is a snapshot of hub statistics
+type HubStats struct {
+	Sessions         int   // hub sessions being analyzed
+	DecodeErrors     int64 // errors decoding buffered data of sessions
+	Desyncs          int64 // undecodable data dropped, see rsniffer.SessionDesync
+	UnpairedRequests int64 // requests dropped without reply, by session end, overflow or desync
+	UnpairedReplies  int64 // replies without request, e.g. sniffer starts in the middle of a session
+	SniffErrors      int64
+	SampledOut       int64
+}
+
+// Stats returns statistics of the hub, it is safe to call while sessions
+// are analyzed.
+func (hub *BaseHub) Stats() HubStats {
+	hub.mu.Lock()
+	stats := HubStats{
+		Sessions:         len(hub.sessions),
+		DecodeErrors:     hub.decodeErrors,
+		Desyncs:          hub.sessionEvents[rsniffer.SessionDesync],
+		UnpairedRequests: hub.unpairedReqs,
+		UnpairedReplies:  hub.unpairedReps,
+		SniffErrors:      hub.sniffErrors,
+	}
+	hub.mu.Unlock()
+	if hub.sampler != nil {
+		_, stats.SampledOut = hub.sampler.Counts()
+	}
+	return stats
+}
+
+// StatsReporter reports statistics of sniffer, hub and pipeline as a stats
+// event in interval, so that data loss of sniffer could be told.
+type StatsReporter struct {
+	interval time.Duration
+	last     time.Time
+	sniffer  *rsniffer.Sniffer
+	hub      *BaseHub
+	pipeline *Pipeline // nil if analyzed on the capture loop
+}
+
+func NewStatsReporter(interval time.Duration, sniffer *rsniffer.Sniffer, hub *BaseHub, pipeline *Pipeline) *StatsReporter {
+	return &StatsReporter{
+		interval: interval,
+		last:     time.Now(),
+		sniffer:  sniffer,
+		hub:      hub,
+		pipeline: pipeline,
+	}
+}
+
+// Fields returns the current statistics as result fields
+func (sr *StatsReporter) Fields() map[string]interface{} {
+	cs := sr.sniffer.Stats()
+	hs := sr.hub.Stats()
+	fields := map[string]interface{}{
+		rsniffer.AnalyzeEvent: rsniffer.EventStats,
+		"kernel_received":     cs.Received,
+		"kernel_dropped":      cs.Dropped,
+		"if_dropped":          cs.IfDropped,
+		"packets":             cs.Packets,
+		"bytes":               cs.Bytes,
+		"capture_backlog":     cs.Backlog,
+		"sessions_active":     cs.SessionsActive,
+		"sessions_opened":     cs.SessionsOpened,
+		"sessions_evicted":    cs.SessionsEvicted,
+		"overflows":           cs.Overflows,
+		"hub_sessions":        hs.Sessions,
+		"decode_errors":       hs.DecodeErrors,
+		"desyncs":             hs.Desyncs,
+		"unpaired_requests":   hs.UnpairedRequests,
+		"unpaired_replies":    hs.UnpairedReplies,
+		"sniff_errors":        hs.SniffErrors,
+		"sampled_out":         hs.SampledOut,
+	}
+	if sr.pipeline != nil {
+		ps := sr.pipeline.Stats()
+		fields["worker_backlog"] = sr.pipeline.Backlog()
+		fields["worker_queued"] = ps.Queued
+		fields["worker_coalesced"] = ps.Coalesced
+		fields["worker_dropped"] = ps.Dropped
+		fields["worker_stalls"] = ps.Stalls
+		fields["worker_stalled"] = ps.Stalled.String()
+	}
+	return fields
+}
+
+// Tick reports statistics if interval elapses
+func (sr *StatsReporter) Tick(now time.Time, handler AnalyzeResultHandler) {
+	if sr.interval <= 0 || now.Sub(sr.last) < sr.interval {
+		return
+	}
+	sr.last = now
+	handler(sr.Fields(), nil)
+}
@@ -0,0 +1,252 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type trackingClient struct {
+	sid      string
+	client   string
+	id       int64 // replied by CLIENT ID, 0 if unknown
+	tracking *rsniffer.Tracking
+}
+
+// redirect returns the client id invalidations are redirected to, 0 if not
+func (tc *trackingClient) redirect() int64 {
+	if tc.tracking == nil || !tc.tracking.On {
+		return 0
+	}
+	return tc.tracking.Redirect
+}
+
+// InvalidationStat is the invalidations received by a client, or of keys of
+// a pattern
+type InvalidationStat struct {
+	Messages int64 // invalidation messages
+	Keys     int64 // invalidated keys
+	Flushes  int64 // invalidations of all keys, e.g. by FLUSHALL
+	mode     string
+}
+
+// TrackingAnalyzer reports CLIENT TRACKING of clients, and aggregates
+// invalidations received by each client and of each key pattern in a window.
+// Invalidations to RESP2 redirect connections are attributed to the
+// connection receiving them, together with clients redirecting to it. State
+// of a client is released when its session ends.
+type TrackingAnalyzer struct {
+	cfg         *rsniffer.TrackingConfig
+	mu          sync.Mutex // guards clients, their indexes and stats
+	windowStart time.Time
+	clients     map[string]*trackingClient           // by hub session id
+	byClient    map[string]*trackingClient           // by client address
+	redirects   map[int64]map[string]*trackingClient // redirecting clients by client id redirected to
+	clientStats map[string]*InvalidationStat
+	patterns    map[string]*InvalidationStat
+}
+
+func NewTrackingAnalyzer(cfg *rsniffer.TrackingConfig) *TrackingAnalyzer {
+	return &TrackingAnalyzer{
+		cfg:         cfg,
+		windowStart: time.Now(),
+		clients:     map[string]*trackingClient{},
+		byClient:    map[string]*trackingClient{},
+		redirects:   map[int64]map[string]*trackingClient{},
+		clientStats: map[string]*InvalidationStat{},
+		patterns:    map[string]*InvalidationStat{},
+	}
+}
+
+func (ta *TrackingAnalyzer) client(hs *HubSession) *trackingClient {
+	tc, ok := ta.clients[hs.ID()]
+	if !ok {
+		tc = &trackingClient{sid: hs.ID(), client: hs.Client()}
+		ta.clients[hs.ID()] = tc
+		ta.byClient[tc.client] = tc
+	}
+	return tc
+}
+
+// setTracking updates tracking of client and the index of redirects
+func (ta *TrackingAnalyzer) setTracking(tc *trackingClient, t *rsniffer.Tracking) {
+	ta.unindexRedirect(tc)
+	tc.tracking = t
+	if id := tc.redirect(); id != 0 {
+		from, ok := ta.redirects[id]
+		if !ok {
+			from = map[string]*trackingClient{}
+			ta.redirects[id] = from
+		}
+		from[tc.sid] = tc
+	}
+}
+
+func (ta *TrackingAnalyzer) unindexRedirect(tc *trackingClient) {
+	id := tc.redirect()
+	if from, ok := ta.redirects[id]; ok {
+		delete(from, tc.sid)
+		if len(from) == 0 {
+			delete(ta.redirects, id)
+		}
+	}
+}
+
+// SessionEnd releases the client of the session
+func (ta *TrackingAnalyzer) SessionEnd(hs *HubSession, handler AnalyzeResultHandler) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	tc, ok := ta.clients[hs.ID()]
+	if !ok {
+		return
+	}
+	ta.unindexRedirect(tc)
+	delete(ta.clients, hs.ID())
+	if ta.byClient[tc.client] == tc {
+		delete(ta.byClient, tc.client)
+	}
+}
+
+func invalidationStat(stats map[string]*InvalidationStat, name string) *InvalidationStat {
+	is, ok := stats[name]
+	if !ok {
+		is = &InvalidationStat{}
+		stats[name] = is
+	}
+	return is
+}
+
+func (ta *TrackingAnalyzer) Analyze(hs *HubSession, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	if strings.ToUpper(cmd.Name()) != "CLIENT" || len(cmd.Args) < 2 || replyRD.IsError() {
+		return
+	}
+	switch strings.ToUpper(cmd.Args[1]) {
+	case "ID":
+		if replyRD.IsInteger() {
+			ta.mu.Lock()
+			ta.client(hs).id = replyRD.Msg.Integer
+			ta.mu.Unlock()
+		}
+	case "TRACKING":
+		t := rsniffer.ParseClientTracking(cmd)
+		if t == nil {
+			return
+		}
+		ta.mu.Lock()
+		ta.setTracking(ta.client(hs), t)
+		ta.mu.Unlock()
+		fields := map[string]interface{}{
+			rsniffer.AnalyzeEvent:   rsniffer.EventTracking,
+			rsniffer.AnalyzeSession: hs.ID(),
+			rsniffer.AnalyzeClient:  hs.Client(),
+			"mode":                  t.Mode(),
+		}
+		if t.Redirect != 0 {
+			fields["redirect"] = t.Redirect
+		}
+		if len(t.Prefixes) > 0 {
+			fields["prefixes"] = t.Prefixes
+		}
+		handler(fields, nil)
+	}
+}
+
+func (ta *TrackingAnalyzer) AnalyzePush(hs *HubSession, push *rsniffer.PushMessage, handler AnalyzeResultHandler) {
+	if !push.IsInvalidation() {
+		return
+	}
+	keys, flush := push.InvalidatedKeys()
+	patterns := make([]string, len(keys))
+	for i, key := range keys {
+		patterns[i] = rsniffer.PatternOther
+		if ta.cfg.Matcher != nil {
+			patterns[i] = ta.cfg.Matcher.Match(key)
+		}
+	}
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	cs := invalidationStat(ta.clientStats, hs.Client())
+	// mode is kept in case the session ends before the window
+	cs.mode = ta.mode(hs.Client())
+	cs.Messages++
+	cs.Keys += int64(len(keys))
+	if flush {
+		cs.Flushes++
+	}
+	for _, pattern := range patterns {
+		invalidationStat(ta.patterns, pattern).Keys++
+	}
+}
+
+// redirectFrom returns the tracking clients redirecting invalidations to the
+// client with id
+func (ta *TrackingAnalyzer) redirectFrom(client string) []string {
+	from := make([]string, 0)
+	tc, ok := ta.byClient[client]
+	if !ok || tc.id == 0 {
+		return from
+	}
+	for _, rc := range ta.redirects[tc.id] {
+		from = append(from, rc.client)
+	}
+	sort.Strings(from)
+	return from
+}
+
+func (ta *TrackingAnalyzer) mode(client string) string {
+	if tc, ok := ta.byClient[client]; ok && tc.tracking != nil {
+		return tc.tracking.Mode()
+	}
+	return "redirect"
+}
+
+func (ta *TrackingAnalyzer) Tick(now time.Time, handler AnalyzeResultHandler) {
+	if ta.cfg.Window <= 0 {
+		return
+	}
+	ta.mu.Lock()
+	if now.Sub(ta.windowStart) < ta.cfg.Window {
+		ta.mu.Unlock()
+		return
+	}
+	elapsed := now.Sub(ta.windowStart)
+	clientStats, patterns := ta.clientStats, ta.patterns
+	redirectFrom := make(map[string][]string, len(clientStats))
+	for client := range clientStats {
+		redirectFrom[client] = ta.redirectFrom(client)
+	}
+	ta.windowStart = now
+	ta.clientStats = map[string]*InvalidationStat{}
+	ta.patterns = map[string]*InvalidationStat{}
+	ta.mu.Unlock()
+
+	for client, cs := range clientStats {
+		rate := float64(cs.Keys) / elapsed.Seconds()
+		handler(map[string]interface{}{
+			rsniffer.AnalyzeEvent:  rsniffer.EventInval,
+			rsniffer.AnalyzeKind:   "client",
+			rsniffer.AnalyzeClient: client,
+			rsniffer.AnalyzeWindow: elapsed.String(),
+			rsniffer.AnalyzeRate:   rate,
+			"mode":                 cs.mode,
+			"redirect_from":        redirectFrom[client],
+			"messages":             cs.Messages,
+			"keys":                 cs.Keys,
+			"flushes":              cs.Flushes,
+			"storm":                ta.cfg.StormRate > 0 && rate >= ta.cfg.StormRate,
+		}, nil)
+	}
+	for pattern, ps := range patterns {
+		handler(map[string]interface{}{
+			rsniffer.AnalyzeEvent:   rsniffer.EventInval,
+			rsniffer.AnalyzeKind:    "pattern",
+			rsniffer.AnalyzePattern: pattern,
+			rsniffer.AnalyzeWindow:  elapsed.String(),
+			rsniffer.AnalyzeRate:    float64(ps.Keys) / elapsed.Seconds(),
+			"keys":                  ps.Keys,
+		}, nil)
+	}
+}
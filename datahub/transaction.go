@@ -0,0 +1,133 @@
+package datahub
+
+import (
+	"fmt"
+	"github.com/amyangfei/redsnif/rsniffer"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resetTransaction leaves transaction without reporting it
+func (hs *HubSession) resetTransaction() {
+	hs.flags &= ^RedisMulti
+	hs.multiQueuedReq = make([]*rsniffer.RespData, 0)
+	hs.multiErrors = 0
+	hs.multiStart = time.Time{}
+}
+
+// analyzeTransaction tracks WATCH, MULTI, EXEC, DISCARD and commands queued
+// in transaction, it returns true if the pair is consumed, otherwise the pair
+// should be analyzed as a normal command.
+func (hub *BaseHub) analyzeTransaction(hs *HubSession, cmdName string, cmd *rsniffer.Command, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) bool {
+	inMulti := hs.flags&RedisMulti > 0
+	switch cmdName {
+	case "WATCH":
+		// WATCH inside MULTI is rejected and doesn't abort the transaction
+		if replyRD.IsString() {
+			for _, key := range cmd.Keys() {
+				hs.watched[key] = true
+			}
+		}
+		return false
+	case "UNWATCH":
+		if replyRD.IsString() {
+			hs.watched = map[string]bool{}
+		}
+		return false
+	case "MULTI":
+		// nested MULTI is rejected and doesn't abort the transaction
+		if inMulti || !replyRD.IsString() {
+			return false
+		}
+		hs.resetTransaction()
+		hs.flags |= RedisMulti
+		hs.multiStart = reqRD.Time
+		return true
+	case "DISCARD":
+		if !inMulti || !replyRD.IsString() {
+			return false
+		}
+		hub.endTransaction(hs, rsniffer.TxDiscarded, replyRD, handler)
+		return true
+	case "EXEC":
+		if !inMulti {
+			// EXEC without MULTI
+			return false
+		}
+		hub.execTransaction(hs, reqRD, replyRD, handler)
+		return true
+	}
+	if !inMulti {
+		return false
+	}
+	if replyRD.IsString() && replyRD.Msg.Status == "QUEUED" {
+		hs.multiQueuedReq = append(hs.multiQueuedReq, reqRD)
+		return true
+	}
+	if replyRD.IsError() {
+		// the rejected command is reported as normal, EXEC will fail with EXECABORT
+		hs.multiErrors++
+		return false
+	}
+	handler(nil, fmt.Errorf("unexpected reply of %s queued in transaction", cmdName))
+	return true
+}
+
+// execTransaction analyzes commands executed by EXEC and reports the
+// transaction with its outcome.
+func (hub *BaseHub) execTransaction(hs *HubSession, reqRD, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	queued := hs.multiQueuedReq
+	switch {
+	case replyRD.IsError():
+		hub.analyzePair(hs, reqRD, replyRD, handler)
+		outcome := rsniffer.TxFailed
+		if replyRD.Msg.Error != nil && strings.HasPrefix(replyRD.Msg.Error.Error(), "EXECABORT") {
+			outcome = rsniffer.TxExecAborted
+		}
+		hub.endTransaction(hs, outcome, replyRD, handler)
+	case replyRD.IsArray() && replyRD.Msg.Array == nil:
+		// null reply, a watched key is modified, even if nothing is queued
+		hub.endTransaction(hs, rsniffer.TxWatchAborted, replyRD, handler)
+	case replyRD.IsArray() && len(replyRD.Msg.Array) == len(queued):
+		for j := 0; j < len(queued); j++ {
+			tReply := &rsniffer.RespData{Msg: replyRD.Msg.Array[j]}
+			hub.analyzePair(hs, queued[j], tReply, handler)
+		}
+		hub.endTransaction(hs, rsniffer.TxExecuted, replyRD, handler)
+	default:
+		handler(nil, fmt.Errorf("multi result count doesn't match queued requests"))
+		hub.endTransaction(hs, rsniffer.TxFailed, replyRD, handler)
+	}
+}
+
+// endTransaction reports the transaction, EXEC and DISCARD also unwatch all
+// keys.
+func (hub *BaseHub) endTransaction(hs *HubSession, outcome string, replyRD *rsniffer.RespData, handler AnalyzeResultHandler) {
+	cmds := make([]string, 0, len(hs.multiQueuedReq))
+	for _, rd := range hs.multiQueuedReq {
+		if cmd, err := rd.GetCommand(); err == nil {
+			cmds = append(cmds, strings.ToUpper(cmd.Name()))
+		}
+	}
+	watched := make([]string, 0, len(hs.watched))
+	for key := range hs.watched {
+		watched = append(watched, key)
+	}
+	sort.Strings(watched)
+	fields := map[string]interface{}{
+		rsniffer.AnalyzeEvent:   rsniffer.EventTx,
+		rsniffer.AnalyzeSession: hs.ID(),
+		rsniffer.AnalyzeClient:  hs.Client(),
+		rsniffer.AnalyzeOutcome: outcome,
+		"commands":              cmds,
+		"queue_errors":          hs.multiErrors,
+		"watched":               watched,
+	}
+	if !hs.multiStart.IsZero() && !replyRD.Time.IsZero() {
+		fields[rsniffer.AnalyzeDuration] = int64(replyRD.Time.Sub(hs.multiStart) / time.Microsecond)
+	}
+	handler(fields, nil)
+	hs.resetTransaction()
+	hs.watched = map[string]bool{}
+}
@@ -0,0 +1,116 @@
+package datahub
+
+import (
+	"github.com/amyangfei/redsnif/rsniffer"
+	"reflect"
+	"testing"
+)
+
+// txStep is a command and its raw reply
+type txStep struct {
+	reply string
+	args  []string
+}
+
+func TestTransactionOutcome(t *testing.T) {
+	tests := []struct {
+		name     string
+		steps    []txStep
+		outcome  string
+		commands []string
+		watched  []string
+		qErrors  int
+	}{
+		{"executed", []txStep{
+			{"+OK\r\n", []string{"WATCH", "k1", "k2"}},
+			{"+OK\r\n", []string{"MULTI"}},
+			{"+QUEUED\r\n", []string{"GET", "k1"}},
+			{"+QUEUED\r\n", []string{"SET", "k2", "v"}},
+			{"*2\r\n$1\r\nx\r\n+OK\r\n", []string{"EXEC"}},
+		}, rsniffer.TxExecuted, []string{"GET", "SET"}, []string{"k1", "k2"}, 0},
+		{"empty executed", []txStep{
+			{"+OK\r\n", []string{"MULTI"}},
+			{"*0\r\n", []string{"EXEC"}},
+		}, rsniffer.TxExecuted, []string{}, []string{}, 0},
+		{"watch aborted", []txStep{
+			{"+OK\r\n", []string{"WATCH", "k1"}},
+			{"+OK\r\n", []string{"MULTI"}},
+			{"+QUEUED\r\n", []string{"INCR", "k1"}},
+			{"*-1\r\n", []string{"EXEC"}},
+		}, rsniffer.TxWatchAborted, []string{"INCR"}, []string{"k1"}, 0},
+		{"empty watch aborted", []txStep{
+			{"+OK\r\n", []string{"WATCH", "k1"}},
+			{"+OK\r\n", []string{"MULTI"}},
+			{"*-1\r\n", []string{"EXEC"}},
+		}, rsniffer.TxWatchAborted, []string{}, []string{"k1"}, 0},
+		{"exec aborted", []txStep{
+			{"+OK\r\n", []string{"MULTI"}},
+			{"+QUEUED\r\n", []string{"SET", "k", "v"}},
+			{"-ERR wrong number of arguments for 'get' command\r\n", []string{"GET"}},
+			{"-EXECABORT Transaction discarded because of previous errors.\r\n", []string{"EXEC"}},
+		}, rsniffer.TxExecAborted, []string{"SET"}, []string{}, 1},
+		{"discarded", []txStep{
+			{"+OK\r\n", []string{"WATCH", "k"}},
+			{"+OK\r\n", []string{"MULTI"}},
+			{"+QUEUED\r\n", []string{"GET", "k"}},
+			{"+OK\r\n", []string{"DISCARD"}},
+		}, rsniffer.TxDiscarded, []string{"GET"}, []string{"k"}, 0},
+		{"failed", []txStep{
+			{"+OK\r\n", []string{"MULTI"}},
+			{"+QUEUED\r\n", []string{"GET", "k"}},
+			{"-ERR EXEC without MULTI\r\n", []string{"EXEC"}},
+		}, rsniffer.TxFailed, []string{"GET"}, []string{}, 0},
+		{"mismatched results", []txStep{
+			{"+OK\r\n", []string{"MULTI"}},
+			{"+QUEUED\r\n", []string{"GET", "k"}},
+			{"*0\r\n", []string{"EXEC"}},
+		}, rsniffer.TxFailed, []string{"GET"}, []string{}, 0},
+	}
+	for _, tt := range tests {
+		ts := newTestSession(t, NewBaseHub(rsniffer.DefaultSniffConfig()), "s1")
+		for _, step := range tt.steps {
+			ts.send(step.reply, step.args...)
+		}
+		txs := ts.events(rsniffer.EventTx)
+		if len(txs) != 1 {
+			t.Errorf("%s: %d transactions, want 1", tt.name, len(txs))
+			continue
+		}
+		tx := txs[0]
+		if tx[rsniffer.AnalyzeOutcome] != tt.outcome || !reflect.DeepEqual(tx["commands"], tt.commands) ||
+			!reflect.DeepEqual(tx["watched"], tt.watched) || tx["queue_errors"] != tt.qErrors {
+			t.Errorf("%s: transaction %v", tt.name, tx)
+		}
+		if tx[rsniffer.AnalyzeDuration] == nil {
+			t.Errorf("%s: transaction has no duration", tt.name)
+		}
+		// the session leaves transaction and unwatches all keys
+		hs := ts.hub.sessions["s1"]
+		if hs.flags&RedisMulti > 0 || len(hs.multiQueuedReq) > 0 || len(hs.watched) > 0 {
+			t.Errorf("%s: session is left in transaction", tt.name)
+		}
+	}
+}
+
+func TestTransactionQueuedCommands(t *testing.T) {
+	cfg := rsniffer.DefaultSniffConfig()
+	cfg.AzConfig.SaveCmdTypes = []int{rsniffer.RedisCmdRead, rsniffer.RedisCmdWrite}
+	ts := newTestSession(t, NewBaseHub(cfg), "s1")
+	ts.send("+OK\r\n", "MULTI")
+	ts.send("+QUEUED\r\n", "SET", "k", "v")
+	ts.send("+QUEUED\r\n", "GET", "k")
+	if len(ts.results) != 0 {
+		t.Fatalf("queued commands are reported before EXEC: %v", ts.results)
+	}
+	ts.send("*2\r\n+OK\r\n$1\r\nv\r\n", "EXEC")
+	// queued commands are paired with their results in EXEC reply
+	cmds := make([]interface{}, 0)
+	for _, fields := range ts.results {
+		if fields[rsniffer.AnalyzeEvent] == nil {
+			cmds = append(cmds, fields[rsniffer.AnalyzeCmd])
+		}
+	}
+	if !reflect.DeepEqual(cmds, []interface{}{"SET", "GET"}) {
+		t.Errorf("commands reported %v, want SET and GET", cmds)
+	}
+}
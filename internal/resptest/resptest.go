@@ -0,0 +1,130 @@
+// Package resptest provides a fake redis server speaking RESP for tests of
+// code connecting to redis, such as the proxy and the replayer.
+package resptest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Server is a RESP server listening on a local TCP port, it keeps commands
+// received on each connection and the raw bytes of all of them. Connection
+// is closed after replying QUIT.
+type Server struct {
+	l     net.Listener
+	reply func(args []string) string
+	mu    sync.Mutex
+	conns [][][]string // commands of each connection in accepted order
+	raw   bytes.Buffer
+}
+
+// NewServer starts a server, reply returns the raw reply of a command, or an
+// empty string to reply nothing. +OK is replied to every command if reply is
+// nil.
+func NewServer(t *testing.T, reply func(args []string) string) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply == nil {
+		reply = func([]string) string { return "+OK\r\n" }
+	}
+	s := &Server{l: l, reply: reply}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, nil)
+			idx := len(s.conns) - 1
+			s.mu.Unlock()
+			go s.serve(conn, idx)
+		}
+	}()
+	return s
+}
+
+// Addr returns the listening address, such as 127.0.0.1:6379
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Close stops accepting connections, accepted ones are served until clients
+// close them
+func (s *Server) Close() {
+	s.l.Close()
+}
+
+func (s *Server) serve(conn net.Conn, idx int) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, raw, err := ReadCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[idx] = append(s.conns[idx], args)
+		s.raw.Write(raw)
+		s.mu.Unlock()
+		if reply := s.reply(args); reply != "" {
+			conn.Write([]byte(reply))
+		}
+		if strings.ToUpper(args[0]) == "QUIT" {
+			return
+		}
+	}
+}
+
+// Commands returns commands received on each connection
+func (s *Server) Commands() [][][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([][][]string, len(s.conns))
+	for i, cmds := range s.conns {
+		conns[i] = append([][]string(nil), cmds...)
+	}
+	return conns
+}
+
+// Bytes returns raw bytes of all commands received
+func (s *Server) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.raw.Bytes()...)
+}
+
+// ReadCommand reads a RESP array of bulk strings, raw is the bytes read
+func ReadCommand(r *bufio.Reader) (args []string, raw []byte, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	raw = []byte(line)
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i < n; i++ {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, nil, err
+		}
+		raw = append(append(raw, header...), data...)
+		args = append(args, string(data[:size]))
+	}
+	return args, raw, nil
+}
@@ -0,0 +1,151 @@
+package rsniffer
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlockingConfig enables per queue wait statistics of blocking commands
+type BlockingConfig struct {
+	Window time.Duration // window of per queue summaries
+}
+
+// RedisBlockingCmds are commands which may block the connection until served
+// or timed out, XREAD and XREADGROUP block only with BLOCK option.
+var RedisBlockingCmds = map[string]bool{
+	"BLPOP":      true,
+	"BRPOP":      true,
+	"BRPOPLPUSH": true,
+	"BLMOVE":     true,
+	"BLMPOP":     true,
+	"BZPOPMIN":   true,
+	"BZPOPMAX":   true,
+	"BZMPOP":     true,
+	"XREAD":      true,
+	"XREADGROUP": true,
+	"WAIT":       true,
+	"WAITAOF":    true,
+}
+
+// IsBlocking reports whether the command may block the connection
+func (c *Command) IsBlocking() bool {
+	name := strings.ToUpper(c.Name())
+	if !RedisBlockingCmds[name] {
+		return false
+	}
+	if name == "XREAD" || name == "XREADGROUP" {
+		for _, arg := range c.Args[1:] {
+			switch strings.ToUpper(arg) {
+			case "BLOCK":
+				return true
+			case "STREAMS":
+				return false
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ServiceLatency returns latency of a command, -1 for blocking commands whose
+// latency is mostly the time waiting for data, see BlockingWait.
+func ServiceLatency(cmd *Command, request, reply *RespData) time.Duration {
+	if cmd.IsBlocking() {
+		return -1
+	}
+	return reply.Latency(request)
+}
+
+// BlockingWait returns how long a blocking command waits until served or
+// timed out, -1 for commands which are not blocking.
+func BlockingWait(cmd *Command, request, reply *RespData) time.Duration {
+	if !cmd.IsBlocking() {
+		return -1
+	}
+	return reply.Latency(request)
+}
+
+// BlockingTimeout reports whether a blocking command is timed out instead of
+// served, it is true for a nil reply, or WAIT acknowledged by less replicas
+// than requested.
+func BlockingTimeout(cmd *Command, reply *RespData) bool {
+	switch strings.ToUpper(cmd.Name()) {
+	case "WAIT":
+		// WAIT numreplicas timeout
+		if len(cmd.Args) < 2 || !reply.IsInteger() {
+			return false
+		}
+		expect, err := strconv.ParseInt(cmd.Args[1], 10, 64)
+		return err == nil && reply.Msg.Integer < expect
+	case "WAITAOF":
+		// WAITAOF numlocal numreplicas timeout
+		if len(cmd.Args) < 3 || !reply.IsArray() || len(reply.Msg.Array) != 2 {
+			return false
+		}
+		for idx, arg := range cmd.Args[1:3] {
+			expect, err := strconv.ParseInt(arg, 10, 64)
+			if err == nil && reply.Msg.Array[idx].Integer < expect {
+				return true
+			}
+		}
+		return false
+	}
+	return (reply.IsArray() && reply.Msg.Array == nil) || (reply.IsBulk() && reply.Msg.Bytes == nil)
+}
+
+// BlockingServedKeys returns the keys served to a blocking command, e.g. the
+// list popped by BLPOP, nil if timed out.
+func BlockingServedKeys(cmd *Command, reply *RespData) []string {
+	if BlockingTimeout(cmd, reply) || reply.IsError() {
+		return nil
+	}
+	switch strings.ToUpper(cmd.Name()) {
+	case "BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX", "BLMPOP", "BZMPOP":
+		// reply starts with the served key
+		if reply.IsArray() && len(reply.Msg.Array) > 0 {
+			return []string{string(reply.Msg.Array[0].Bytes)}
+		}
+	case "BRPOPLPUSH", "BLMOVE":
+		// the source list
+		if keys := cmd.Keys(); len(keys) > 0 {
+			return keys[:1]
+		}
+	case "XREAD", "XREADGROUP":
+		// array of [stream, entries]
+		if !reply.IsArray() {
+			return nil
+		}
+		keys := make([]string, 0, len(reply.Msg.Array))
+		for _, elem := range reply.Msg.Array {
+			if len(elem.Array) > 0 {
+				keys = append(keys, string(elem.Array[0].Bytes))
+			}
+		}
+		return keys
+	}
+	return nil
+}
+
+// keys of BLMPOP and BZMPOP: timeout numkeys key [key ...]
+func numKeysAfterTimeout(args []string) []string {
+	if len(args) < 3 {
+		return nil
+	}
+	n, err := strconv.Atoi(args[2])
+	if err != nil || n <= 0 || 3+n > len(args) {
+		return nil
+	}
+	return args[3 : 3+n]
+}
+
+// keys of XREAD and XREADGROUP: ... STREAMS key [key ...] id [id ...]
+func streamsKeys(args []string) []string {
+	for i, arg := range args {
+		if strings.ToUpper(arg) == "STREAMS" {
+			streams := args[i+1:]
+			return streams[:len(streams)/2]
+		}
+	}
+	return nil
+}
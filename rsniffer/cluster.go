@@ -0,0 +1,134 @@
+package rsniffer
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClusterSlots is the number of hash slots of redis cluster
+const ClusterSlots = 16384
+
+// kinds of redis cluster errors
+const (
+	ClusterMoved     = "moved"       // the slot is served by another node
+	ClusterAsk       = "ask"         // the slot is migrating, ask another node once
+	ClusterCrossSlot = "crossslot"   // keys of the command hash to different slots
+	ClusterTryAgain  = "tryagain"    // keys of the command are being migrated
+	ClusterDown      = "clusterdown" // the cluster is down or the slot is not served
+)
+
+var clusterErrPrefixes = map[string]string{
+	"MOVED":       ClusterMoved,
+	"ASK":         ClusterAsk,
+	"CROSSSLOT":   ClusterCrossSlot,
+	"TRYAGAIN":    ClusterTryAgain,
+	"CLUSTERDOWN": ClusterDown,
+}
+
+// ClusterConfig enables redis cluster analytics
+type ClusterConfig struct {
+	Window time.Duration // window of per slot, per node and per client summaries
+}
+
+// crc16 of redis cluster, CRC16-CCITT (XMODEM)
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of key, only the hashtag is hashed if the key
+// has a non-empty one, such as "{user1000}.following".
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % ClusterSlots
+}
+
+// CommandSlots returns distinct hash slots of keys of the command in order,
+// a command with more than one slot is rejected by redis cluster.
+func CommandSlots(cmd *Command) []int {
+	slots := make([]int, 0, 1)
+	seen := map[int]bool{}
+	for _, key := range cmd.Keys() {
+		slot := KeySlot(key)
+		if !seen[slot] {
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// ClusterError is an error replied by redis cluster
+type ClusterError struct {
+	Kind string // ClusterMoved, ClusterAsk ...
+	Slot int    // slot of MOVED and ASK redirection, -1 if unknown
+	Node string // node redirected to by MOVED and ASK
+}
+
+// ParseClusterError parses error reply of redis cluster, such as
+// "MOVED 3999 127.0.0.1:6381", nil is returned for other errors.
+func ParseClusterError(err error) *ClusterError {
+	if err == nil {
+		return nil
+	}
+	parts := strings.Fields(err.Error())
+	if len(parts) == 0 {
+		return nil
+	}
+	kind, ok := clusterErrPrefixes[parts[0]]
+	if !ok {
+		return nil
+	}
+	ce := &ClusterError{Kind: kind, Slot: -1}
+	if kind == ClusterMoved || kind == ClusterAsk {
+		if len(parts) != 3 {
+			return nil
+		}
+		slot, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil
+		}
+		ce.Slot, ce.Node = slot, parts[2]
+	}
+	return ce
+}
+
+// addCluster records hash slot of command and cluster error if any
+func addCluster(result map[string]interface{}, cmd *Command, currRespD *RespData) {
+	if slots := CommandSlots(cmd); len(slots) == 1 {
+		result[AnalyzeSlot] = slots[0]
+	}
+	if !currRespD.IsError() {
+		return
+	}
+	if ce := ParseClusterError(currRespD.Msg.Error); ce != nil {
+		result[AnalyzeClusterErr] = ce.Kind
+		if ce.Node != "" {
+			result[AnalyzeRedirect] = ce.Node
+		}
+	}
+}
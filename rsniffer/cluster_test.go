@@ -0,0 +1,88 @@
+package rsniffer
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	// check value of CRC16-CCITT (XMODEM)
+	if crc := crc16("123456789"); crc != 0x31c3 {
+		t.Fatalf("crc16 = %#x, want 0x31c3", crc)
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"", 0},
+		{"foo", 12182},
+		{"bar", 5061},
+		{"hello", 866},
+		{"123456789", 0x31c3},
+		{"{bar}", 5061},
+		{"foo{bar}", 5061},
+		{"{bar}foo", 5061},
+		{"foo{bar}{zap}", 5061},
+		{"{user1000}.following", KeySlot("user1000")},
+		{"{user1000}.followers", KeySlot("user1000")},
+		{"foo{}{bar}", KeySlot("foo{}{bar}")}, // empty hashtag, the whole key is hashed
+		{"foo{{bar}}", KeySlot("{bar")},
+		{"foo{bar", KeySlot("foo{bar")},
+		{"foo}bar{", KeySlot("foo}bar{")},
+	}
+	for _, tt := range tests {
+		if slot := KeySlot(tt.key); slot != tt.slot {
+			t.Errorf("KeySlot(%q) = %d, want %d", tt.key, slot, tt.slot)
+		}
+	}
+	if KeySlot("foo{}{bar}") == KeySlot("bar") {
+		t.Error("empty hashtag is used")
+	}
+}
+
+func TestCommandSlots(t *testing.T) {
+	tests := []struct {
+		args  []string
+		slots []int
+	}{
+		{[]string{"GET", "foo"}, []int{12182}},
+		{[]string{"MGET", "{u1}a", "{u1}b"}, []int{KeySlot("u1")}},
+		{[]string{"MSET", "foo", "1", "bar", "2"}, []int{12182, 5061}},
+		{[]string{"DEL", "foo", "bar", "foo"}, []int{12182, 5061}},
+		{[]string{"PING"}, []int{}},
+		{[]string{"UNKNOWNCMD", "foo"}, []int{}},
+	}
+	for _, tt := range tests {
+		cmd, _ := NewCommand(tt.args...)
+		if slots := CommandSlots(cmd); !reflect.DeepEqual(slots, tt.slots) {
+			t.Errorf("CommandSlots(%v) = %v, want %v", tt.args, slots, tt.slots)
+		}
+	}
+}
+
+func TestParseClusterError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want *ClusterError
+	}{
+		{errors.New("MOVED 3999 127.0.0.1:6381"), &ClusterError{Kind: ClusterMoved, Slot: 3999, Node: "127.0.0.1:6381"}},
+		{errors.New("ASK 3999 127.0.0.1:6381"), &ClusterError{Kind: ClusterAsk, Slot: 3999, Node: "127.0.0.1:6381"}},
+		{errors.New("CROSSSLOT Keys in request don't hash to the same slot"), &ClusterError{Kind: ClusterCrossSlot, Slot: -1}},
+		{errors.New("TRYAGAIN Multiple keys request during rehashing of slot"), &ClusterError{Kind: ClusterTryAgain, Slot: -1}},
+		{errors.New("CLUSTERDOWN The cluster is down"), &ClusterError{Kind: ClusterDown, Slot: -1}},
+		{errors.New("MOVED 3999"), nil},
+		{errors.New("MOVED x 127.0.0.1:6381"), nil},
+		{errors.New("ERR unknown command"), nil},
+		{errors.New(""), nil},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		if got := ParseClusterError(tt.err); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseClusterError(%v) = %+v, want %+v", tt.err, got, tt.want)
+		}
+	}
+}
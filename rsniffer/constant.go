@@ -1,21 +1,80 @@
 package rsniffer
 
-import (
-	"errors"
-)
-
 const (
 	AnalyzeCmd     = "cmd"
 	AnalyzeCmdType = "type"
 	AnalyzeParams  = "params"
 	AnalyzeReply   = "reply"
 	AnalyzeRequest = "request"
+	AnalyzeReqTime = "req_time" // capture time of recorded request, RFC 3339
 	AnalyzeStat    = "stat"
 	AnalyzeMesg    = "mesg"
+
+	AnalyzeEvent    = "event"
+	AnalyzeSession  = "session"
+	AnalyzeClient   = "client"
+	AnalyzeServer   = "server"
+	AnalyzeKey      = "key"
+	AnalyzeBytes    = "bytes"
+	AnalyzeElements = "elements"
+	AnalyzeSource   = "source"
+	AnalyzeTop      = "top"
+	AnalyzeWindow   = "window"
+	AnalyzeLatency  = "latency" // in microseconds
+	AnalyzePattern  = "pattern"
+	AnalyzeChannel  = "channel"
+	AnalyzeKind     = "kind"
+	AnalyzeRate     = "rate" // per second
+	AnalyzeOutcome  = "outcome"
+	AnalyzeDuration = "duration" // in microseconds
+	AnalyzeWait     = "wait"     // in microseconds
+	AnalyzeTimeout  = "timeout"
+	AnalyzeNoReply  = "no_reply"
+	AnalyzeOffset   = "offset"
+	AnalyzeSlot     = "slot"
+	AnalyzeNode     = "node"
+	AnalyzeRedirect = "redirect" // node redirected to by MOVED or ASK
+	AnalyzeErrCode  = "code"     // code of error reply, such as WRONGTYPE
+
+	AnalyzeClusterErr = "cluster_error"
+	AnalyzeSampleRate = "sample_rate" // probability the result is kept by sampling
 )
 
-var (
-	RedSessionCloseErr = errors.New("redis session closed")
+// event types of analyze results, results of normal commands have no event
+const (
+	EventBigKey    = "bigkey"
+	EventBigKeyTop = "bigkey_top"
+	EventPattern   = "pattern"
+	EventPubsubMsg = "pubsub_message"
+	EventChannel   = "channel"
+	EventTx        = "transaction"
+	EventBlocking  = "blocking"
+	EventTracking  = "tracking"
+	EventInval     = "invalidation"
+	EventMonitor   = "monitor"
+	EventReplSync  = "repl_sync"
+	EventReplRDB   = "repl_rdb"
+	EventCluster   = "cluster"
+	EventSentinel  = "sentinel"
+	EventReplyErr  = "reply_error"
+	EventErrorRate = "error_rate"
+	EventSession   = "session"
+	EventSampling  = "sampling"
+	EventStats     = "stats"
+)
+
+// outcomes of transaction
+const (
+	TxExecuted     = "executed"
+	TxDiscarded    = "discarded"
+	TxWatchAborted = "watch_aborted" // a watched key is modified, EXEC replies null
+	TxExecAborted  = "exec_aborted"  // a command is rejected when queued, EXEC replies EXECABORT
+	TxFailed       = "failed"        // EXEC replies other error or mismatched results
+)
+
+// sources of analyze results, results of commands sent by clients have no source
+const (
+	SourceReplication = "replication" // command propagated by master to replica
 )
 
 const (
@@ -23,6 +82,7 @@ const (
 	RecordParams
 	RecordReply
 	RecordRequest
+	RecordNone // nothing is recorded, used by RecordRule
 )
 
 const (
@@ -0,0 +1,176 @@
+package rsniffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strings"
+)
+
+// encapsulations of redis traffic that BPF filter should match, 802.1Q VLAN,
+// VXLAN and GRE (including ERSPAN) packets are always decoded to the inner
+// IP/TCP layers, these flags only make the BPF filter let them through.
+const (
+	EncapVLAN = 1 << iota
+	EncapVXLAN
+	EncapGRE
+)
+
+const VXLANPort = 4789
+
+var encapNames = map[string]int{
+	"vlan":  EncapVLAN,
+	"vxlan": EncapVXLAN,
+	"gre":   EncapGRE,
+}
+
+// ParseEncap parses encapsulation names such as "vlan", "vxlan" and "gre"
+func ParseEncap(names []string) (int, error) {
+	encap := 0
+	for _, name := range names {
+		flag, ok := encapNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("unknown encapsulation %q", name)
+		}
+		encap |= flag
+	}
+	return encap, nil
+}
+
+// LinkTypeLinuxSLL2 is the link type of "any" device capture with newer
+// libpcap, which is not known by gopacket.
+const LinkTypeLinuxSLL2 = 276
+
+var LayerTypeLinuxSLL2 = gopacket.RegisterLayerType(1276, gopacket.LayerTypeMetadata{
+	Name:    "LinuxSLL2",
+	Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+})
+
+// LinuxSLL2 is the Linux cooked capture v2 header
+type LinuxSLL2 struct {
+	layers.BaseLayer
+	EthernetType   layers.EthernetType
+	InterfaceIndex uint32
+	ARPHardware    uint16
+	PacketType     uint8
+	AddrLen        uint8
+	Addr           []byte
+}
+
+func (sll *LinuxSLL2) LayerType() gopacket.LayerType { return LayerTypeLinuxSLL2 }
+
+func (sll *LinuxSLL2) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 20 {
+		return errors.New("Linux SLL2 packet too small")
+	}
+	sll.EthernetType = layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	sll.InterfaceIndex = binary.BigEndian.Uint32(data[4:8])
+	sll.ARPHardware = binary.BigEndian.Uint16(data[8:10])
+	sll.PacketType = data[10]
+	sll.AddrLen = data[11]
+	addrLen := int(sll.AddrLen)
+	if addrLen > 8 {
+		addrLen = 8
+	}
+	sll.Addr = data[12 : 12+addrLen]
+	sll.BaseLayer = layers.BaseLayer{Contents: data[:20], Payload: data[20:]}
+	return nil
+}
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	sll := &LinuxSLL2{}
+	if err := sll.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(sll)
+	return p.NextDecoder(sll.EthernetType)
+}
+
+// linkDecoder returns the packet decoder of link type, gopacket keeps link
+// type in a byte, so LinkTypeLinuxSLL2 is reported by pcap handle truncated.
+func linkDecoder(linkType layers.LinkType) gopacket.Decoder {
+	if int(linkType) == LinkTypeLinuxSLL2&0xff {
+		return LayerTypeLinuxSLL2
+	}
+	return linkType
+}
+
+// packetTCPMeta returns the TCP layer and its meta of a packet, for
+// encapsulated packets the innermost IP layer before TCP is used.
+func packetTCPMeta(packet gopacket.Packet) (*TCPMeta, *layers.TCP) {
+	var tcpMeta *TCPMeta
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.IPv4:
+			tcpMeta = &TCPMeta{SrcIP: l.SrcIP, DstIP: l.DstIP}
+		case *layers.IPv6:
+			tcpMeta = &TCPMeta{SrcIP: l.SrcIP, DstIP: l.DstIP}
+		case *layers.TCP:
+			if tcpMeta == nil {
+				return nil, nil
+			}
+			tcpMeta.SrcPort = l.SrcPort
+			tcpMeta.DstPort = l.DstPort
+			return tcpMeta, l
+		}
+	}
+	return nil, nil
+}
+
+// vxlanFilter matches the inner IPv4/TCP of VXLAN packets, offsets are
+// relative to the outer UDP header: 8 bytes UDP, 8 bytes VXLAN and 14 bytes
+// inner ethernet. Inner IPv6 is not matched.
+func vxlanFilter(endpoints []*Endpoint) string {
+	ipOffset := 30
+	ihl := fmt.Sprintf("((udp[%d] & 0xf) << 2)", ipOffset)
+	portCond := func(portOffset int, ep *Endpoint) string {
+		port := fmt.Sprintf("udp[%d + %s:2]", ipOffset+portOffset, ihl)
+		if ep.PortMin == ep.PortMax {
+			return fmt.Sprintf("%s = %d", port, ep.PortMin)
+		}
+		return fmt.Sprintf("(%s >= %d and %s <= %d)", port, ep.PortMin, port, ep.PortMax)
+	}
+	hostCond := func(ipOff int, ep *Endpoint) string {
+		if ep.ip == nil || ep.ip.To4() == nil {
+			return ""
+		}
+		return fmt.Sprintf("udp[%d:4] = 0x%x and ", ipOffset+ipOff, []byte(ep.ip.To4()))
+	}
+	conds := make([]string, 0, len(endpoints)*2)
+	for _, ep := range endpoints {
+		if ep.ip != nil && ep.ip.To4() == nil {
+			continue
+		}
+		conds = append(conds, fmt.Sprintf("(%s%s)", hostCond(16, ep), portCond(2, ep)))
+		conds = append(conds, fmt.Sprintf("(%s%s)", hostCond(12, ep), portCond(0, ep)))
+	}
+	filter := fmt.Sprintf("udp dst port %d and udp[%d:2] = 0x0800 and udp[%d] = 6",
+		VXLANPort, ipOffset-2, ipOffset+9)
+	if len(conds) == 0 {
+		return filter
+	}
+	return fmt.Sprintf("%s and (%s)", filter, strings.Join(conds, " or "))
+}
+
+// BPFFilter returns BPF filter of redis endpoints and encapsulations
+func (cfg *SniffConfig) BPFFilter() (string, error) {
+	endpoints, err := cfg.Endpoints()
+	if err != nil {
+		return "", err
+	}
+	filter := BuildBPFFilter(endpoints)
+	if cfg.Encap&EncapVXLAN != 0 {
+		filter = fmt.Sprintf("(%s) or (%s)", filter, vxlanFilter(endpoints))
+	}
+	if cfg.Encap&EncapGRE != 0 {
+		// inner headers of GRE vary with GRE flags, filtered after decoding
+		filter = fmt.Sprintf("(%s) or (proto gre)", filter)
+	}
+	if cfg.Encap&EncapVLAN != 0 {
+		// vlan keyword shifts offsets of the following expression
+		filter = fmt.Sprintf("(%s) or (vlan and (%s))", filter, filter)
+	}
+	return filter, nil
+}
@@ -0,0 +1,170 @@
+package rsniffer
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Endpoint is a redis server, or a set of servers listening on a port range
+type Endpoint struct {
+	Host    string // empty host matches any IP
+	PortMin int
+	PortMax int
+	ip      net.IP
+}
+
+// hostIP parses host of endpoint, unspecified address such as "::" or
+// "0.0.0.0" of a dual-stack listener means any IP.
+func hostIP(host string) (net.IP, bool) {
+	if host == "" || host == "*" {
+		return nil, true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, false
+	}
+	if ip.IsUnspecified() {
+		return nil, true
+	}
+	return ip, true
+}
+
+// ParseEndpoint parses endpoint in formats: "host:port", "host:6379-6390",
+// ":6379" or "*:6379" for any IP on the port.
+func ParseEndpoint(s string) (*Endpoint, error) {
+	host, ports, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %v", s, err)
+	}
+	ip, ok := hostIP(host)
+	if !ok {
+		return nil, fmt.Errorf("invalid endpoint %q: host must be an IP", s)
+	}
+	ep := &Endpoint{ip: ip}
+	if ip != nil {
+		ep.Host = ip.String()
+	}
+	if idx := strings.IndexByte(ports, '-'); idx >= 0 {
+		ep.PortMin, err = strconv.Atoi(ports[:idx])
+		if err == nil {
+			ep.PortMax, err = strconv.Atoi(ports[idx+1:])
+		}
+	} else {
+		ep.PortMin, err = strconv.Atoi(ports)
+		ep.PortMax = ep.PortMin
+	}
+	if err != nil || ep.PortMin <= 0 || ep.PortMax > 65535 || ep.PortMin > ep.PortMax {
+		return nil, fmt.Errorf("invalid port of endpoint %q", s)
+	}
+	return ep, nil
+}
+
+func (ep *Endpoint) String() string {
+	host := ep.Host
+	if host == "" {
+		host = "*"
+	}
+	if ep.PortMin == ep.PortMax {
+		return net.JoinHostPort(host, strconv.Itoa(ep.PortMin))
+	}
+	return net.JoinHostPort(host, fmt.Sprintf("%d-%d", ep.PortMin, ep.PortMax))
+}
+
+// Match reports whether ip and port belong to the endpoint, an IPv4 address
+// matches its IPv4-mapped IPv6 form such as ::ffff:10.0.0.1
+func (ep *Endpoint) Match(ip net.IP, port int) bool {
+	if port < ep.PortMin || port > ep.PortMax {
+		return false
+	}
+	epIP := ep.ip
+	if epIP == nil && ep.Host != "" {
+		// endpoint is not created by ParseEndpoint
+		epIP, _ = hostIP(ep.Host)
+	}
+	return epIP == nil || epIP.Equal(ip)
+}
+
+// BPFFilter returns the BPF filter expression of the endpoint
+func (ep *Endpoint) BPFFilter() string {
+	var filter string
+	if ep.PortMin == ep.PortMax {
+		filter = fmt.Sprintf("tcp port %d", ep.PortMin)
+	} else {
+		filter = fmt.Sprintf("tcp portrange %d-%d", ep.PortMin, ep.PortMax)
+	}
+	if ep.Host != "" {
+		host := ep.Host
+		// IPv4-mapped address is captured as IPv4 packet
+		if ip, _ := hostIP(ep.Host); ip != nil && ip.To4() != nil {
+			host = ip.To4().String()
+		}
+		filter = fmt.Sprintf("host %s and %s", host, filter)
+	}
+	return filter
+}
+
+// BuildBPFFilter returns the BPF filter matching any of the endpoints
+func BuildBPFFilter(endpoints []*Endpoint) string {
+	filters := make([]string, 0, len(endpoints))
+	for _, ep := range endpoints {
+		filters = append(filters, "("+ep.BPFFilter()+")")
+	}
+	return strings.Join(filters, " or ")
+}
+
+// Endpoints returns the redis servers to sniff, Host and Port are used if
+// no Targets is configured. A host which is not an IP is resolved, an
+// endpoint is added for each of its addresses. Endpoints are computed only
+// once, no endpoint is returned if a host fails to resolve.
+func (cfg *SniffConfig) Endpoints() ([]*Endpoint, error) {
+	cfg.endpointsOnce.Do(func() {
+		targets := cfg.Targets
+		if len(targets) == 0 {
+			targets = []*Endpoint{{Host: cfg.Host, PortMin: cfg.Port, PortMax: cfg.Port}}
+		}
+		endpoints := make([]*Endpoint, 0, len(targets))
+		for _, t := range targets {
+			ip, ok := hostIP(t.Host)
+			if ok {
+				ep := *t
+				ep.ip, ep.Host = ip, ""
+				if ip != nil {
+					ep.Host = ip.String()
+				}
+				endpoints = append(endpoints, &ep)
+				continue
+			}
+			ips, err := net.LookupIP(t.Host)
+			if err != nil {
+				cfg.endpointsErr = fmt.Errorf("resolve host of endpoint %s: %v", t, err)
+				return
+			}
+			for _, ip := range ips {
+				ep := *t
+				ep.ip, ep.Host = ip, ip.String()
+				endpoints = append(endpoints, &ep)
+			}
+		}
+		cfg.endpoints = endpoints
+	})
+	return cfg.endpoints, cfg.endpointsErr
+}
+
+// Direction tells whether the packet is sent from client to redis server,
+// ok is false if neither side of the packet is a sniffed redis server.
+func (cfg *SniffConfig) Direction(tm *TCPMeta) (toServer bool, ok bool) {
+	endpoints, _ := cfg.Endpoints()
+	for _, ep := range endpoints {
+		if ep.Match(tm.DstIP, int(tm.DstPort)) {
+			return true, true
+		}
+	}
+	for _, ep := range endpoints {
+		if ep.Match(tm.SrcIP, int(tm.SrcPort)) {
+			return false, true
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,152 @@
+package rsniffer
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		s       string
+		host    string
+		min     int
+		max     int
+		str     string
+		invalid bool
+	}{
+		{s: "10.0.0.1:6379", host: "10.0.0.1", min: 6379, max: 6379, str: "10.0.0.1:6379"},
+		{s: "10.0.0.1:6379-6390", host: "10.0.0.1", min: 6379, max: 6390, str: "10.0.0.1:6379-6390"},
+		{s: "*:6380", min: 6380, max: 6380, str: "*:6380"},
+		{s: ":6380", min: 6380, max: 6380, str: "*:6380"},
+		{s: "0.0.0.0:6379", min: 6379, max: 6379, str: "*:6379"},
+		{s: "[::]:6379", min: 6379, max: 6379, str: "*:6379"},
+		{s: "[fe80::1]:6379", host: "fe80::1", min: 6379, max: 6379, str: "[fe80::1]:6379"},
+		{s: "[::ffff:10.0.0.1]:6379", host: "10.0.0.1", min: 6379, max: 6379, str: "10.0.0.1:6379"},
+		{s: "10.0.0.1", invalid: true},
+		{s: "redis.local:6379", invalid: true},
+		{s: "10.0.0.1:0", invalid: true},
+		{s: "10.0.0.1:65536", invalid: true},
+		{s: "10.0.0.1:6390-6379", invalid: true},
+		{s: "10.0.0.1:x", invalid: true},
+		{s: "10.0.0.1:6379-", invalid: true},
+	}
+	for _, tt := range tests {
+		ep, err := ParseEndpoint(tt.s)
+		if (err != nil) != tt.invalid {
+			t.Errorf("ParseEndpoint(%q) error %v, invalid %v", tt.s, err, tt.invalid)
+			continue
+		}
+		if tt.invalid {
+			continue
+		}
+		if ep.Host != tt.host || ep.PortMin != tt.min || ep.PortMax != tt.max {
+			t.Errorf("ParseEndpoint(%q) = %+v", tt.s, ep)
+		}
+		if ep.String() != tt.str {
+			t.Errorf("ParseEndpoint(%q).String() = %q, want %q", tt.s, ep.String(), tt.str)
+		}
+	}
+}
+
+func TestEndpointMatch(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		ip       string
+		port     int
+		matched  bool
+	}{
+		{"10.0.0.1:6379", "10.0.0.1", 6379, true},
+		{"10.0.0.1:6379", "10.0.0.2", 6379, false},
+		{"10.0.0.1:6379", "10.0.0.1", 6380, false},
+		{"10.0.0.1:6379", "::ffff:10.0.0.1", 6379, true},
+		{"10.0.0.1:6379-6390", "10.0.0.1", 6385, true},
+		{"10.0.0.1:6379-6390", "10.0.0.1", 6391, false},
+		{"*:6379", "192.168.1.1", 6379, true},
+		{"*:6379", "fe80::1", 6379, true},
+		{"[fe80::1]:6379", "fe80::1", 6379, true},
+		{"[fe80::1]:6379", "fe80::2", 6379, false},
+	}
+	for _, tt := range tests {
+		ep, err := ParseEndpoint(tt.endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched := ep.Match(net.ParseIP(tt.ip), tt.port); matched != tt.matched {
+			t.Errorf("%s Match(%s, %d) = %v, want %v", tt.endpoint, tt.ip, tt.port, matched, tt.matched)
+		}
+	}
+}
+
+func TestEndpointBPFFilter(t *testing.T) {
+	tests := []struct {
+		endpoints []string
+		filter    string
+	}{
+		{[]string{"10.0.0.1:6379"}, "(host 10.0.0.1 and tcp port 6379)"},
+		{[]string{"*:6379-6390"}, "(tcp portrange 6379-6390)"},
+		{[]string{"[::ffff:10.0.0.1]:6379"}, "(host 10.0.0.1 and tcp port 6379)"},
+		{[]string{"[fe80::1]:6379", "*:6380"}, "(host fe80::1 and tcp port 6379) or (tcp port 6380)"},
+	}
+	for _, tt := range tests {
+		endpoints := make([]*Endpoint, 0, len(tt.endpoints))
+		for _, s := range tt.endpoints {
+			ep, err := ParseEndpoint(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			endpoints = append(endpoints, ep)
+		}
+		if filter := BuildBPFFilter(endpoints); filter != tt.filter {
+			t.Errorf("BuildBPFFilter(%v) = %q, want %q", tt.endpoints, filter, tt.filter)
+		}
+	}
+}
+
+func TestSniffConfigEndpoints(t *testing.T) {
+	tests := []struct {
+		host    string
+		port    int
+		targets []*Endpoint
+		want    []string
+		invalid bool
+	}{
+		{host: "10.0.0.1", port: 6379, want: []string{"10.0.0.1:6379"}},
+		{host: "0.0.0.0", port: 6379, want: []string{"*:6379"}},
+		{host: "", port: 6380, want: []string{"*:6380"}},
+		{host: "10.0.0.1", port: 6379, targets: []*Endpoint{{Host: "::ffff:10.0.0.2", PortMin: 7000, PortMax: 7005}},
+			want: []string{"10.0.0.2:7000-7005"}},
+		// hostnames are resolved rather than matching any IP
+		{host: "localhost", port: 6379, want: []string{"127.0.0.1:6379"}},
+		{host: "redis.invalid", port: 6379, invalid: true},
+		{targets: []*Endpoint{{Host: "10.0.0.1", PortMin: 6379, PortMax: 6379}, {Host: "redis.invalid", PortMin: 6379, PortMax: 6379}},
+			invalid: true},
+	}
+	for _, tt := range tests {
+		cfg := &SniffConfig{Host: tt.host, Port: tt.port, Targets: tt.targets}
+		endpoints, err := cfg.Endpoints()
+		if (err != nil) != tt.invalid {
+			t.Errorf("Endpoints of %q %v error %v, invalid %v", tt.host, tt.targets, err, tt.invalid)
+			continue
+		}
+		if tt.invalid {
+			if len(endpoints) != 0 {
+				t.Errorf("Endpoints of %q %v = %v, want none", tt.host, tt.targets, endpoints)
+			}
+			if _, err := cfg.BPFFilter(); err == nil {
+				t.Errorf("BPFFilter of %q %v is built", tt.host, tt.targets)
+			}
+			continue
+		}
+		got := make([]string, 0, len(endpoints))
+		for _, ep := range endpoints {
+			// localhost may resolve to ::1 as well
+			if ep.ip == nil || ep.ip.To4() != nil {
+				got = append(got, ep.String())
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Endpoints of %q %v = %v, want %v", tt.host, tt.targets, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package rsniffer
+
+import (
+	"fmt"
+	"time"
+)
+
+// kinds of redis session lifecycle events
+const (
+	SessionOpen     = iota + 1 // the first data of session is captured
+	SessionClose               // FIN, or client connection of proxy is closed
+	SessionReset               // RST
+	SessionEvicted             // no data is captured for SniffConfig.SessionIdle
+	SessionOverflow            // buffered data exceeds buffer size and is dropped
+	SessionDesync              // undecodable data is dropped, e.g. after overflow
+)
+
+var SessionEventNames = map[int]string{
+	SessionOpen:     "open",
+	SessionClose:    "close",
+	SessionReset:    "reset",
+	SessionEvicted:  "evicted",
+	SessionOverflow: "overflow",
+	SessionDesync:   "desync",
+}
+
+// SessionEvent is a lifecycle event of redis session, it is sent to the error
+// channel of sniffer together with errors, but is not a failure of capture.
+type SessionEvent struct {
+	Kind    int
+	Session *RedSession
+	Err     error // cause of overflow and desync
+	Time    time.Time
+}
+
+func (se *SessionEvent) Error() string {
+	if se.Err != nil {
+		return fmt.Sprintf("redis session %s: %v", SessionEventNames[se.Kind], se.Err)
+	}
+	return fmt.Sprintf("redis session %s", SessionEventNames[se.Kind])
+}
+
+// CaptureError is a fatal error of capture, such as failing to open device or
+// to listen in proxy mode, sniffer stops after sending it.
+type CaptureError struct {
+	Err error
+}
+
+func (ce *CaptureError) Error() string {
+	return fmt.Sprintf("capture error: %v", ce.Err)
+}
+
+// IsFatal tells whether an error from sniffer stops capture
+func IsFatal(err error) bool {
+	_, ok := err.(*CaptureError)
+	return ok
+}
+
+func newSessionEvent(kind int, rs *RedSession, err error, ts time.Time) *SessionEvent {
+	return &SessionEvent{Kind: kind, Session: rs, Err: err, Time: ts}
+}
@@ -0,0 +1,201 @@
+package rsniffer
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	PatternPrefix = iota + 1
+	PatternGlob
+	PatternRegex
+)
+
+// PatternOther is the bucket of keys matching no rule
+const PatternOther = "(other)"
+
+type PatternRule struct {
+	Type    int    // PatternPrefix, PatternGlob or PatternRegex
+	Pattern string // prefix, redis style glob or regular expression
+	Name    string // name of the bucket, Pattern is used if empty
+}
+
+// ParsePatternRule parses rule in format "type:pattern", type is one of
+// prefix, glob and regex, e.g. "glob:user:*:profile".
+func ParsePatternRule(rule string) (PatternRule, error) {
+	idx := strings.IndexByte(rule, ':')
+	if idx < 0 {
+		return PatternRule{}, fmt.Errorf("invalid pattern rule %q", rule)
+	}
+	pattern := rule[idx+1:]
+	switch rule[:idx] {
+	case "prefix":
+		return PatternRule{Type: PatternPrefix, Pattern: pattern}, nil
+	case "glob":
+		return PatternRule{Type: PatternGlob, Pattern: pattern}, nil
+	case "regex":
+		return PatternRule{Type: PatternRegex, Pattern: pattern}, nil
+	}
+	return PatternRule{}, fmt.Errorf("unknown type of pattern rule %q", rule)
+}
+
+type KeyPatternConfig struct {
+	Matcher *KeyPatternMatcher
+	Window  time.Duration // window of per pattern statistics
+}
+
+type keyPatternRule struct {
+	PatternRule
+	re *regexp.Regexp
+}
+
+// KeyPatternMatcher buckets keys into patterns, rules are matched in order
+// and the first match wins. If no rule matches, the key is normalized by
+// replacing numeric, uuid and hex segments with '*' when autoNormalize is on.
+type KeyPatternMatcher struct {
+	rules         []*keyPatternRule
+	autoNormalize bool
+}
+
+func NewKeyPatternMatcher(rules []PatternRule, autoNormalize bool) (*KeyPatternMatcher, error) {
+	m := &KeyPatternMatcher{
+		rules:         make([]*keyPatternRule, 0, len(rules)),
+		autoNormalize: autoNormalize,
+	}
+	for _, rule := range rules {
+		r := &keyPatternRule{PatternRule: rule}
+		if r.Name == "" {
+			r.Name = r.Pattern
+		}
+		switch rule.Type {
+		case PatternPrefix:
+		case PatternGlob:
+			re, err := regexp.Compile(globToRegexp(rule.Pattern))
+			if err != nil {
+				return nil, fmt.Errorf("invalid glob pattern %q: %v", rule.Pattern, err)
+			}
+			r.re = re
+		case PatternRegex:
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex pattern %q: %v", rule.Pattern, err)
+			}
+			r.re = re
+		default:
+			return nil, fmt.Errorf("unknown pattern type %d of %q", rule.Type, rule.Pattern)
+		}
+		m.rules = append(m.rules, r)
+	}
+	return m, nil
+}
+
+// Match returns the pattern bucket of the key
+func (m *KeyPatternMatcher) Match(key string) string {
+	if name, ok := m.matchRule(key); ok {
+		return name
+	}
+	if m.autoNormalize {
+		return NormalizeKey(key)
+	}
+	return PatternOther
+}
+
+// matchRule returns the bucket of the first rule matching the key, ok is
+// false if no rule matches.
+func (m *KeyPatternMatcher) matchRule(key string) (name string, ok bool) {
+	for _, r := range m.rules {
+		if r.Type == PatternPrefix {
+			if strings.HasPrefix(key, r.Pattern) {
+				return r.Name, true
+			}
+		} else if r.re.MatchString(key) {
+			return r.Name, true
+		}
+	}
+	return "", false
+}
+
+// globToRegexp converts redis style glob pattern, which supports '*', '?',
+// '[...]' and '\' escaping, to an anchored regular expression.
+func globToRegexp(glob string) string {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			buf.WriteString("[")
+			if strings.HasPrefix(class, "^") {
+				buf.WriteString("^")
+				class = class[1:]
+			}
+			buf.WriteString(strings.Replace(class, `\`, `\\`, -1))
+			buf.WriteString("]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				buf.WriteString(regexp.QuoteMeta(string(glob[i])))
+			} else {
+				buf.WriteString(`\\`)
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
+
+// CompileGlob compiles redis style glob pattern such as pattern of PSUBSCRIBE
+func CompileGlob(glob string) (*regexp.Regexp, error) {
+	return regexp.Compile(globToRegexp(glob))
+}
+
+var (
+	uuidRegexp = regexp.MustCompile(
+		`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	numberRegexp = regexp.MustCompile(`^[0-9]+$`)
+	hexRegexp    = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{8,}$`)
+	digitRegexp  = regexp.MustCompile(`[0-9]`)
+)
+
+const keySeparators = ":/._|-#@,= "
+
+// NormalizeKey replaces numeric, uuid and hex segments of a key with '*',
+// e.g. user:1024:profile becomes user:*:profile.
+func NormalizeKey(key string) string {
+	key = uuidRegexp.ReplaceAllString(key, "*")
+	var buf bytes.Buffer
+	start := 0
+	for i := 0; i <= len(key); i++ {
+		if i < len(key) && strings.IndexByte(keySeparators, key[i]) < 0 {
+			continue
+		}
+		seg := key[start:i]
+		if numberRegexp.MatchString(seg) ||
+			(hexRegexp.MatchString(seg) && digitRegexp.MatchString(seg)) {
+			buf.WriteString("*")
+		} else {
+			buf.WriteString(seg)
+		}
+		if i < len(key) {
+			buf.WriteByte(key[i])
+		}
+		start = i + 1
+	}
+	return buf.String()
+}
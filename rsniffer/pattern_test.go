@@ -0,0 +1,123 @@
+package rsniffer
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		key     string
+		matched bool
+	}{
+		{"user:*", "user:1", true},
+		{"user:*", "user:", true},
+		{"user:*", "users:1", false},
+		{"user:*:profile", "user:1:profile", true},
+		{"user:*:profile", "user:1:profile:x", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`end\`, `end\`, true},
+		{"a[b", "a[b", true},
+		{"a.b", "a.b", true},
+		{"a.b", "axb", false},
+		{"(x)+", "(x)+", true},
+	}
+	for _, tt := range tests {
+		re, err := regexp.Compile(globToRegexp(tt.glob))
+		if err != nil {
+			t.Errorf("glob %q: %v", tt.glob, err)
+			continue
+		}
+		if matched := re.MatchString(tt.key); matched != tt.matched {
+			t.Errorf("glob %q key %q: matched %v, want %v", tt.glob, tt.key, matched, tt.matched)
+		}
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"user:1024:profile", "user:*:profile"},
+		{"user:1024", "user:*"},
+		{"1024", "*"},
+		{"order/42/items", "order/*/items"},
+		{"session:550e8400-e29b-41d4-a716-446655440000", "session:*"},
+		{"blob:deadbeef01", "blob:*"},
+		{"blob:0xdeadbeef01", "blob:*"},
+		{"blob:deadbeefcafe", "blob:deadbeefcafe"}, // hex without digit is a word
+		{"v2:user", "v2:user"},
+		{"a:b:c", "a:b:c"},
+		{"", ""},
+		{"user::1", "user::*"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeKey(tt.key); got != tt.want {
+			t.Errorf("NormalizeKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestKeyPatternMatcher(t *testing.T) {
+	rules := []PatternRule{
+		{Type: PatternPrefix, Pattern: "film:"},
+		{Type: PatternGlob, Pattern: "user:*:profile", Name: "profile"},
+		{Type: PatternRegex, Pattern: `^order:\d+$`},
+	}
+	tests := []struct {
+		autoNormalize bool
+		key           string
+		want          string
+	}{
+		{false, "film:1", "film:"},
+		{false, "user:1:profile", "profile"},
+		{false, "order:12", `^order:\d+$`},
+		{false, "order:x", PatternOther},
+		{true, "order:x", "order:x"},
+		{true, "cart:12", "cart:*"},
+	}
+	for _, tt := range tests {
+		m, err := NewKeyPatternMatcher(rules, tt.autoNormalize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Match(tt.key); got != tt.want {
+			t.Errorf("Match(%q) auto %v = %q, want %q", tt.key, tt.autoNormalize, got, tt.want)
+		}
+	}
+}
+
+func TestParsePatternRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		want    PatternRule
+		invalid bool
+	}{
+		{rule: "prefix:user:", want: PatternRule{Type: PatternPrefix, Pattern: "user:"}},
+		{rule: "glob:user:*", want: PatternRule{Type: PatternGlob, Pattern: "user:*"}},
+		{rule: "regex:^a$", want: PatternRule{Type: PatternRegex, Pattern: "^a$"}},
+		{rule: "user", invalid: true},
+		{rule: "suffix:x", invalid: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePatternRule(tt.rule)
+		if (err != nil) != tt.invalid {
+			t.Errorf("ParsePatternRule(%q) error %v, invalid %v", tt.rule, err, tt.invalid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParsePatternRule(%q) = %+v, want %+v", tt.rule, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package rsniffer
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyConfig enables proxy mode, redis traffic is relayed between clients
+// and the real redis instead of captured, so that clients connected through
+// unix domain socket could also be analyzed.
+type ProxyConfig struct {
+	Listen   string // "unix:/var/run/redsnif.sock" or "tcp:127.0.0.1:16379"
+	Upstream string // the real redis, "unix:/var/run/redis.sock" or "tcp:127.0.0.1:6379"
+}
+
+// ParseProxyAddr splits address of proxy config into network and address,
+// an address without "unix:" or "tcp:" prefix is a unix socket if it is an
+// absolute path, otherwise a TCP address.
+func ParseProxyAddr(s string) (network, address string) {
+	if strings.HasPrefix(s, "unix:") {
+		return "unix", s[len("unix:"):]
+	}
+	if strings.HasPrefix(s, "tcp:") {
+		return "tcp", s[len("tcp:"):]
+	}
+	if strings.HasPrefix(s, "/") {
+		return "unix", s
+	}
+	return "tcp", s
+}
+
+// Proxy relays connections to the upstream redis, data of both directions
+// is fed into RedSession like captured packets.
+type Proxy struct {
+	cfg      *SniffConfig
+	listener net.Listener
+	network  string
+	connID   int
+	closed   chan struct{}
+	wg       sync.WaitGroup
+	sniffer  *Sniffer // counts relayed data if set
+}
+
+// NewProxy starts listening on cfg.Proxy.Listen, a stale unix socket file is
+// removed before listening.
+func NewProxy(cfg *SniffConfig) (*Proxy, error) {
+	if cfg.Proxy == nil {
+		return nil, fmt.Errorf("proxy is not configured")
+	}
+	network, address := ParseProxyAddr(cfg.Proxy.Listen)
+	if network == "unix" {
+		if conn, err := net.Dial(network, address); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is in use", address)
+		}
+		os.Remove(address)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Proxy{
+		cfg:      cfg,
+		listener: l,
+		network:  network,
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+// Addr returns the listening address of the proxy
+func (p *Proxy) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// Close stops accepting new connections and closes the listener
+func (p *Proxy) Close() error {
+	select {
+	case <-p.closed:
+		return nil
+	default:
+		close(p.closed)
+	}
+	return p.listener.Close()
+}
+
+// Serve accepts client connections until the proxy is closed, then waits for
+// all relayed connections to finish and sends io.EOF to sink. If accepting
+// fails, relayed connections are closed and a *CaptureError is sent after
+// them, so that nothing is sent to sink after either error.
+func (p *Proxy) Serve(sink Sink) {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			select {
+			case <-p.closed:
+				p.wg.Wait()
+				sink.Error(io.EOF)
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			p.Close()
+			p.wg.Wait()
+			sink.Error(&CaptureError{err})
+			return
+		}
+		p.connID++
+		p.wg.Add(1)
+		go func(conn net.Conn, id int) {
+			defer p.wg.Done()
+			p.relay(conn, id, sink)
+		}(conn, p.connID)
+	}
+}
+
+// session creates the redis session of a client connection, unix socket
+// clients have no address so they are named by the listening path and a
+// sequence number.
+func (p *Proxy) session(conn net.Conn, id int) *RedSession {
+	client := conn.RemoteAddr().String()
+	if p.network == "unix" || client == "" || client == "@" {
+		client = fmt.Sprintf("%s#%d", p.cfg.Proxy.Listen, id)
+	}
+	_, upstream := ParseProxyAddr(p.cfg.Proxy.Upstream)
+	key := fmt.Sprintf("%s-%s", client, upstream)
+	bufSize := sessionBufSize(p.cfg)
+	rs := &RedSession{
+		ID:         sessionID(key),
+		Created:    time.Now().Unix(),
+		ClientAddr: client,
+		ServerAddr: upstream,
+		RBuf:       make([]byte, bufSize),
+		WBuf:       make([]byte, bufSize),
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && p.network == "tcp" {
+		rs.SrcIP = addr.IP
+		rs.SrcPort = layers.TCPPort(addr.Port)
+	}
+	return rs
+}
+
+func (p *Proxy) relay(conn net.Conn, id int, sink Sink) {
+	defer conn.Close()
+	network, address := ParseProxyAddr(p.cfg.Proxy.Upstream)
+	upstream, err := net.Dial(network, address)
+	if err != nil {
+		sink.Error(fmt.Errorf("proxy dial upstream error: %v", err))
+		return
+	}
+	defer upstream.Close()
+
+	rs := p.session(conn, id)
+	sink.Error(newSessionEvent(SessionOpen, rs, nil, time.Now()))
+	done := make(chan struct{}, 2)
+	go p.pipe(rs, conn, upstream, true, sink, done)
+	go p.pipe(rs, upstream, conn, false, sink, done)
+	pipes := 2
+	select {
+	case <-done:
+		pipes--
+	case <-p.closed:
+	}
+	// either side or the proxy is closed, close both and wait for the pipes
+	// so that nothing of the session is sent after SessionClose
+	conn.Close()
+	upstream.Close()
+	for ; pipes > 0; pipes-- {
+		<-done
+	}
+	sink.Error(newSessionEvent(SessionClose, rs, nil, time.Now()))
+}
+
+// pipe copies data from src to dst. Data is appended to redis session before
+// it is forwarded, so a request is always buffered before its reply, and the
+// session is sent to sink after forwarding to keep analysis off the data path.
+func (p *Proxy) pipe(rs *RedSession, src, dst net.Conn, toServer bool, sink Sink, done chan struct{}) {
+	defer func() { done <- struct{}{} }()
+	buf := make([]byte, sessionBufSize(p.cfg))
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if p.sniffer != nil {
+				atomic.AddInt64(&p.sniffer.packets, 1)
+				atomic.AddInt64(&p.sniffer.bytes, int64(n))
+			}
+			ts := time.Now()
+			var aerr error
+			if toServer {
+				aerr = rs.AppendRequestData(buf[:n], ts)
+			} else {
+				aerr = rs.AppendReplyData(buf[:n], ts)
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+			if aerr != nil {
+				sink.Error(aerr)
+			} else {
+				sink.Data(rs)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ProxySniff relays redis traffic in proxy mode and sends redis sessions with
+// new data to sink, it is the proxy mode counterpart of PacketSniff.
+func ProxySniff(snifCfg *SniffConfig, sink Sink) {
+	NewSniffer(snifCfg).proxySniff(sink)
+}
+
+func (s *Sniffer) proxySniff(sink Sink) {
+	p, err := NewProxy(s.cfg)
+	if err != nil {
+		sink.Error(&CaptureError{err})
+		return
+	}
+	p.sniffer = s
+	p.Serve(sink)
+}
@@ -0,0 +1,237 @@
+package rsniffer
+
+import (
+	"bufio"
+	"github.com/amyangfei/redsnif/internal/resptest"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// proxySink decodes sessions it receives and keeps session events
+type proxySink struct {
+	mu       sync.Mutex
+	requests []*RespData
+	replies  []*RespData
+	events   chan *SessionEvent
+	errs     []error
+}
+
+func (ps *proxySink) Data(rs *RedSession) {
+	request, reply, err := rs.GetRespData()
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if err != nil {
+		ps.errs = append(ps.errs, err)
+	}
+	ps.requests = append(ps.requests, request...)
+	ps.replies = append(ps.replies, reply...)
+}
+
+func (ps *proxySink) Error(err error) {
+	if se, ok := err.(*SessionEvent); ok {
+		ps.events <- se
+		return
+	}
+	if err == io.EOF {
+		return
+	}
+	ps.mu.Lock()
+	ps.errs = append(ps.errs, err)
+	ps.mu.Unlock()
+}
+
+func (ps *proxySink) waitEvent(t *testing.T, kind int) *SessionEvent {
+	select {
+	case se := <-ps.events:
+		if se.Kind != kind {
+			t.Fatalf("session event %s, want %s", SessionEventNames[se.Kind], SessionEventNames[kind])
+		}
+		return se
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no %s session event", SessionEventNames[kind])
+	}
+	return nil
+}
+
+func startProxy(t *testing.T, fr *resptest.Server) (*Proxy, *proxySink) {
+	cfg := DefaultSniffConfig()
+	cfg.Proxy = &ProxyConfig{Listen: "tcp:127.0.0.1:0", Upstream: "tcp:" + fr.Addr()}
+	p, err := NewProxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &proxySink{events: make(chan *SessionEvent, 16)}
+	go p.Serve(sink)
+	return p, sink
+}
+
+func encodeArgs(args ...string) string {
+	s := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		s += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	return s
+}
+
+func TestProxyRelay(t *testing.T) {
+	fr := resptest.NewServer(t, nil)
+	defer fr.Close()
+	p, sink := startProxy(t, fr)
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := encodeArgs("SET", "user:1", "x") + encodeArgs("GET", "user:1")
+	// pipelined requests split in the middle of a command
+	conn.Write([]byte(sent[:10]))
+	time.Sleep(10 * time.Millisecond)
+	conn.Write([]byte(sent[10:]))
+	r := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		if line, err := r.ReadString('\n'); err != nil || line != "+OK\r\n" {
+			t.Fatalf("reply %d: %q %v", i, line, err)
+		}
+	}
+	if got := string(fr.Bytes()); got != sent {
+		t.Fatalf("upstream received %q, want %q", got, sent)
+	}
+
+	open := sink.waitEvent(t, SessionOpen)
+	conn.Close()
+	closed := sink.waitEvent(t, SessionClose)
+	if string(open.Session.ID) != string(closed.Session.ID) {
+		t.Fatal("open and close events of different sessions")
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.errs) > 0 {
+		t.Fatalf("sink errors: %v", sink.errs)
+	}
+	if len(sink.requests) != 2 || len(sink.replies) != 2 {
+		t.Fatalf("sink got %d requests and %d replies, want 2 and 2", len(sink.requests), len(sink.replies))
+	}
+	cfg := &AnalyzeConfig{SaveCmdTypes: []int{RedisCmdRead, RedisCmdWrite}, SaveDetail: RecordParams}
+	for i, want := range []string{"SET", "GET"} {
+		result, err := RespDataAnalyze(sink.requests[i], sink.replies[i], cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result[AnalyzeCmd] != want {
+			t.Errorf("result %d cmd %v, want %s", i, result[AnalyzeCmd], want)
+		}
+	}
+}
+
+func TestProxyUpstreamClose(t *testing.T) {
+	fr := resptest.NewServer(t, nil)
+	defer fr.Close()
+	p, sink := startProxy(t, fr)
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink.waitEvent(t, SessionOpen)
+	conn.Write([]byte(encodeArgs("QUIT")))
+	sink.waitEvent(t, SessionClose)
+
+	// client connection is closed once upstream is closed
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("client connection is not closed: %v", err)
+	}
+	if string(b) != "+OK\r\n" {
+		t.Fatalf("client received %q", b)
+	}
+}
+
+// blockSink blocks the first Data call until released, and notes whether
+// any Data call is running when io.EOF arrives
+type blockSink struct {
+	mu      sync.Mutex
+	first   bool
+	running int
+	late    bool
+	entered chan struct{}
+	release chan struct{}
+	eof     chan struct{}
+}
+
+func (bs *blockSink) Data(rs *RedSession) {
+	bs.mu.Lock()
+	bs.running++
+	block := !bs.first
+	bs.first = true
+	bs.mu.Unlock()
+	if block {
+		close(bs.entered)
+		<-bs.release
+	}
+	bs.mu.Lock()
+	bs.running--
+	bs.mu.Unlock()
+}
+
+func (bs *blockSink) Error(err error) {
+	if err != io.EOF {
+		return
+	}
+	bs.mu.Lock()
+	bs.late = bs.running > 0
+	bs.mu.Unlock()
+	close(bs.eof)
+}
+
+func TestProxyCloseInFlight(t *testing.T) {
+	fr := resptest.NewServer(t, nil)
+	defer fr.Close()
+	cfg := DefaultSniffConfig()
+	cfg.Proxy = &ProxyConfig{Listen: "tcp:127.0.0.1:0", Upstream: "tcp:" + fr.Addr()}
+	p, err := NewProxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &blockSink{entered: make(chan struct{}), release: make(chan struct{}), eof: make(chan struct{})}
+	go p.Serve(sink)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(encodeArgs("SET", "k", "v")))
+	select {
+	case <-sink.entered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request is not sent to sink")
+	}
+
+	// the request pipe is still in sink when the proxy is closed
+	p.Close()
+	select {
+	case <-sink.eof:
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(sink.release)
+	select {
+	case <-sink.eof:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve does not end after Close")
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.late {
+		t.Fatal("io.EOF is sent while a pipe is sending to sink")
+	}
+}
@@ -0,0 +1,161 @@
+package rsniffer
+
+import (
+	"github.com/amyangfei/resp-go/resp"
+	"strings"
+	"time"
+)
+
+// kinds of pub/sub subscription
+const (
+	SubChannel = iota + 1
+	SubPattern
+	SubShardChannel
+)
+
+// subscribe confirmation kinds replied by redis, true for subscribe and false
+// for unsubscribe
+var subscribeReplies = map[string]struct {
+	kind      int
+	subscribe bool
+}{
+	"subscribe":    {SubChannel, true},
+	"unsubscribe":  {SubChannel, false},
+	"psubscribe":   {SubPattern, true},
+	"punsubscribe": {SubPattern, false},
+	"ssubscribe":   {SubShardChannel, true},
+	"sunsubscribe": {SubShardChannel, false},
+}
+
+// SubKindNames names the kinds of subscription in analyze results
+var SubKindNames = map[int]string{
+	SubChannel:      "channel",
+	SubPattern:      "pattern",
+	SubShardChannel: "shard",
+}
+
+// ChannelConfig enables pub/sub channel analytics
+type ChannelConfig struct {
+	Window time.Duration // window of per channel and per pattern summaries
+}
+
+// SubscribeCmds maps (un)subscribe commands to the kind of subscription
+var SubscribeCmds = map[string]int{
+	"SUBSCRIBE":    SubChannel,
+	"UNSUBSCRIBE":  SubChannel,
+	"PSUBSCRIBE":   SubPattern,
+	"PUNSUBSCRIBE": SubPattern,
+	"SSUBSCRIBE":   SubShardChannel,
+	"SUNSUBSCRIBE": SubShardChannel,
+}
+
+// InvalidateChannel is the channel of client side caching invalidation
+// messages sent to RESP2 redirect connections
+const InvalidateChannel = "__redis__:invalidate"
+
+// PushMessage is a message pushed by redis to a subscribed client, or a
+// RESP3 invalidate push to a tracking client
+type PushMessage struct {
+	Kind    string // message, pmessage, smessage or invalidate
+	Pattern string // the matched pattern of pmessage
+	Channel string
+	Payload []byte
+	Data    *resp.Message // the payload message, keys array of invalidation
+	Time    time.Time
+}
+
+// IsInvalidation reports whether the message invalidates keys tracked by
+// client side caching
+func (pm *PushMessage) IsInvalidation() bool {
+	return pm.Channel == InvalidateChannel
+}
+
+// InvalidatedKeys returns keys of an invalidation message, flush is true if
+// all keys are invalidated, e.g. by FLUSHALL.
+func (pm *PushMessage) InvalidatedKeys() (keys []string, flush bool) {
+	if pm.Data == nil || pm.Data.Type != resp.ArrayHeader || pm.Data.Array == nil {
+		return nil, true
+	}
+	keys = make([]string, 0, len(pm.Data.Array))
+	for _, elem := range pm.Data.Array {
+		keys = append(keys, string(elem.Bytes))
+	}
+	return keys, false
+}
+
+// SubscribeReply is the confirmation of a (un)subscribe request, redis replies
+// one for each channel or pattern of the request.
+type SubscribeReply struct {
+	Kind      int  // SubChannel, SubPattern or SubShardChannel
+	Subscribe bool // false for unsubscribe
+	Channel   string
+	Count     int64 // subscriptions of the client after this reply
+}
+
+// pubsubFrame returns elements of an array reply whose first element is a
+// bulk string, nil if the reply can't be a pub/sub frame.
+func pubsubFrame(rd *RespData) []*resp.Message {
+	if rd == nil || !rd.IsArray() || len(rd.Msg.Array) < 2 {
+		return nil
+	}
+	if rd.Msg.Array[0].Type != resp.BulkHeader {
+		return nil
+	}
+	return rd.Msg.Array
+}
+
+// ParsePushMessage parses message, pmessage and smessage pushed to subscribed
+// client and RESP3 invalidate push, nil is returned if rd is not one of them.
+func ParsePushMessage(rd *RespData) *PushMessage {
+	elems := pubsubFrame(rd)
+	if elems == nil {
+		return nil
+	}
+	kind := strings.ToLower(string(elems[0].Bytes))
+	switch {
+	case (kind == "message" || kind == "smessage") && len(elems) == 3:
+		return &PushMessage{
+			Kind:    kind,
+			Channel: string(elems[1].Bytes),
+			Payload: elems[2].Bytes,
+			Data:    elems[2],
+			Time:    rd.Time,
+		}
+	case kind == "pmessage" && len(elems) == 4:
+		return &PushMessage{
+			Kind:    kind,
+			Pattern: string(elems[1].Bytes),
+			Channel: string(elems[2].Bytes),
+			Payload: elems[3].Bytes,
+			Data:    elems[3],
+			Time:    rd.Time,
+		}
+	case kind == "invalidate" && len(elems) == 2 && rd.Push:
+		return &PushMessage{
+			Kind:    kind,
+			Channel: InvalidateChannel,
+			Data:    elems[1],
+			Time:    rd.Time,
+		}
+	}
+	return nil
+}
+
+// ParseSubscribeReply parses confirmation of (un)subscribe requests, nil is
+// returned if rd is not a confirmation.
+func ParseSubscribeReply(rd *RespData) *SubscribeReply {
+	elems := pubsubFrame(rd)
+	if elems == nil || len(elems) != 3 || elems[2].Type != resp.IntegerHeader {
+		return nil
+	}
+	sr, ok := subscribeReplies[strings.ToLower(string(elems[0].Bytes))]
+	if !ok {
+		return nil
+	}
+	return &SubscribeReply{
+		Kind:      sr.kind,
+		Subscribe: sr.subscribe,
+		Channel:   string(elems[1].Bytes),
+		Count:     elems[2].Integer,
+	}
+}
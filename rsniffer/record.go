@@ -0,0 +1,129 @@
+package rsniffer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RecordDetails maps names of record detail used in config to its value
+var RecordDetails = map[string]int{
+	"none":    RecordNone,
+	"cmd":     RecordCmdOnly,
+	"params":  RecordParams,
+	"reply":   RecordReply,
+	"request": RecordRequest,
+}
+
+// ParseRecordDetail returns record detail of name, such as "params"
+func ParseRecordDetail(name string) (int, error) {
+	detail, ok := RecordDetails[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown record detail %q", name)
+	}
+	return detail, nil
+}
+
+// RecordRule decides what is recorded for commands it matches, rules in
+// AnalyzeConfig.RecordRules are matched in order and the first match wins.
+type RecordRule struct {
+	Commands      []string           // command names, any command if empty
+	Keys          *KeyPatternMatcher // matches if any key of command matches a rule of it, any command if nil
+	Detail        int                // RecordNone, RecordCmdOnly, RecordParams, RecordReply or RecordRequest
+	ReplyOnError  bool               // record reply if it is an error, reply is recorded only if a condition holds
+	ReplyMinBytes int                // record reply if it has at least so many bytes, 0 disables
+}
+
+// ParseRecordRule parses rule in format "detail[/condition...]:commands[:key
+// pattern rule]", commands are separated by comma or "*" for any command, and
+// conditions of reply are "error" or minimal bytes. e.g. "request:DEL:glob:user:*",
+// "none:PING" and "reply/error/4096:*".
+func ParseRecordRule(rule string) (*RecordRule, error) {
+	parts := strings.SplitN(rule, ":", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid record rule %q", rule)
+	}
+	conds := strings.Split(parts[0], "/")
+	detail, err := ParseRecordDetail(conds[0])
+	if err != nil {
+		return nil, err
+	}
+	rr := &RecordRule{Detail: detail}
+	for _, cond := range conds[1:] {
+		if cond == "error" {
+			rr.ReplyOnError = true
+			continue
+		}
+		size, err := strconv.Atoi(cond)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid reply condition of record rule %q", rule)
+		}
+		rr.ReplyMinBytes = size
+	}
+	if parts[1] != "*" {
+		rr.Commands = strings.Split(parts[1], ",")
+	}
+	if len(parts) == 3 {
+		keyRule, err := ParsePatternRule(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		if rr.Keys, err = NewKeyPatternMatcher([]PatternRule{keyRule}, false); err != nil {
+			return nil, err
+		}
+	}
+	return rr, nil
+}
+
+// Match tells whether the rule applies to the command
+func (rr *RecordRule) Match(cmd *Command) bool {
+	if len(rr.Commands) > 0 {
+		found := false
+		for _, name := range rr.Commands {
+			if strings.EqualFold(name, cmd.Name()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rr.Keys == nil {
+		return true
+	}
+	for _, key := range cmd.Keys() {
+		if _, ok := rr.Keys.matchRule(key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// keepReply tells whether the reply is recorded, a nil rule keeps every reply
+func (rr *RecordRule) keepReply(replyRD *RespData) bool {
+	if rr == nil || (!rr.ReplyOnError && rr.ReplyMinBytes <= 0) {
+		return true
+	}
+	if rr.ReplyOnError && replyRD.IsError() {
+		return true
+	}
+	return rr.ReplyMinBytes > 0 && replyRD.Size() >= rr.ReplyMinBytes
+}
+
+// recordDetail returns the record detail of a command and the rule deciding
+// it, SaveCmdTypes and SaveDetail apply if no rule matches. ok is false if
+// nothing of the command is recorded.
+func (config *AnalyzeConfig) recordDetail(cmd *Command, cmdType int) (detail int, rule *RecordRule, ok bool) {
+	for _, rr := range config.RecordRules {
+		if rr.Match(cmd) {
+			return rr.Detail, rr, rr.Detail != RecordNone
+		}
+	}
+	for _, saveCmdType := range config.SaveCmdTypes {
+		if cmdType == saveCmdType {
+			return config.SaveDetail, nil, true
+		}
+	}
+	return 0, nil, false
+}
@@ -0,0 +1,181 @@
+package rsniffer
+
+import (
+	"errors"
+	"github.com/amyangfei/resp-go/resp"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRecordRule(t *testing.T) {
+	tests := []struct {
+		rule     string
+		detail   int
+		commands []string
+		keys     bool
+		onError  bool
+		minBytes int
+		err      bool
+	}{
+		{rule: "none:PING", detail: RecordNone, commands: []string{"PING"}},
+		{rule: "CMD:get,set", detail: RecordCmdOnly, commands: []string{"get", "set"}},
+		{rule: "params:*", detail: RecordParams},
+		{rule: "request:DEL:glob:user:*", detail: RecordRequest, commands: []string{"DEL"}, keys: true},
+		{rule: "reply/error:*", detail: RecordReply, onError: true},
+		{rule: "reply/error/4096:*", detail: RecordReply, onError: true, minBytes: 4096},
+		{rule: "reply/1024:HGETALL", detail: RecordReply, commands: []string{"HGETALL"}, minBytes: 1024},
+		{rule: "params", err: true},
+		{rule: "params:", err: true},
+		{rule: "all:*", err: true},
+		{rule: "reply/0:*", err: true},
+		{rule: "reply/big:*", err: true},
+		{rule: "reply/:*", err: true},
+		{rule: "params:GET:user:*", err: true},
+		{rule: "params:GET:regex:(", err: true},
+	}
+	for _, tt := range tests {
+		rr, err := ParseRecordRule(tt.rule)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseRecordRule(%q) error = %v, want error %v", tt.rule, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if rr.Detail != tt.detail || !reflect.DeepEqual(rr.Commands, tt.commands) || (rr.Keys != nil) != tt.keys ||
+			rr.ReplyOnError != tt.onError || rr.ReplyMinBytes != tt.minBytes {
+			t.Errorf("ParseRecordRule(%q) = %+v", tt.rule, rr)
+		}
+	}
+}
+
+func TestRecordRuleMatch(t *testing.T) {
+	tests := []struct {
+		rule  string
+		args  []string
+		match bool
+	}{
+		{"params:*", []string{"GET", "foo"}, true},
+		{"params:*", []string{"PING"}, true},
+		{"params:GET,SET", []string{"get", "foo"}, true},
+		{"params:GET,SET", []string{"SET", "foo", "bar"}, true},
+		{"params:GET,SET", []string{"DEL", "foo"}, false},
+		{"params:*:prefix:user:", []string{"GET", "user:1"}, true},
+		{"params:*:prefix:user:", []string{"GET", "item:1"}, false},
+		{"params:*:prefix:user:", []string{"MGET", "item:1", "user:1"}, true},
+		{"params:*:prefix:user:", []string{"PING"}, false},
+		{"params:DEL:glob:user:*", []string{"GET", "user:1"}, false},
+		{"params:DEL:glob:user:*", []string{"DEL", "user:1"}, true},
+	}
+	for _, tt := range tests {
+		rr, err := ParseRecordRule(tt.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd, _ := NewCommand(tt.args...)
+		if match := rr.Match(cmd); match != tt.match {
+			t.Errorf("rule %q Match(%q) = %v, want %v", tt.rule, tt.args, match, tt.match)
+		}
+	}
+}
+
+func TestKeepReply(t *testing.T) {
+	errReply := &RespData{Msg: &resp.Message{Type: resp.ErrorHeader}}
+	small := &RespData{Msg: &resp.Message{Type: resp.BulkHeader, Bytes: []byte("v")}}
+	big := &RespData{Msg: &resp.Message{Type: resp.BulkHeader, Bytes: []byte(strings.Repeat("v", 100))}}
+	tests := []struct {
+		rule  string
+		reply *RespData
+		keep  bool
+	}{
+		{"", small, true},
+		{"reply:*", small, true},
+		{"reply:*", errReply, true},
+		{"reply/error:*", errReply, true},
+		{"reply/error:*", big, false},
+		{"reply/100:*", big, true},
+		{"reply/100:*", small, false},
+		{"reply/100:*", errReply, false},
+		{"reply/error/100:*", errReply, true},
+		{"reply/error/100:*", big, true},
+		{"reply/error/100:*", small, false},
+	}
+	for _, tt := range tests {
+		var rr *RecordRule
+		if tt.rule != "" {
+			var err error
+			if rr, err = ParseRecordRule(tt.rule); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if keep := rr.keepReply(tt.reply); keep != tt.keep {
+			t.Errorf("rule %q keepReply(%d bytes) = %v, want %v", tt.rule, tt.reply.Size(), keep, tt.keep)
+		}
+	}
+}
+
+func TestRecordDetail(t *testing.T) {
+	rules := make([]*RecordRule, 0)
+	for _, r := range []string{"none:PING", "request:DEL:glob:user:*", "params:DEL,GET"} {
+		rr, err := ParseRecordRule(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rr)
+	}
+	config := &AnalyzeConfig{
+		SaveCmdTypes: []int{RedisCmdWrite},
+		SaveDetail:   RecordCmdOnly,
+		RecordRules:  rules,
+	}
+	tests := []struct {
+		args   []string
+		detail int
+		rule   *RecordRule
+		ok     bool
+	}{
+		{[]string{"PING"}, RecordNone, rules[0], false},
+		{[]string{"DEL", "user:1"}, RecordRequest, rules[1], true},
+		{[]string{"DEL", "item:1"}, RecordParams, rules[2], true},
+		{[]string{"GET", "user:1"}, RecordParams, rules[2], true},
+		{[]string{"SET", "foo", "bar"}, RecordCmdOnly, nil, true},
+		{[]string{"HGET", "h", "f"}, 0, nil, false},
+	}
+	for _, tt := range tests {
+		cmd, _ := NewCommand(tt.args...)
+		cmdType := RedisCmds[strings.ToUpper(cmd.Name())]
+		detail, rule, ok := config.recordDetail(cmd, cmdType)
+		if detail != tt.detail || rule != tt.rule || ok != tt.ok {
+			t.Errorf("recordDetail(%q) = %d, %p, %v, want %d, %p, %v", tt.args, detail, rule, ok, tt.detail, tt.rule, tt.ok)
+		}
+	}
+}
+
+func TestRecordRequestTime(t *testing.T) {
+	captured := time.Date(2018, 5, 1, 10, 0, 0, 123456000, time.UTC)
+	config := &AnalyzeConfig{SaveCmdTypes: []int{RedisCmdRead}, SaveDetail: RecordRequest}
+	tests := []struct {
+		reqTime time.Time
+		reply   *resp.Message
+		want    interface{}
+	}{
+		{captured, &resp.Message{Type: resp.BulkHeader, Bytes: []byte("v")}, "2018-05-01T10:00:00.123456Z"},
+		{captured, &resp.Message{Type: resp.ErrorHeader, Error: errors.New("WRONGTYPE wrong kind")}, "2018-05-01T10:00:00.123456Z"},
+		{time.Time{}, &resp.Message{Type: resp.BulkHeader, Bytes: []byte("v")}, nil},
+	}
+	for _, tt := range tests {
+		reqRD := &RespData{Msg: bulkArray("GET", "k"), Time: tt.reqTime}
+		replyRD := &RespData{Msg: tt.reply, Time: tt.reqTime.Add(time.Millisecond)}
+		var result map[string]interface{}
+		if replyRD.IsError() {
+			result, _ = RespErrorAnalyze(reqRD, replyRD, config)
+		} else {
+			result, _ = RespDataAnalyze(reqRD, replyRD, config)
+		}
+		if result[AnalyzeRequest] != encodeArgs("GET", "k") || result[AnalyzeReqTime] != tt.want {
+			t.Errorf("request %v at %v, want %v", result[AnalyzeRequest], result[AnalyzeReqTime], tt.want)
+		}
+	}
+}
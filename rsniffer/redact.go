@@ -0,0 +1,343 @@
+package rsniffer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/amyangfei/resp-go/resp"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultRedactMask replaces masked values if RedactConfig.Mask is empty
+const DefaultRedactMask = "***"
+
+// RedactRule masks or hashes arguments of a command
+type RedactRule struct {
+	Command string // command name, such as "SET"
+	Args    []int  // positions in command args, 1 is the first argument, negative counts from the end, all arguments if empty
+	Hash    bool   // replace with hash instead of mask, so that equal values stay correlatable
+}
+
+// ParseRedactRule parses rule in format "action:command[:positions]", action
+// is mask or hash and positions are separated by comma, e.g. "hash:SET:2" or
+// "mask:HSET:-1". All arguments are redacted if positions are omitted.
+func ParseRedactRule(rule string) (*RedactRule, error) {
+	parts := strings.SplitN(rule, ":", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid redact rule %q", rule)
+	}
+	rr := &RedactRule{Command: strings.ToUpper(parts[1])}
+	switch parts[0] {
+	case "mask":
+	case "hash":
+		rr.Hash = true
+	default:
+		return nil, fmt.Errorf("unknown action of redact rule %q", rule)
+	}
+	if len(parts) == 3 {
+		for _, field := range strings.Split(parts[2], ",") {
+			pos, err := strconv.Atoi(field)
+			if err != nil || pos == 0 {
+				return nil, fmt.Errorf("invalid position of redact rule %q", rule)
+			}
+			rr.Args = append(rr.Args, pos)
+		}
+	}
+	return rr, nil
+}
+
+// RedactConfig configures redaction of recorded params, requests and replies,
+// on top of built-in rules of credential bearing commands.
+type RedactConfig struct {
+	Mask     string           // replacement of masked values
+	HashKey  string           // HMAC key of hashed values, values can be guessed by brute force without it
+	Rules    []*RedactRule    // per command argument masking and hashing
+	Patterns []*regexp.Regexp // matches in any recorded value are masked, e.g. email addresses
+}
+
+// sensitiveConfigs are parameters of CONFIG SET and CONFIG GET holding secrets
+var sensitiveConfigs = map[string]bool{
+	"requirepass":              true,
+	"masterauth":               true,
+	"tls-key-file-pass":        true,
+	"tls-client-key-file-pass": true,
+}
+
+// argsAfterToken returns positions of the n arguments after token, such as
+// password after AUTH option of MIGRATE
+func argsAfterToken(args []string, token string, n int) []int {
+	for i := 1; i < len(args); i++ {
+		if strings.ToUpper(args[i]) == token {
+			pos := make([]int, 0, n)
+			for j := i + 1; j <= i+n && j < len(args); j++ {
+				pos = append(pos, j)
+			}
+			return pos
+		}
+	}
+	return nil
+}
+
+// redisCredentialArgs return positions of credentials in command args
+var redisCredentialArgs = map[string]func(args []string) []int{
+	"AUTH": func(args []string) []int {
+		// AUTH [username] password
+		return []int{len(args) - 1}
+	},
+	"HELLO": func(args []string) []int {
+		// HELLO protover AUTH username password
+		pos := argsAfterToken(args, "AUTH", 2)
+		if len(pos) == 2 {
+			return pos[1:]
+		}
+		return pos
+	},
+	"MIGRATE": func(args []string) []int {
+		// AUTH password or AUTH2 username password
+		if pos := argsAfterToken(args, "AUTH", 1); pos != nil {
+			return pos
+		}
+		if pos := argsAfterToken(args, "AUTH2", 2); len(pos) == 2 {
+			return pos[1:]
+		}
+		return nil
+	},
+	"ACL": func(args []string) []int {
+		// ACL SETUSER username >password #hash <password !hash ...
+		if len(args) < 3 || strings.ToUpper(args[1]) != "SETUSER" {
+			return nil
+		}
+		pos := make([]int, 0)
+		for i := 3; i < len(args); i++ {
+			if args[i] != "" && strings.ContainsRune("><#!", rune(args[i][0])) {
+				pos = append(pos, i)
+			}
+		}
+		return pos
+	},
+	"CONFIG": func(args []string) []int {
+		// CONFIG SET parameter value [parameter value ...]
+		if len(args) < 4 || strings.ToUpper(args[1]) != "SET" {
+			return nil
+		}
+		pos := make([]int, 0)
+		for i := 2; i+1 < len(args); i += 2 {
+			if sensitiveConfigs[strings.ToLower(args[i])] {
+				pos = append(pos, i+1)
+			}
+		}
+		return pos
+	},
+	"SENTINEL": func(args []string) []int {
+		// SENTINEL SET master auth-pass password
+		if len(args) < 5 || strings.ToUpper(args[1]) != "SET" {
+			return nil
+		}
+		pos := make([]int, 0)
+		for i := 3; i+1 < len(args); i += 2 {
+			if strings.ToLower(args[i]) == "auth-pass" {
+				pos = append(pos, i+1)
+			}
+		}
+		return pos
+	},
+}
+
+func (rc *RedactConfig) mask() string {
+	if rc == nil || rc.Mask == "" {
+		return DefaultRedactMask
+	}
+	return rc.Mask
+}
+
+func (rc *RedactConfig) hash(value string) string {
+	var key string
+	if rc != nil {
+		key = rc.HashKey
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return "hash:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// Scrub masks matches of patterns in a value, such as an error message
+func (rc *RedactConfig) Scrub(value string) string {
+	if rc == nil {
+		return value
+	}
+	for _, pattern := range rc.Patterns {
+		value = pattern.ReplaceAllString(value, rc.mask())
+	}
+	return value
+}
+
+// RedactArgs returns a copy of command args with credentials masked and the
+// rules and patterns of rc applied, changed is false if nothing is redacted.
+func RedactArgs(cmd *Command, rc *RedactConfig) (args []string, changed bool) {
+	args = make([]string, len(cmd.Args))
+	copy(args, cmd.Args)
+	cmdName := strings.ToUpper(cmd.Name())
+	masked := map[int]bool{}
+	if credFunc, ok := redisCredentialArgs[cmdName]; ok {
+		for _, pos := range credFunc(args) {
+			if pos > 0 && pos < len(args) {
+				masked[pos] = true
+			}
+		}
+	}
+	hashed := map[int]bool{}
+	if rc != nil {
+		for _, rule := range rc.Rules {
+			if strings.ToUpper(rule.Command) != cmdName {
+				continue
+			}
+			positions := rule.Args
+			if len(positions) == 0 {
+				positions = make([]int, 0, len(args)-1)
+				for i := 1; i < len(args); i++ {
+					positions = append(positions, i)
+				}
+			}
+			for _, pos := range positions {
+				if pos < 0 {
+					pos = len(args) + pos
+				}
+				if pos <= 0 || pos >= len(args) {
+					continue
+				}
+				if rule.Hash {
+					hashed[pos] = true
+				} else {
+					masked[pos] = true
+				}
+			}
+		}
+	}
+	for i := 1; i < len(args); i++ {
+		value := args[i]
+		switch {
+		case masked[i]:
+			value = rc.mask()
+		case hashed[i]:
+			value = rc.hash(value)
+		default:
+			value = rc.Scrub(value)
+		}
+		if value != args[i] {
+			args[i] = value
+			changed = true
+		}
+	}
+	return args, changed
+}
+
+// redactReplyMsg returns a copy of reply with secrets in replies of CONFIG
+// GET and ACL masked and patterns of rc applied
+func redactReplyMsg(cmd *Command, msg *resp.Message, rc *RedactConfig) *resp.Message {
+	var sub string
+	if len(cmd.Args) > 1 {
+		sub = strings.ToUpper(cmd.Args[1])
+	}
+	secret := func(elems []*resp.Message, i int) bool {
+		return false
+	}
+	switch strings.ToUpper(cmd.Name()) {
+	case "CONFIG":
+		if sub == "GET" {
+			// parameter value pairs
+			secret = func(elems []*resp.Message, i int) bool {
+				return i%2 == 1 && sensitiveConfigs[strings.ToLower(string(elems[i-1].Bytes))]
+			}
+		}
+	case "ACL":
+		switch sub {
+		case "GETUSER":
+			// field value pairs, "passwords" is a list of password hashes
+			secret = func(elems []*resp.Message, i int) bool {
+				return i%2 == 1 && string(elems[i-1].Bytes) == "passwords"
+			}
+		case "LIST":
+			// rules of every user, such as "user default on #<hash> ~* +@all"
+			secret = func(elems []*resp.Message, i int) bool {
+				return true
+			}
+		}
+	}
+	var redact func(m *resp.Message, masked bool) *resp.Message
+	redact = func(m *resp.Message, masked bool) *resp.Message {
+		if m == nil {
+			return nil
+		}
+		out := *m
+		switch m.Type {
+		case resp.ArrayHeader:
+			out.Array = make([]*resp.Message, len(m.Array))
+			for i, elem := range m.Array {
+				out.Array[i] = redact(elem, masked || (m == msg && secret(m.Array, i)))
+			}
+		case resp.BulkHeader:
+			if m.Bytes == nil {
+				break
+			}
+			if masked && strings.ToUpper(cmd.Name()) == "ACL" && sub == "LIST" {
+				out.Bytes = []byte(maskACLRules(string(m.Bytes), rc))
+			} else if masked {
+				out.Bytes = []byte(rc.mask())
+			} else {
+				out.Bytes = []byte(rc.Scrub(string(m.Bytes)))
+			}
+		case resp.StringHeader:
+			out.Status = rc.Scrub(m.Status)
+		case resp.ErrorHeader:
+			if m.Error != nil {
+				out.Error = errors.New(rc.Scrub(m.Error.Error()))
+			}
+		}
+		return &out
+	}
+	return redact(msg, false)
+}
+
+// maskACLRules masks password rules in a user line of ACL LIST
+func maskACLRules(line string, rc *RedactConfig) string {
+	rules := strings.Fields(line)
+	for i, rule := range rules {
+		if rule != "" && strings.ContainsRune("><#!", rune(rule[0])) {
+			rules[i] = rule[:1] + rc.mask()
+		}
+	}
+	return rc.Scrub(strings.Join(rules, " "))
+}
+
+// redactResult redacts recorded params, request and reply of a result before
+// it is handed to hubs.
+func redactResult(result map[string]interface{}, cmd *Command, replyRD *RespData, rc *RedactConfig) {
+	_, hasParams := result[AnalyzeParams]
+	_, hasRequest := result[AnalyzeRequest]
+	_, hasReply := result[AnalyzeReply]
+	if !hasParams && !hasRequest && !hasReply {
+		return
+	}
+	args, changed := RedactArgs(cmd, rc)
+	if hasParams {
+		result[AnalyzeParams] = args[1:]
+	}
+	if hasRequest && changed {
+		msg := &resp.Message{Type: resp.ArrayHeader, Array: make([]*resp.Message, len(args))}
+		for i, arg := range args {
+			msg.Array[i] = &resp.Message{Type: resp.BulkHeader, Bytes: []byte(arg)}
+		}
+		// ignore error
+		raw, _ := resp.Marshal(msg)
+		result[AnalyzeRequest] = string(raw)
+	}
+	if hasReply && replyRD != nil {
+		// ignore error
+		raw, _ := resp.Marshal(redactReplyMsg(cmd, replyRD.Msg, rc))
+		result[AnalyzeReply] = string(raw)
+	}
+}
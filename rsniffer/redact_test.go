@@ -0,0 +1,189 @@
+package rsniffer
+
+import (
+	"github.com/amyangfei/resp-go/resp"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestParseRedactRule(t *testing.T) {
+	tests := []struct {
+		rule string
+		want *RedactRule
+		err  bool
+	}{
+		{"mask:set", &RedactRule{Command: "SET"}, false},
+		{"hash:SET:2", &RedactRule{Command: "SET", Args: []int{2}, Hash: true}, false},
+		{"mask:HSET:-1,2", &RedactRule{Command: "HSET", Args: []int{-1, 2}}, false},
+		{"mask", nil, true},
+		{"mask:", nil, true},
+		{"drop:SET", nil, true},
+		{"mask:SET:0", nil, true},
+		{"mask:SET:a", nil, true},
+		{"mask:SET:1,", nil, true},
+	}
+	for _, tt := range tests {
+		rr, err := ParseRedactRule(tt.rule)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseRedactRule(%q) error = %v, want error %v", tt.rule, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(rr, tt.want) {
+			t.Errorf("ParseRedactRule(%q) = %+v, want %+v", tt.rule, rr, tt.want)
+		}
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	rc := &RedactConfig{
+		Mask:    "xx",
+		HashKey: "key",
+		Rules: []*RedactRule{
+			{Command: "SET", Args: []int{2}, Hash: true},
+			{Command: "HSET", Args: []int{-1}},
+			{Command: "ECHO"},
+		},
+		Patterns: []*regexp.Regexp{regexp.MustCompile(`[a-z]+@example\.com`)},
+	}
+	hashed := rc.hash("secret")
+	tests := []struct {
+		rc      *RedactConfig
+		args    []string
+		want    []string
+		changed bool
+	}{
+		// built-in credential positions
+		{nil, []string{"AUTH", "pw"}, []string{"AUTH", DefaultRedactMask}, true},
+		{nil, []string{"auth", "user", "pw"}, []string{"auth", "user", DefaultRedactMask}, true},
+		{nil, []string{"HELLO", "3", "AUTH", "user", "pw"}, []string{"HELLO", "3", "AUTH", "user", DefaultRedactMask}, true},
+		{nil, []string{"HELLO", "3", "AUTH", "user", "pw", "SETNAME", "c"}, []string{"HELLO", "3", "AUTH", "user", DefaultRedactMask, "SETNAME", "c"}, true},
+		{nil, []string{"HELLO", "3", "SETNAME", "c"}, []string{"HELLO", "3", "SETNAME", "c"}, false},
+		{nil, []string{"MIGRATE", "h", "6379", "k", "0", "1000", "AUTH", "pw"},
+			[]string{"MIGRATE", "h", "6379", "k", "0", "1000", "AUTH", DefaultRedactMask}, true},
+		{nil, []string{"MIGRATE", "h", "6379", "", "0", "1000", "AUTH2", "user", "pw", "KEYS", "a"},
+			[]string{"MIGRATE", "h", "6379", "", "0", "1000", "AUTH2", "user", DefaultRedactMask, "KEYS", "a"}, true},
+		{nil, []string{"MIGRATE", "h", "6379", "k", "0", "1000", "COPY"}, []string{"MIGRATE", "h", "6379", "k", "0", "1000", "COPY"}, false},
+		{nil, []string{"ACL", "SETUSER", "u", "on", ">pw", "#abc", "~*", "+@all"},
+			[]string{"ACL", "SETUSER", "u", "on", DefaultRedactMask, DefaultRedactMask, "~*", "+@all"}, true},
+		{nil, []string{"ACL", "DELUSER", ">u"}, []string{"ACL", "DELUSER", ">u"}, false},
+		{nil, []string{"CONFIG", "SET", "maxmemory", "1gb", "requirepass", "pw"},
+			[]string{"CONFIG", "SET", "maxmemory", "1gb", "requirepass", DefaultRedactMask}, true},
+		{nil, []string{"CONFIG", "GET", "requirepass"}, []string{"CONFIG", "GET", "requirepass"}, false},
+		{nil, []string{"SENTINEL", "SET", "m", "quorum", "2", "auth-pass", "pw"},
+			[]string{"SENTINEL", "SET", "m", "quorum", "2", "auth-pass", DefaultRedactMask}, true},
+		{nil, []string{"GET", "foo"}, []string{"GET", "foo"}, false},
+		// custom mask, rules and patterns
+		{rc, []string{"AUTH", "pw"}, []string{"AUTH", "xx"}, true},
+		{rc, []string{"SET", "foo", "secret"}, []string{"SET", "foo", hashed}, true},
+		{rc, []string{"set", "foo"}, []string{"set", "foo"}, false},
+		{rc, []string{"HSET", "h", "f1", "v1", "f2", "v2"}, []string{"HSET", "h", "f1", "v1", "f2", "xx"}, true},
+		{rc, []string{"ECHO", "a", "b"}, []string{"ECHO", "xx", "xx"}, true},
+		{rc, []string{"GET", "bob@example.com"}, []string{"GET", "xx"}, true},
+		{rc, []string{"SET", "mail:bob@example.com", "secret"}, []string{"SET", "mail:xx", hashed}, true},
+		{rc, []string{"GET", "foo"}, []string{"GET", "foo"}, false},
+	}
+	for _, tt := range tests {
+		cmd, err := NewCommand(tt.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args, changed := RedactArgs(cmd, tt.rc)
+		if !reflect.DeepEqual(args, tt.want) || changed != tt.changed {
+			t.Errorf("RedactArgs(%q) = %q, %v, want %q, %v", tt.args, args, changed, tt.want, tt.changed)
+		}
+		if tt.changed && reflect.DeepEqual(cmd.Args, args) {
+			t.Errorf("RedactArgs(%q) modified args of command", tt.args)
+		}
+	}
+	if h := rc.hash("secret"); h != hashed || len(h) != len("hash:")+16 {
+		t.Errorf("hash is %q, want stable %q of 8 bytes", h, hashed)
+	}
+	if (&RedactConfig{HashKey: "other"}).hash("secret") == hashed {
+		t.Error("hash does not depend on key")
+	}
+}
+
+func bulkArray(elems ...string) *resp.Message {
+	msg := &resp.Message{Type: resp.ArrayHeader, Array: make([]*resp.Message, len(elems))}
+	for i, elem := range elems {
+		msg.Array[i] = &resp.Message{Type: resp.BulkHeader, Bytes: []byte(elem)}
+	}
+	return msg
+}
+
+func bulkStrings(msg *resp.Message) []string {
+	elems := make([]string, len(msg.Array))
+	for i, elem := range msg.Array {
+		elems[i] = string(elem.Bytes)
+	}
+	return elems
+}
+
+func TestRedactReplyMsg(t *testing.T) {
+	rc := &RedactConfig{Patterns: []*regexp.Regexp{regexp.MustCompile(`[a-z]+@example\.com`)}}
+	tests := []struct {
+		rc    *RedactConfig
+		args  []string
+		reply []string
+		want  []string
+	}{
+		{nil, []string{"CONFIG", "GET", "*"},
+			[]string{"maxmemory", "0", "requirepass", "pw", "masterauth", "mpw"},
+			[]string{"maxmemory", "0", "requirepass", DefaultRedactMask, "masterauth", DefaultRedactMask}},
+		{nil, []string{"CONFIG", "GET", "requirepass"},
+			[]string{"requirepass", ""},
+			[]string{"requirepass", DefaultRedactMask}},
+		{nil, []string{"ACL", "LIST"},
+			[]string{"user default on #abc ~* +@all", "user bob on >pw <old !def resetkeys"},
+			[]string{"user default on #" + DefaultRedactMask + " ~* +@all", "user bob on >" + DefaultRedactMask + " <" + DefaultRedactMask + " !" + DefaultRedactMask + " resetkeys"}},
+		{nil, []string{"ACL", "USERS"},
+			[]string{"default", "bob"},
+			[]string{"default", "bob"}},
+		{nil, []string{"LRANGE", "l", "0", "-1"},
+			[]string{"requirepass", "pw"},
+			[]string{"requirepass", "pw"}},
+		{rc, []string{"LRANGE", "l", "0", "-1"},
+			[]string{"bob@example.com", "to:amy@example.com"},
+			[]string{DefaultRedactMask, "to:" + DefaultRedactMask}},
+	}
+	for _, tt := range tests {
+		cmd, _ := NewCommand(tt.args...)
+		msg := bulkArray(tt.reply...)
+		out := redactReplyMsg(cmd, msg, tt.rc)
+		if got := bulkStrings(out); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("redactReplyMsg(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+		if got := bulkStrings(msg); !reflect.DeepEqual(got, tt.reply) {
+			t.Errorf("redactReplyMsg(%q) modified reply to %q", tt.args, got)
+		}
+	}
+}
+
+func TestRedactReplyMsgGetUser(t *testing.T) {
+	cmd, _ := NewCommand("ACL", "GETUSER", "bob")
+	msg := &resp.Message{Type: resp.ArrayHeader, Array: []*resp.Message{
+		{Type: resp.BulkHeader, Bytes: []byte("flags")},
+		bulkArray("on"),
+		{Type: resp.BulkHeader, Bytes: []byte("passwords")},
+		bulkArray("hash1", "hash2"),
+	}}
+	out := redactReplyMsg(cmd, msg, nil)
+	if got := bulkStrings(out.Array[1]); !reflect.DeepEqual(got, []string{"on"}) {
+		t.Errorf("flags = %q, want unchanged", got)
+	}
+	if got := bulkStrings(out.Array[3]); !reflect.DeepEqual(got, []string{DefaultRedactMask, DefaultRedactMask}) {
+		t.Errorf("passwords = %q, want masked", got)
+	}
+	if got := bulkStrings(msg.Array[3]); !reflect.DeepEqual(got, []string{"hash1", "hash2"}) {
+		t.Errorf("reply is modified to %q", got)
+	}
+
+	errMsg := &resp.Message{Type: resp.ErrorHeader}
+	if out := redactReplyMsg(cmd, errMsg, nil); out.Type != resp.ErrorHeader {
+		t.Errorf("error reply type = %v", out.Type)
+	}
+	if redactReplyMsg(cmd, nil, nil) != nil {
+		t.Error("nil reply is not kept")
+	}
+}
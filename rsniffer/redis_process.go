@@ -1,6 +1,7 @@
 package rsniffer
 
 import (
+	"bytes"
 	"crypto/md5"
 	"fmt"
 	"github.com/amyangfei/resp-go/resp"
@@ -13,9 +14,28 @@ import (
 )
 
 type AnalyzeConfig struct {
-	ReadHitAnalyze bool  // whether analyze hit/miss of readreply command
-	SaveCmdTypes   []int // command types that will be recorded
-	SaveDetail     int   // record detail: cmd only, with params or with reply
+	ReadHitAnalyze bool              // whether analyze hit/miss of readreply command
+	ReplStream     bool              // whether decode replication stream of replicas into events
+	SaveCmdTypes   []int             // command types that will be recorded
+	SaveDetail     int               // record detail: cmd only, with params or with reply
+	RecordRules    []*RecordRule     // per command and key pattern record detail, first match wins over SaveCmdTypes and SaveDetail
+	BigKey         *BigKeyConfig     // big key detection, disabled if nil
+	KeyPattern     *KeyPatternConfig // key pattern aggregation, disabled if nil
+	Channel        *ChannelConfig    // pub/sub channel analytics, disabled if nil
+	Blocking       *BlockingConfig   // blocking command queue statistics, disabled if nil
+	Tracking       *TrackingConfig   // client side caching invalidation analysis, disabled if nil
+	Cluster        *ClusterConfig    // redis cluster slot and redirection analysis, disabled if nil
+	Sentinel       *SentinelConfig   // sentinel client and failover analysis, disabled if nil
+	Error          *ErrorConfig      // per command and per client error rates, disabled if nil
+	Redact         *RedactConfig     // custom redaction of recorded values, credentials are always masked
+	Sampling       *SamplingConfig   // sampling of per command results, all are emitted if nil
+}
+
+type BigKeyConfig struct {
+	MaxBytes    int           // values with more bytes will be reported
+	MaxElements int           // collections with more elements will be reported
+	TopN        int           // keep the N largest keys seen in a window
+	Window      time.Duration // window of the top N largest keys
 }
 
 var BasicAnalyzeConfig *AnalyzeConfig = &AnalyzeConfig{
@@ -25,22 +45,32 @@ var BasicAnalyzeConfig *AnalyzeConfig = &AnalyzeConfig{
 }
 
 type RedSession struct {
-	ID      []byte
-	Counter int
-	Created int64
-	SrcIP   net.IP
-	DstIP   net.IP
-	SrcPort layers.TCPPort
-	DstPort layers.TCPPort
-	RBuf    []byte // data buffer for request from client to redis
-	WBuf    []byte // data buffer for reply from redis to client
-	REnd    int    // the last process byte index of RBuf
-	WEnd    int    // the last process byte index of WBuf
-	mu      sync.Mutex
+	ID         []byte
+	Counter    int
+	Created    int64
+	SrcIP      net.IP
+	DstIP      net.IP
+	SrcPort    layers.TCPPort
+	DstPort    layers.TCPPort
+	ClientAddr string      // client address overriding SrcIP and SrcPort, e.g. unix socket client
+	ServerAddr string      // server address overriding DstIP and DstPort
+	RBuf       []byte      // data buffer for request from client to redis
+	WBuf       []byte      // data buffer for reply from redis to client
+	REnd       int         // the last process byte index of RBuf
+	WEnd       int         // the last process byte index of WBuf
+	RTime      time.Time   // capture time of the last request data
+	WTime      time.Time   // capture time of the last reply data
+	repl       *replStream // replication stream of replica connection, nil if not
+	replFrames []*RespData // frames of sync reply and RDB not returned by GetRespData yet
+	syncScan   int         // bytes of RBuf checked for SYNC and PSYNC on capture side
+	lastSeen   time.Time   // capture time of the last packet, for eviction of idle session
+	pending    int32       // whether the session is queued in Shards, accessed atomically
+	mu         sync.Mutex
 }
 
 type RedSessionPool struct {
-	sessions map[string]*RedSession
+	sessions  map[string]*RedSession
+	lastEvict time.Time
 }
 
 func NewRedSessionPool() *RedSessionPool {
@@ -49,26 +79,33 @@ func NewRedSessionPool() *RedSessionPool {
 	}
 }
 
-func (sp *RedSessionPool) GetRedSession(tcpMeta *TCPMeta, cfg *SniffConfig) *RedSession {
+func (sp *RedSessionPool) GetRedSession(tcpMeta *TCPMeta, toServer bool, cfg *SniffConfig) *RedSession {
 	if tcpMeta == nil {
 		return nil
 	}
-	key := TCPIdentify(tcpMeta, cfg.Host, cfg.Port)
+	key := TCPIdentify(tcpMeta, toServer)
 	if _, ok := sp.sessions[key]; !ok {
-		now := time.Now().Unix()
-		h := md5.New()
-		idstr := fmt.Sprintf("%s-%d", key, now)
-		h.Write([]byte(idstr))
+		bufSize := sessionBufSize(cfg)
+		// SrcIP and SrcPort always point to the client side
+		cliMeta := tcpMeta
+		if !toServer {
+			cliMeta = &TCPMeta{
+				SrcIP:   tcpMeta.DstIP,
+				DstIP:   tcpMeta.SrcIP,
+				SrcPort: tcpMeta.DstPort,
+				DstPort: tcpMeta.SrcPort,
+			}
+		}
 		sp.sessions[key] = &RedSession{
-			ID:      h.Sum(nil),
+			ID:      sessionID(key),
 			Counter: 0,
 			Created: time.Now().Unix(),
-			SrcIP:   tcpMeta.SrcIP,
-			DstIP:   tcpMeta.DstIP,
-			SrcPort: tcpMeta.SrcPort,
-			DstPort: tcpMeta.DstPort,
-			RBuf:    make([]byte, cfg.Snaplen*2),
-			WBuf:    make([]byte, cfg.Snaplen*2),
+			SrcIP:   cliMeta.SrcIP,
+			DstIP:   cliMeta.DstIP,
+			SrcPort: cliMeta.SrcPort,
+			DstPort: cliMeta.DstPort,
+			RBuf:    make([]byte, bufSize),
+			WBuf:    make([]byte, bufSize),
 			REnd:    0,
 			WEnd:    0,
 		}
@@ -78,43 +115,84 @@ func (sp *RedSessionPool) GetRedSession(tcpMeta *TCPMeta, cfg *SniffConfig) *Red
 	return session
 }
 
+// sessionID returns a unique id of redis session identified by key
+func sessionID(key string) []byte {
+	h := md5.New()
+	idstr := fmt.Sprintf("%s-%d", key, time.Now().Unix())
+	h.Write([]byte(idstr))
+	return h.Sum(nil)
+}
+
+func sessionBufSize(cfg *SniffConfig) int {
+	bufSize := int(cfg.Snaplen * 2)
+	if cfg.MaxBufSize > bufSize {
+		bufSize = cfg.MaxBufSize
+	}
+	return bufSize
+}
+
 func (sp *RedSessionPool) RemoveRedSession(key string) {
 	delete(sp.sessions, key)
 }
 
+// Evict removes and returns sessions without packet for idle, such as those
+// whose FIN is not captured. Sessions are checked at most every idle/10.
+func (sp *RedSessionPool) Evict(now time.Time, idle time.Duration) []*RedSession {
+	if idle <= 0 || now.Sub(sp.lastEvict) < idle/10 {
+		return nil
+	}
+	sp.lastEvict = now
+	evicted := make([]*RedSession, 0)
+	for key, rs := range sp.sessions {
+		if now.Sub(rs.lastSeen) >= idle {
+			delete(sp.sessions, key)
+			evicted = append(evicted, rs)
+		}
+	}
+	return evicted
+}
+
 func PacketProcess(packet gopacket.Packet, sp *RedSessionPool, cfg *SniffConfig) (*RedSession, error) {
-	tcpLayer := packet.Layer(layers.LayerTypeTCP)
-	ipLayer := packet.Layer(layers.LayerTypeIPv4)
-	var tcpMeta *TCPMeta = nil
-	if tcpLayer != nil && ipLayer != nil {
-		tcp, _ := tcpLayer.(*layers.TCP)
-		ip, _ := ipLayer.(*layers.IPv4)
-		tcpMeta = &TCPMeta{
-			SrcIP:   ip.SrcIP,
-			DstIP:   ip.DstIP,
-			SrcPort: tcp.SrcPort,
-			DstPort: tcp.DstPort,
+	tcpMeta, tcp := packetTCPMeta(packet)
+	if tcpMeta == nil {
+		return nil, nil
+	}
+	fromCliToRedis, ok := cfg.Direction(tcpMeta)
+	if !ok {
+		// neither side is a sniffed redis server
+		return nil, nil
+	}
+	ts := packet.Metadata().Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	if tcp.FIN || tcp.RST {
+		sessionKey := TCPIdentify(tcpMeta, fromCliToRedis)
+		session, ok := sp.sessions[sessionKey]
+		if !ok {
+			// no data is captured, or closed by the other side already
+			return nil, nil
 		}
-		if tcp.FIN {
-			sessionKey := TCPIdentify(tcpMeta, cfg.Host, cfg.Port)
-			sp.RemoveRedSession(sessionKey)
-			return nil, RedSessionCloseErr
+		sp.RemoveRedSession(sessionKey)
+		if tcp.RST {
+			return nil, newSessionEvent(SessionReset, session, nil, ts)
 		}
+		return nil, newSessionEvent(SessionClose, session, nil, ts)
 	}
 
 	// Check application Layer
 	applicationLayer := packet.ApplicationLayer()
 	if applicationLayer != nil {
-		session := sp.GetRedSession(tcpMeta, cfg)
-		fromCliToRedis := tcpMeta.FromSrcToDst(cfg.Host, cfg.Port)
+		session := sp.GetRedSession(tcpMeta, fromCliToRedis, cfg)
+		session.lastSeen = ts
 		payload := applicationLayer.Payload()
 		if fromCliToRedis {
-			err := session.AppendRequestData(payload)
+			err := session.AppendRequestData(payload, ts)
 			if err != nil {
 				return nil, err
 			}
 		} else {
-			err := session.AppendReplyData(payload)
+			err := session.AppendReplyData(payload, ts)
 			if err != nil {
 				return nil, err
 			}
@@ -124,96 +202,255 @@ func PacketProcess(packet gopacket.Packet, sp *RedSessionPool, cfg *SniffConfig)
 	return nil, nil
 }
 
-func (rs *RedSession) AppendRequestData(payload []byte) error {
+// Client returns the address of redis client of this session
+func (rs *RedSession) Client() string {
+	if rs.ClientAddr != "" {
+		return rs.ClientAddr
+	}
+	return hostPort(rs.SrcIP, rs.SrcPort)
+}
+
+// Server returns the address of redis server of this session
+func (rs *RedSession) Server() string {
+	if rs.ServerAddr != "" {
+		return rs.ServerAddr
+	}
+	return hostPort(rs.DstIP, rs.DstPort)
+}
+
+func (rs *RedSession) AppendRequestData(payload []byte, ts time.Time) error {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 	if rs.REnd+len(payload) > len(rs.RBuf) {
-		return fmt.Errorf("data %d exceed max RBuf size", rs.REnd+len(payload))
+		// drop buffered data, the session resyncs with later data
+		err := fmt.Errorf("data %d exceed max RBuf size", rs.REnd+len(payload))
+		rs.REnd = 0
+		rs.syncScan = 0
+		return newSessionEvent(SessionOverflow, rs, err, ts)
 	}
 	// TODO: no copy support?
 	copy(rs.RBuf[rs.REnd:], payload)
 	rs.REnd += len(payload)
+	rs.RTime = ts
+	rs.detectSync()
 	return nil
 }
 
-func (rs *RedSession) AppendReplyData(payload []byte) error {
+// AppendReplyData buffers reply data. Sync reply of a replica connection is
+// scanned here instead of by GetRespData, so that RDB payload is counted and
+// dropped as it is captured even if the session is not analyzed in time.
+func (rs *RedSession) AppendReplyData(payload []byte, ts time.Time) error {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
+	for rs.repl != nil && rs.repl.state != replCommands && len(payload) > 0 {
+		if rs.repl.state == replRDB {
+			// RDB payload may be far larger than WBuf
+			payload = payload[rs.repl.consumeRDB(payload):]
+		} else {
+			// lines before RDB payload are short, buffer a line at a time so
+			// that RDB header is parsed before its payload is buffered
+			n := bytes.IndexByte(payload, '\n') + 1
+			if n == 0 {
+				n = len(payload)
+			}
+			if err := rs.bufferReply(payload[:n], ts); err != nil {
+				return err
+			}
+			payload = payload[n:]
+		}
+		rs.scanRepl(ts)
+	}
+	return rs.bufferReply(payload, ts)
+}
+
+func (rs *RedSession) bufferReply(payload []byte, ts time.Time) error {
 	if rs.WEnd+len(payload) > len(rs.WBuf) {
-		return fmt.Errorf("data %d exceed max WBuf size", rs.WEnd+len(payload))
+		err := fmt.Errorf("data %d exceed max WBuf size", rs.WEnd+len(payload))
+		rs.WEnd = 0
+		return newSessionEvent(SessionOverflow, rs, err, ts)
 	}
 	// TODO: no copy support?
 	copy(rs.WBuf[rs.WEnd:], payload)
 	rs.WEnd += len(payload)
+	rs.WTime = ts
 	return nil
 }
 
+// GetRespData decodes buffered requests and replies, undecodable data is
+// dropped and a SessionDesync event is returned together with data decoded.
 func (rs *RedSession) GetRespData() (request, reply []*RespData, err error) {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
 
-	reqMsgs, pos, err := resp.Decode(rs.RBuf[0:rs.REnd])
+	var desync error
+
+	// decode from a copy, messages may refer to the decoded bytes while the
+	// buffer is refilled by the sniffer goroutine
+	reqMsgs, pos, err := resp.Decode(append([]byte(nil), rs.RBuf[0:rs.REnd]...))
 	request = make([]*RespData, 0)
 	for _, msg := range reqMsgs {
-		request = append(request, &RespData{Msg: msg})
+		request = append(request, &RespData{Msg: msg, Time: rs.RTime})
+	}
+	if malformedRequest(rs.RBuf[pos:rs.REnd]) {
+		desync = fmt.Errorf("%d bytes of request dropped", rs.REnd-pos)
+		pos = rs.REnd
 	}
 	copy(rs.RBuf, rs.RBuf[pos:rs.REnd])
 	rs.REnd = rs.REnd - pos
+	if rs.syncScan -= pos; rs.syncScan < 0 {
+		rs.syncScan = 0
+	}
 
-	replyMsgs, pos, err := resp.Decode(rs.WBuf[0:rs.WEnd])
-	reply = make([]*RespData, 0)
-	for _, msg := range replyMsgs {
-		reply = append(reply, &RespData{Msg: msg})
+	// replica connection replies sync and RDB payload before the stream of
+	// propagated commands, which is decoded as normal replies. Frames of them
+	// are scanned when captured, see AppendReplyData.
+	if rs.repl != nil && rs.repl.state != replCommands {
+		rs.scanRepl(rs.WTime)
+	}
+	reply = append(make([]*RespData, 0), rs.replFrames...)
+	rs.replFrames = nil
+	if rs.repl != nil && rs.repl.state != replCommands {
+		return request, reply, rs.desyncEvent(desync)
+	}
+
+	// replies of RESP3 client are converted to RESP2 first
+	replyBuf, push, pos, err := resp3ToResp2(rs.WBuf[0:rs.WEnd])
+	if err != nil {
+		desync = fmt.Errorf("%d bytes of reply dropped", rs.WEnd-pos)
+		pos = rs.WEnd
+	}
+	replyMsgs, _, _ := resp.Decode(replyBuf)
+	for idx, msg := range replyMsgs {
+		rd := &RespData{Msg: msg, Time: rs.WTime}
+		if idx < len(push) {
+			rd.Push = push[idx]
+		}
+		if rs.repl != nil {
+			rd.Repl = ReplCmd
+		}
+		reply = append(reply, rd)
 	}
-	copy(rs.WBuf, rs.RBuf[pos:rs.WEnd])
+	copy(rs.WBuf, rs.WBuf[pos:rs.WEnd])
 	rs.WEnd = rs.WEnd - pos
 
-	return request, reply, nil
+	return request, reply, rs.desyncEvent(desync)
+}
+
+func (rs *RedSession) desyncEvent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return newSessionEvent(SessionDesync, rs, err, time.Now())
+}
+
+// reply shapes of read commands used to tell key hit or miss
+const (
+	hitByBulk     = iota + 1 // nil or empty bulk means miss
+	hitByBulkList            // array of bulks, one for each key or field
+	hitByArray               // empty array means miss
+	hitByInteger             // zero means miss
+)
+
+var readHitShapes = map[string]int{
+	"GET":         hitByBulk,
+	"GETRANGE":    hitByBulk,
+	"HGET":        hitByBulk,
+	"LINDEX":      hitByBulk,
+	"ZSCORE":      hitByBulk,
+	"SRANDMEMBER": hitByBulk,
+
+	"MGET":  hitByBulkList,
+	"HMGET": hitByBulkList,
+
+	"HGETALL":       hitByArray,
+	"HKEYS":         hitByArray,
+	"HVALS":         hitByArray,
+	"LRANGE":        hitByArray,
+	"SMEMBERS":      hitByArray,
+	"ZRANGE":        hitByArray,
+	"ZREVRANGE":     hitByArray,
+	"ZRANGEBYSCORE": hitByArray,
+
+	"EXISTS":    hitByInteger,
+	"STRLEN":    hitByInteger,
+	"HEXISTS":   hitByInteger,
+	"HLEN":      hitByInteger,
+	"HSTRLEN":   hitByInteger,
+	"LLEN":      hitByInteger,
+	"SCARD":     hitByInteger,
+	"SISMEMBER": hitByInteger,
+	"ZCARD":     hitByInteger,
+}
+
+func bulkHitStatus(msg *resp.Message) int {
+	if msg.Type != resp.BulkHeader || len(msg.Bytes) == 0 {
+		return KeyMiss
+	}
+	return KeyHit
 }
 
 // cmd: a Command struct represents client request to redis
 // cmdName: name of cmd
 // currRespD: a RespData struct represents the reply from redis
 func KeyHitAnalyze(cmd *Command, cmdName string, currRespD *RespData) []map[string]interface{} {
+	shape, ok := readHitShapes[cmdName]
+	if !ok {
+		return nil
+	}
+	keys := cmd.Keys()
 	stat := make([]map[string]interface{}, 0)
-	// last command is get
-	if cmdName == "GET" {
-		key := ""
-		if len(cmd.Args) > 1 {
-			key = cmd.Args[1]
-		}
-		var status int
-		if currRespD.IsError() {
-			status = KeyError
-		} else if len(currRespD.Msg.Bytes) == 0 {
-			status = KeyMiss
-		} else {
-			status = KeyHit
-		}
+	addStat := func(key string, status int) {
 		stat = append(stat, map[string]interface{}{
 			"key":    key,
 			"status": status,
 		})
-	} else if cmdName == "MGET" {
-		if currRespD.IsError() {
-			stat = append(stat, map[string]interface{}{
-				"key":    "",
-				"status": KeyError,
-			})
+	}
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+	if currRespD.IsError() {
+		for _, key := range keys {
+			addStat(key, KeyError)
+		}
+		return stat
+	}
+
+	switch shape {
+	case hitByBulk:
+		addStat(keys[0], bulkHitStatus(currRespD.Msg))
+	case hitByBulkList:
+		// MGET has a reply for each key, HMGET for each field of one key
+		fieldKeys := keys
+		if cmdName == "HMGET" {
+			fieldKeys = make([]string, 0)
+			for i := 2; i < len(cmd.Args); i++ {
+				fieldKeys = append(fieldKeys, keys[0])
+			}
+		}
+		for idx, key := range fieldKeys {
+			if !currRespD.IsArray() || idx >= len(currRespD.Msg.Array) {
+				addStat(key, KeyError)
+				continue
+			}
+			addStat(key, bulkHitStatus(currRespD.Msg.Array[idx]))
+		}
+	case hitByArray:
+		if currRespD.IsArray() && len(currRespD.Msg.Array) > 0 {
+			addStat(keys[0], KeyHit)
 		} else {
-			for idx, key := range cmd.Args[1:] {
-				var status int
-				if len(currRespD.Msg.Array[idx].Bytes) == 0 {
-					status = KeyMiss
-				} else {
-					status = KeyHit
-				}
-				stat = append(stat, map[string]interface{}{
-					"key":    key,
-					"status": status,
-				})
+			addStat(keys[0], KeyMiss)
+		}
+	case hitByInteger:
+		if !currRespD.IsInteger() || currRespD.Msg.Integer == 0 {
+			for _, key := range keys {
+				addStat(key, KeyMiss)
+			}
+		} else if currRespD.Msg.Integer >= int64(len(keys)) {
+			for _, key := range keys {
+				addStat(key, KeyHit)
 			}
 		}
+		// EXISTS with several keys and partly hit, we can't tell which key hits
 	}
 	if len(stat) == 0 {
 		return nil
@@ -221,42 +458,77 @@ func KeyHitAnalyze(cmd *Command, cmdName string, currRespD *RespData) []map[stri
 	return stat
 }
 
-// RespErrorAnalyze deals with command executes with error
+// addLatency records latency of command, blocking commands have wait time and
+// whether timed out instead, as they are held by redis until served.
+func addLatency(result map[string]interface{}, cmd *Command, lastRespD, currRespD *RespData) {
+	if latency := ServiceLatency(cmd, lastRespD, currRespD); latency >= 0 {
+		result[AnalyzeLatency] = int64(latency / time.Microsecond)
+	}
+	if !cmd.IsBlocking() {
+		return
+	}
+	if wait := BlockingWait(cmd, lastRespD, currRespD); wait >= 0 {
+		result[AnalyzeWait] = int64(wait / time.Microsecond)
+	}
+	if !currRespD.IsError() {
+		result[AnalyzeTimeout] = BlockingTimeout(cmd, currRespD)
+	}
+}
+
+// recordRequest records the raw request with its capture time, so that the
+// request could be replayed with its timing, see cmd/redreplay
+func recordRequest(result map[string]interface{}, reqRD *RespData) {
+	// ignore error
+	raw, _ := reqRD.RawPayload()
+	result[AnalyzeRequest] = string(raw)
+	if !reqRD.Time.IsZero() {
+		result[AnalyzeReqTime] = reqRD.Time.Format(time.RFC3339Nano)
+	}
+}
+
+// RespErrorAnalyze deals with command executes with error, the returned error
+// is a *ReplyError classified by its code
 func RespErrorAnalyze(lastRespD, currRespD *RespData, config *AnalyzeConfig) (map[string]interface{}, error) {
 	cmd, err := lastRespD.GetCommand()
 	if err != nil {
 		return nil, err
 	}
 	cmdName := strings.ToUpper(cmd.Name())
+	replyErr := ClassifyReplyError(currRespD.Msg.Error)
 	cmdType, ok := RedisCmds[cmdName]
 	if !ok {
-		return nil, currRespD.Msg.Error
+		return nil, replyErr
+	}
+	detail, rule, ok := config.recordDetail(cmd, cmdType)
+	if !ok {
+		return nil, replyErr
 	}
 	result := make(map[string]interface{})
-	for _, saveCmdType := range config.SaveCmdTypes {
-		if cmdType == saveCmdType {
-			switch config.SaveDetail {
-			case RecordRequest:
-				// ignore error
-				raw, _ := lastRespD.RawPayload()
-				result[AnalyzeRequest] = string(raw)
-				fallthrough
-			case RecordReply:
-				// ignore error
-				raw, _ := currRespD.RawPayload()
-				result[AnalyzeReply] = string(raw)
-				fallthrough
-			case RecordParams:
-				result[AnalyzeParams] = cmd.Args[1:]
-				fallthrough
-			case RecordCmdOnly:
-				result[AnalyzeCmd] = cmdName
-				result[AnalyzeCmdType] = cmdType
-			}
-			return result, currRespD.Msg.Error
+	switch detail {
+	case RecordRequest:
+		recordRequest(result, lastRespD)
+		fallthrough
+	case RecordReply:
+		if rule.keepReply(currRespD) {
+			// ignore error
+			raw, _ := currRespD.RawPayload()
+			result[AnalyzeReply] = string(raw)
 		}
+		fallthrough
+	case RecordParams:
+		result[AnalyzeParams] = cmd.Args[1:]
+		fallthrough
+	case RecordCmdOnly:
+		result[AnalyzeCmd] = cmdName
+		result[AnalyzeCmdType] = cmdType
 	}
-	return nil, currRespD.Msg.Error
+	redactResult(result, cmd, currRespD, config.Redact)
+	addLatency(result, cmd, lastRespD, currRespD)
+	if config.Cluster != nil {
+		addCluster(result, cmd, currRespD)
+	}
+	result[AnalyzeErrCode] = replyErr.Code
+	return result, replyErr
 }
 
 // RespDataAnalyze deals with command executes normaly
@@ -271,34 +543,90 @@ func RespDataAnalyze(lastRespD, currRespD *RespData, config *AnalyzeConfig) (map
 		return nil, nil
 	}
 	result := make(map[string]interface{})
-	for _, saveCmdType := range config.SaveCmdTypes {
-		if cmdType == saveCmdType {
-			switch config.SaveDetail {
-			case RecordRequest:
-				// ignore error
-				raw, _ := lastRespD.RawPayload()
-				result[AnalyzeRequest] = string(raw)
-				fallthrough
-			case RecordReply:
-				// ignore error
-				raw, _ := currRespD.RawPayload()
-				result[AnalyzeReply] = string(raw)
-				fallthrough
-			case RecordParams:
-				result[AnalyzeParams] = cmd.Args[1:]
-				fallthrough
-			case RecordCmdOnly:
-				result[AnalyzeCmd] = cmdName
-				result[AnalyzeCmdType] = cmdType
-			}
-			if config.ReadHitAnalyze && cmdType == RedisCmdRead {
-				stat := KeyHitAnalyze(cmd, cmdName, currRespD)
-				if stat != nil {
-					result[AnalyzeStat] = stat
-				}
-			}
-			break
+	detail, rule, ok := config.recordDetail(cmd, cmdType)
+	if !ok {
+		return result, nil
+	}
+	switch detail {
+	case RecordRequest:
+		recordRequest(result, lastRespD)
+		fallthrough
+	case RecordReply:
+		if rule.keepReply(currRespD) {
+			// ignore error
+			raw, _ := currRespD.RawPayload()
+			result[AnalyzeReply] = string(raw)
+		}
+		fallthrough
+	case RecordParams:
+		result[AnalyzeParams] = cmd.Args[1:]
+		fallthrough
+	case RecordCmdOnly:
+		result[AnalyzeCmd] = cmdName
+		result[AnalyzeCmdType] = cmdType
+	}
+	redactResult(result, cmd, currRespD, config.Redact)
+	addLatency(result, cmd, lastRespD, currRespD)
+	if config.Cluster != nil {
+		addCluster(result, cmd, currRespD)
+	}
+	if config.ReadHitAnalyze && cmdType == RedisCmdRead {
+		stat := KeyHitAnalyze(cmd, cmdName, currRespD)
+		if stat != nil {
+			result[AnalyzeStat] = stat
 		}
 	}
 	return result, nil
 }
+
+// requestAnalyze records a command which has no reply to analyze, ok is
+// false if the command is not recorded
+func requestAnalyze(lastRespD *RespData, config *AnalyzeConfig) (result map[string]interface{}, ok bool, err error) {
+	cmd, err := lastRespD.GetCommand()
+	if err != nil {
+		return nil, false, err
+	}
+	cmdName := strings.ToUpper(cmd.Name())
+	cmdType, ok := RedisCmds[cmdName]
+	if !ok {
+		return nil, false, nil
+	}
+	result = make(map[string]interface{})
+	detail, _, ok := config.recordDetail(cmd, cmdType)
+	if !ok {
+		return result, false, nil
+	}
+	switch detail {
+	case RecordRequest:
+		recordRequest(result, lastRespD)
+		fallthrough
+	case RecordReply, RecordParams:
+		result[AnalyzeParams] = cmd.Args[1:]
+		fallthrough
+	case RecordCmdOnly:
+		result[AnalyzeCmd] = cmdName
+		result[AnalyzeCmdType] = cmdType
+	}
+	redactResult(result, cmd, nil, config.Redact)
+	return result, true, nil
+}
+
+// NoReplyAnalyze deals with command which redis doesn't reply, such as
+// commands sent after CLIENT REPLY OFF
+func NoReplyAnalyze(lastRespD *RespData, config *AnalyzeConfig) (map[string]interface{}, error) {
+	result, ok, err := requestAnalyze(lastRespD, config)
+	if ok {
+		result[AnalyzeNoReply] = true
+	}
+	return result, err
+}
+
+// PropagatedAnalyze deals with command propagated by master in replication
+// stream, they are executed by replica without reply.
+func PropagatedAnalyze(cmdRespD *RespData, config *AnalyzeConfig) (map[string]interface{}, error) {
+	result, ok, err := requestAnalyze(cmdRespD, config)
+	if ok {
+		result[AnalyzeSource] = SourceReplication
+	}
+	return result, err
+}
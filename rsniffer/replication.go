@@ -0,0 +1,206 @@
+package rsniffer
+
+import (
+	"bytes"
+	"github.com/amyangfei/resp-go/resp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kinds of frames in replication stream, see RespData.Repl
+const (
+	ReplRDB = iota + 1 // RDB payload of full resync, Msg is an integer of its size
+	ReplCmd            // command propagated by master
+)
+
+// states of the reply direction of a replica connection
+const (
+	replWaitSync = iota + 1 // PSYNC or SYNC is sent, waiting for the sync reply
+	replWaitRDB             // full resync, waiting for RDB payload
+	replRDB                 // transferring RDB payload
+	replCommands            // propagating commands
+)
+
+// replStream tracks replication stream of a replica connection, the reply
+// direction becomes RDB payload followed by propagated commands after sync,
+// RDB payload is counted and dropped instead of buffered. It is created and
+// advanced on capture side until propagated commands begin.
+type replStream struct {
+	state   int
+	psync   bool
+	rdbLeft int64  // payload left of disk based transfer
+	eofMark []byte // end mark of diskless transfer, "$EOF:<mark>"
+	tail    []byte // last bytes of diskless payload which may be a part of eofMark
+	rdbSize int64
+	rdbDone bool // RDB frame is not reported yet
+}
+
+// IsSyncCmd tells whether a command starts replication, redis replies it with
+// replication stream instead of a normal reply
+func IsSyncCmd(cmdName string) bool {
+	return cmdName == "PSYNC" || cmdName == "SYNC"
+}
+
+// consumeRDB counts RDB payload in p, it returns bytes of p belonging to RDB.
+func (r *replStream) consumeRDB(p []byte) int {
+	if r.eofMark == nil {
+		n := int64(len(p))
+		if n > r.rdbLeft {
+			n = r.rdbLeft
+		}
+		r.rdbLeft -= n
+		r.rdbSize += n
+		if r.rdbLeft == 0 {
+			r.finishRDB()
+		}
+		return int(n)
+	}
+	data := append(r.tail, p...)
+	if idx := bytes.Index(data, r.eofMark); idx >= 0 {
+		r.rdbSize += int64(idx - len(r.tail))
+		consumed := idx + len(r.eofMark) - len(r.tail)
+		r.tail = nil
+		r.finishRDB()
+		return consumed
+	}
+	r.rdbSize += int64(len(p))
+	keep := len(r.eofMark) - 1
+	if keep > len(data) {
+		keep = len(data)
+	}
+	r.tail = append([]byte(nil), data[len(data)-keep:]...)
+	return len(p)
+}
+
+func (r *replStream) finishRDB() {
+	r.state = replCommands
+	r.rdbDone = true
+}
+
+// rdbHeader parses header line of RDB payload, "$<size>" or "$EOF:<mark>"
+func (r *replStream) rdbHeader(line []byte) bool {
+	if len(line) == 0 || line[0] != '$' {
+		return false
+	}
+	if bytes.HasPrefix(line, []byte("$EOF:")) {
+		r.eofMark = append([]byte(nil), line[len("$EOF:"):]...)
+		r.state = replRDB
+		return len(r.eofMark) > 0
+	}
+	size, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || size < 0 {
+		return false
+	}
+	r.rdbLeft = size
+	r.state = replRDB
+	if size == 0 {
+		r.finishRDB()
+	}
+	return true
+}
+
+// scan consumes sync reply and RDB payload at the beginning of buf, frames
+// are returned until the stream of propagated commands begins, which is left
+// in buf for normal decoding. ok is false if redis refuses to sync and the
+// connection goes back to request and reply.
+func (r *replStream) scan(buf []byte, ts time.Time) (frames []*RespData, pos int, ok bool) {
+	frames = make([]*RespData, 0)
+	for {
+		if r.rdbDone {
+			r.rdbDone = false
+			frames = append(frames, &RespData{
+				Msg:  &resp.Message{Type: resp.IntegerHeader, Integer: r.rdbSize},
+				Time: ts,
+				Repl: ReplRDB,
+			})
+		}
+		if r.state == replCommands || pos >= len(buf) {
+			return frames, pos, true
+		}
+		if r.state == replRDB {
+			pos += r.consumeRDB(buf[pos:])
+			continue
+		}
+		// master sends newlines to keep the connection alive before RDB
+		if buf[pos] == '\n' {
+			pos++
+			continue
+		}
+		line, next, err := resp3Line(buf, pos)
+		if err != nil {
+			return frames, pos, true
+		}
+		switch {
+		case r.state == replWaitRDB || (!r.psync && buf[pos] == '$'):
+			if !r.rdbHeader(line) {
+				return frames, pos, false
+			}
+		case buf[pos] == '+' || buf[pos] == '-':
+			status := string(line[1:])
+			if buf[pos] == '+' && strings.HasPrefix(status, "FULLRESYNC") {
+				r.state = replWaitRDB
+			} else if buf[pos] == '+' && strings.HasPrefix(status, "CONTINUE") {
+				r.state = replCommands
+			}
+			// other replies may be pipelined before PSYNC, such as REPLCONF
+			msgs, _, err := resp.Decode(append([]byte(nil), buf[pos:next]...))
+			if err != nil || len(msgs) != 1 {
+				return frames, pos, false
+			}
+			frames = append(frames, &RespData{Msg: msgs[0], Time: ts})
+			if buf[pos] == '-' && r.state == replWaitSync {
+				// sync is refused, e.g. -NOMASTERLINK
+				return frames, next, false
+			}
+		default:
+			return frames, pos, false
+		}
+		pos = next
+	}
+}
+
+// detectSync starts replication stream of the session when a SYNC or PSYNC
+// request is buffered. It is called on capture side so that the sync reply
+// is scanned as it is captured, rs.mu must be held.
+func (rs *RedSession) detectSync() {
+	data := rs.RBuf[rs.syncScan:rs.REnd]
+	if !containsSync(data) {
+		return
+	}
+	msgs, pos, _ := resp.Decode(append([]byte(nil), data...))
+	for _, msg := range msgs {
+		rd := &RespData{Msg: msg}
+		if cmd, err := rd.GetCommand(); err == nil && IsSyncCmd(strings.ToUpper(cmd.Name())) {
+			rs.repl = &replStream{
+				state: replWaitSync,
+				psync: strings.ToUpper(cmd.Name()) == "PSYNC",
+			}
+		}
+	}
+	rs.syncScan += pos
+}
+
+// containsSync tells whether data contains "SYNC" in any case, it is a cheap
+// check before requests are decoded on capture side
+func containsSync(data []byte) bool {
+	for i := 0; i+4 <= len(data); i++ {
+		if (data[i] == 'S' || data[i] == 's') && bytes.EqualFold(data[i:i+4], []byte("SYNC")) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanRepl scans buffered sync reply of the session, frames are kept until
+// they are returned by GetRespData. Replication stream is dropped if redis
+// refuses to sync, rs.mu must be held.
+func (rs *RedSession) scanRepl(ts time.Time) {
+	frames, pos, ok := rs.repl.scan(rs.WBuf[0:rs.WEnd], ts)
+	rs.replFrames = append(rs.replFrames, frames...)
+	copy(rs.WBuf, rs.WBuf[pos:rs.WEnd])
+	rs.WEnd = rs.WEnd - pos
+	if !ok {
+		rs.repl = nil
+	}
+}
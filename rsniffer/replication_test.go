@@ -0,0 +1,121 @@
+package rsniffer
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSession(bufSize int) *RedSession {
+	return &RedSession{
+		ID:   []byte("replica"),
+		RBuf: make([]byte, bufSize),
+		WBuf: make([]byte, bufSize),
+	}
+}
+
+// appendChunks appends data in chunks as captured packets, no data is
+// analyzed in between as if deliveries of the session are dropped
+func appendChunks(t *testing.T, rs *RedSession, data []byte, size int) {
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := rs.AppendReplyData(data[:n], time.Now()); err != nil {
+			t.Fatalf("append reply: %v", err)
+		}
+		data = data[n:]
+	}
+}
+
+func TestReplicationRDBNotBuffered(t *testing.T) {
+	rdb := bytes.Repeat([]byte("REDIS0009\x00\xff"), 10000)
+	eofMark := strings.Repeat("a", 40)
+	tests := []struct {
+		name    string
+		request string
+		header  string
+		trailer string
+	}{
+		{"psync disk", encodeArgs("REPLCONF", "capa", "psync2") + encodeArgs("PSYNC", "?", "-1"),
+			"+OK\r\n+FULLRESYNC 8de1787ba490483314a4d30f1c628bc5025eb761 0\r\n\n\n$" +
+				strconv.Itoa(len(rdb)) + "\r\n", ""},
+		{"psync diskless", encodeArgs("psync", "?", "-1"),
+			"+FULLRESYNC 8de1787ba490483314a4d30f1c628bc5025eb761 0\r\n$EOF:" + eofMark + "\r\n", eofMark},
+		{"sync", encodeArgs("SYNC"), "$" + strconv.Itoa(len(rdb)) + "\r\n", ""},
+	}
+	for _, tt := range tests {
+		rs := newTestSession(1024)
+		request := tt.request
+		// request split in the middle of the command name
+		split := strings.Index(strings.ToUpper(request), "SYNC") + 2
+		rs.AppendRequestData([]byte(request[:split]), time.Now())
+		rs.AppendRequestData([]byte(request[split:]), time.Now())
+
+		stream := encodeArgs("SELECT", "0") + encodeArgs("SET", "k", "v")
+		data := append([]byte(tt.header), rdb...)
+		data = append(data, tt.trailer...)
+		data = append(data, stream...)
+		appendChunks(t, rs, data, 1400)
+		if rs.WEnd > len(stream) {
+			t.Errorf("%s: %d bytes buffered, RDB payload is buffered", tt.name, rs.WEnd)
+		}
+
+		_, reply, err := rs.GetRespData()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var rdbFrames, cmds int
+		for _, rd := range reply {
+			switch rd.Repl {
+			case ReplRDB:
+				rdbFrames++
+				if rd.Msg.Integer != int64(len(rdb)) {
+					t.Errorf("%s: RDB size %d, want %d", tt.name, rd.Msg.Integer, len(rdb))
+				}
+			case ReplCmd:
+				cmds++
+			}
+		}
+		if rdbFrames != 1 || cmds != 2 {
+			t.Errorf("%s: %d RDB frames and %d commands, want 1 and 2", tt.name, rdbFrames, cmds)
+		}
+	}
+}
+
+func TestReplicationSyncRefused(t *testing.T) {
+	rs := newTestSession(1024)
+	rs.AppendRequestData([]byte(encodeArgs("PSYNC", "?", "-1")+encodeArgs("PING")), time.Now())
+	if rs.repl == nil {
+		t.Fatal("PSYNC is not detected")
+	}
+	rs.AppendReplyData([]byte("-NOMASTERLINK Can't SYNC while not connected with my master\r\n+PONG\r\n"), time.Now())
+	if rs.repl != nil {
+		t.Fatal("replication stream is kept after sync is refused")
+	}
+	request, reply, err := rs.GetRespData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(request) != 2 || len(reply) != 2 || !reply[0].IsError() || reply[1].Repl != 0 {
+		t.Fatalf("got %d requests and %d replies %v", len(request), len(reply), reply)
+	}
+}
+
+func TestDetectSyncIgnoresKeys(t *testing.T) {
+	rs := newTestSession(1024)
+	rs.AppendRequestData([]byte(encodeArgs("GET", "psync")+encodeArgs("SET", "sync:1", "x")), time.Now())
+	if rs.repl != nil {
+		t.Fatal("replication stream is started by keys")
+	}
+	if rs.syncScan != rs.REnd {
+		t.Fatalf("scanned %d of %d bytes", rs.syncScan, rs.REnd)
+	}
+	rs.GetRespData()
+	if rs.syncScan != 0 {
+		t.Fatalf("scanned bytes %d after requests are decoded", rs.syncScan)
+	}
+}
@@ -0,0 +1,114 @@
+package rsniffer
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// codes of error replies, an error reply starts with its code by convention
+const (
+	ErrCodeErr       = "ERR"
+	ErrCodeWrongType = "WRONGTYPE"
+	ErrCodeOOM       = "OOM"
+	ErrCodeNoScript  = "NOSCRIPT"
+	ErrCodeBusy      = "BUSY"
+	ErrCodeLoading   = "LOADING"
+	ErrCodeReadOnly  = "READONLY"
+	ErrCodeMoved     = "MOVED"
+	ErrCodeAsk       = "ASK"
+	ErrCodeNoAuth    = "NOAUTH"
+	ErrCodeNoPerm    = "NOPERM"
+	ErrCodeExecAbort = "EXECABORT"
+	ErrCodeCrossSlot = "CROSSSLOT"
+	ErrCodeCustom    = "CUSTOM"  // code unknown to redis core, e.g. replied by modules
+	ErrCodeUnknown   = "UNKNOWN" // the reply has no code
+)
+
+// RedisErrCodes are error codes replied by redis core, codes not listed are
+// classified as ErrCodeCustom.
+var RedisErrCodes = map[string]bool{
+	ErrCodeErr:       true,
+	ErrCodeWrongType: true,
+	ErrCodeOOM:       true,
+	ErrCodeNoScript:  true,
+	ErrCodeBusy:      true,
+	ErrCodeLoading:   true,
+	ErrCodeReadOnly:  true,
+	ErrCodeMoved:     true,
+	ErrCodeAsk:       true,
+	ErrCodeNoAuth:    true,
+	ErrCodeNoPerm:    true,
+	ErrCodeExecAbort: true,
+	ErrCodeCrossSlot: true,
+
+	"TRYAGAIN":    true,
+	"CLUSTERDOWN": true,
+	"MASTERDOWN":  true,
+	"MISCONF":     true,
+	"NOREPLICAS":  true,
+	"NOGROUP":     true,
+	"BUSYGROUP":   true,
+	"BUSYKEY":     true,
+	"NOTBUSY":     true,
+	"UNBLOCKED":   true,
+	"WRONGPASS":   true,
+	"NOPROTO":     true,
+}
+
+// ErrorConfig enables per command and per client error rate summaries
+type ErrorConfig struct {
+	Window time.Duration // window of error rate summaries
+}
+
+// ReplyError is an error replied by redis to a client request, it is told
+// apart from errors of the sniffer itself.
+type ReplyError struct {
+	Code   string // the error code, ErrCodeCustom if unknown to redis core
+	Prefix string // the first word of the error reply
+	Msg    string // the whole error reply
+}
+
+func (re *ReplyError) Error() string {
+	return re.Msg
+}
+
+// isErrCode tells whether a word looks like an error code, an uppercase word
+// such as "WRONGTYPE" or "ERR_MODULE"
+func isErrCode(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, r := range word {
+		if !unicode.IsUpper(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// ClassifyReplyError returns the typed error of an error reply
+func ClassifyReplyError(err error) *ReplyError {
+	if re, ok := err.(*ReplyError); ok {
+		return re
+	}
+	re := &ReplyError{Code: ErrCodeUnknown}
+	if err == nil {
+		return re
+	}
+	re.Msg = err.Error()
+	prefix := re.Msg
+	if idx := strings.IndexByte(prefix, ' '); idx >= 0 {
+		prefix = prefix[:idx]
+	}
+	if !isErrCode(prefix) {
+		return re
+	}
+	re.Prefix = prefix
+	if RedisErrCodes[prefix] {
+		re.Code = prefix
+	} else {
+		re.Code = ErrCodeCustom
+	}
+	return re
+}
@@ -0,0 +1,150 @@
+package rsniffer
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+var (
+	errResp3Incomplete = errors.New("incomplete resp3 frame")
+	errResp3Malformed  = errors.New("malformed resp3 frame")
+)
+
+// resp3Line returns the line starting at pos without CRLF and the position
+// after CRLF.
+func resp3Line(buf []byte, pos int) ([]byte, int, error) {
+	idx := bytes.Index(buf[pos:], []byte("\r\n"))
+	if idx < 0 {
+		return nil, 0, errResp3Incomplete
+	}
+	return buf[pos : pos+idx], pos + idx + 2, nil
+}
+
+// convertResp3Frame writes the frame at pos to out in RESP2, it returns the
+// position after the frame and whether it is a push frame. Types unknown to
+// RESP2 are converted: push, set and map to array, null to nil bulk, boolean
+// to integer, double, big number and verbatim string to bulk, blob error to
+// error, attributes are dropped.
+func convertResp3Frame(buf []byte, pos int, out *bytes.Buffer) (int, bool, error) {
+	if pos >= len(buf) {
+		return 0, false, errResp3Incomplete
+	}
+	t := buf[pos]
+	line, next, err := resp3Line(buf, pos+1)
+	if err != nil {
+		return 0, false, err
+	}
+	writeBulk := func(data []byte) {
+		out.WriteString("$" + strconv.Itoa(len(data)) + "\r\n")
+		out.Write(data)
+		out.WriteString("\r\n")
+	}
+	switch t {
+	case '+', '-', ':':
+		out.WriteByte(t)
+		out.Write(line)
+		out.WriteString("\r\n")
+	case '_':
+		out.WriteString("$-1\r\n")
+	case '#':
+		if string(line) == "t" {
+			out.WriteString(":1\r\n")
+		} else {
+			out.WriteString(":0\r\n")
+		}
+	case ',':
+		writeBulk(line)
+	case '(':
+		if _, err := strconv.ParseInt(string(line), 10, 64); err == nil {
+			out.WriteString(":" + string(line) + "\r\n")
+		} else {
+			writeBulk(line)
+		}
+	case '$', '=', '!':
+		n, err := strconv.Atoi(string(line))
+		if err != nil {
+			return 0, false, errResp3Malformed
+		}
+		if n < 0 {
+			out.WriteString("$-1\r\n")
+			break
+		}
+		if next+n+2 > len(buf) {
+			return 0, false, errResp3Incomplete
+		}
+		data := buf[next : next+n]
+		next += n + 2
+		if t == '!' {
+			out.WriteString("-" + string(bytes.Replace(data, []byte("\r\n"), []byte(" "), -1)) + "\r\n")
+		} else {
+			writeBulk(data)
+		}
+	case '*', '>', '~', '%', '|':
+		n, err := strconv.Atoi(string(line))
+		if err != nil {
+			return 0, false, errResp3Malformed
+		}
+		if n < 0 {
+			out.WriteString("*-1\r\n")
+			break
+		}
+		if t == '%' || t == '|' {
+			n *= 2
+		}
+		elems := out
+		if t == '|' {
+			// attribute is followed by the real frame
+			elems = &bytes.Buffer{}
+		} else {
+			out.WriteString("*" + strconv.Itoa(n) + "\r\n")
+		}
+		for i := 0; i < n; i++ {
+			if next, _, err = convertResp3Frame(buf, next, elems); err != nil {
+				return 0, false, err
+			}
+		}
+		if t == '|' {
+			return convertResp3Frame(buf, next, out)
+		}
+		return next, t == '>', nil
+	default:
+		return 0, false, errResp3Malformed
+	}
+	return next, false, nil
+}
+
+// resp3ToResp2 converts the complete frames at the beginning of buf to RESP2
+// which could be decoded by resp-go, push tells whether each frame is a RESP3
+// push frame, consumed is the bytes of buf converted. Frames before a
+// malformed one are still returned with errResp3Malformed.
+func resp3ToResp2(buf []byte) (out []byte, push []bool, consumed int, err error) {
+	var outBuf bytes.Buffer
+	push = make([]bool, 0)
+	for consumed < len(buf) {
+		var frame bytes.Buffer
+		next, isPush, err := convertResp3Frame(buf, consumed, &frame)
+		if err == errResp3Incomplete {
+			break
+		} else if err != nil {
+			return outBuf.Bytes(), push, consumed, err
+		}
+		outBuf.Write(frame.Bytes())
+		push = append(push, isPush)
+		consumed = next
+	}
+	return outBuf.Bytes(), push, consumed, nil
+}
+
+// malformedRequest tells whether buffered request data can't be decoded, an
+// inline command such as "PING\r\n" is not RESP but is accepted by redis.
+func malformedRequest(buf []byte) bool {
+	if len(buf) == 0 {
+		return false
+	}
+	if c := buf[0]; (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return false
+	}
+	_, _, err := convertResp3Frame(buf, 0, &bytes.Buffer{})
+	return err == errResp3Malformed
+}
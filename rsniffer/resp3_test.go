@@ -0,0 +1,70 @@
+package rsniffer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResp3ToResp2(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		out      string
+		push     []bool
+		consumed int // -1 if all is consumed
+		err      error
+	}{
+		{"simple", "+OK\r\n-ERR x\r\n:1\r\n", "+OK\r\n-ERR x\r\n:1\r\n", []bool{false, false, false}, -1, nil},
+		{"bulk", "$3\r\nfoo\r\n$-1\r\n", "$3\r\nfoo\r\n$-1\r\n", []bool{false, false}, -1, nil},
+		{"null", "_\r\n", "$-1\r\n", []bool{false}, -1, nil},
+		{"boolean", "#t\r\n#f\r\n", ":1\r\n:0\r\n", []bool{false, false}, -1, nil},
+		{"double", ",3.14\r\n", "$4\r\n3.14\r\n", []bool{false}, -1, nil},
+		{"big number fits", "(123\r\n", ":123\r\n", []bool{false}, -1, nil},
+		{"big number", "(3492890328409238509324850943850943825024385\r\n",
+			"$43\r\n3492890328409238509324850943850943825024385\r\n", []bool{false}, -1, nil},
+		{"verbatim", "=8\r\ntxt:abcd\r\n", "$8\r\ntxt:abcd\r\n", []bool{false}, -1, nil},
+		{"blob error", "!11\r\nSYNTAX\r\nbad\r\n", "-SYNTAX bad\r\n", []bool{false}, -1, nil},
+		{"map", "%1\r\n+a\r\n:1\r\n", "*2\r\n+a\r\n:1\r\n", []bool{false}, -1, nil},
+		{"set", "~2\r\n+a\r\n+b\r\n", "*2\r\n+a\r\n+b\r\n", []bool{false}, -1, nil},
+		{"nested", "*2\r\n%1\r\n+k\r\n_\r\n#t\r\n", "*2\r\n*2\r\n+k\r\n$-1\r\n:1\r\n", []bool{false}, -1, nil},
+		{"null array", "*-1\r\n", "*-1\r\n", []bool{false}, -1, nil},
+		{"push", ">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n",
+			"*2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n", []bool{true}, -1, nil},
+		{"attribute dropped", "|1\r\n+ttl\r\n:3\r\n+OK\r\n", "+OK\r\n", []bool{false}, -1, nil},
+		{"incomplete line", "+OK\r\n+PA", "+OK\r\n", []bool{false}, 5, nil},
+		{"incomplete bulk", "$5\r\nab", "", []bool{}, 0, nil},
+		{"incomplete array", "*2\r\n+a\r\n", "", []bool{}, 0, nil},
+		{"malformed type", "+OK\r\n?x\r\n", "+OK\r\n", []bool{false}, 5, errResp3Malformed},
+		{"malformed length", "$x\r\nab\r\n", "", []bool{}, 0, errResp3Malformed},
+	}
+	for _, tt := range tests {
+		if tt.consumed < 0 {
+			tt.consumed = len(tt.in)
+		}
+		out, push, consumed, err := resp3ToResp2([]byte(tt.in))
+		if string(out) != tt.out || !reflect.DeepEqual(push, tt.push) || consumed != tt.consumed || err != tt.err {
+			t.Errorf("%s: resp3ToResp2(%q) = %q, %v, %d, %v, want %q, %v, %d, %v", tt.name, tt.in,
+				out, push, consumed, err, tt.out, tt.push, tt.consumed, tt.err)
+		}
+	}
+}
+
+func TestMalformedRequest(t *testing.T) {
+	tests := []struct {
+		buf       string
+		malformed bool
+	}{
+		{"", false},
+		{"PING\r\n", false},
+		{"*1\r\n$4\r\nPI", false},
+		{"*1\r\n$4\r\nPING\r\n", false},
+		{"\x00\x01binary", false}, // not malformed until a line is complete
+		{"\x00\x01binary\r\n", true},
+		{"*x\r\n", true},
+	}
+	for _, tt := range tests {
+		if malformed := malformedRequest([]byte(tt.buf)); malformed != tt.malformed {
+			t.Errorf("malformedRequest(%q) = %v, want %v", tt.buf, malformed, tt.malformed)
+		}
+	}
+}
@@ -3,31 +3,170 @@ package rsniffer
 import (
 	"errors"
 	"github.com/amyangfei/resp-go/resp"
+	"strings"
+	"time"
 )
 
 var RedisCmds map[string]int = map[string]int{
-	"GET":     RedisCmdRead,
-	"HGET":    RedisCmdRead,
-	"HGETALL": RedisCmdRead,
-	//"HLEN":     RedisCmdRead,
-	//"HMGET":    RedisCmdRead,
-	//"HSTRLEN":  RedisCmdRead,
-	//"LINDEX":   RedisCmdRead,
-	"LLEN":   RedisCmdRead,
-	"LRANGE": RedisCmdRead,
-	"MGET":   RedisCmdRead,
+	"GET":           RedisCmdRead,
+	"GETRANGE":      RedisCmdRead,
+	"STRLEN":        RedisCmdRead,
+	"EXISTS":        RedisCmdRead,
+	"HGET":          RedisCmdRead,
+	"HGETALL":       RedisCmdRead,
+	"HEXISTS":       RedisCmdRead,
+	"HKEYS":         RedisCmdRead,
+	"HVALS":         RedisCmdRead,
+	"HLEN":          RedisCmdRead,
+	"HMGET":         RedisCmdRead,
+	"HSTRLEN":       RedisCmdRead,
+	"LINDEX":        RedisCmdRead,
+	"LLEN":          RedisCmdRead,
+	"LRANGE":        RedisCmdRead,
+	"MGET":          RedisCmdRead,
+	"SCARD":         RedisCmdRead,
+	"SISMEMBER":     RedisCmdRead,
+	"SMEMBERS":      RedisCmdRead,
+	"SRANDMEMBER":   RedisCmdRead,
+	"ZCARD":         RedisCmdRead,
+	"ZSCORE":        RedisCmdRead,
+	"ZRANGE":        RedisCmdRead,
+	"ZREVRANGE":     RedisCmdRead,
+	"ZRANGEBYSCORE": RedisCmdRead,
+	"XREAD":         RedisCmdRead,
+	"XREADGROUP":    RedisCmdRead,
 
 	"INFO":    RedisCmdFunc,
 	"DBSIZE":  RedisCmdFunc,
 	"MULTI":   RedisCmdFunc,
 	"EXEC":    RedisCmdFunc,
 	"DISCARD": RedisCmdFunc,
+	"RESET":   RedisCmdFunc,
+	"WATCH":   RedisCmdFunc,
+	"UNWATCH": RedisCmdFunc,
+	"CLIENT":  RedisCmdFunc,
+	"WAIT":    RedisCmdFunc,
+	"WAITAOF": RedisCmdFunc,
+
+	"PUBLISH":      RedisCmdFunc,
+	"SPUBLISH":     RedisCmdFunc,
+	"SUBSCRIBE":    RedisCmdFunc,
+	"UNSUBSCRIBE":  RedisCmdFunc,
+	"PSUBSCRIBE":   RedisCmdFunc,
+	"PUNSUBSCRIBE": RedisCmdFunc,
+	"SSUBSCRIBE":   RedisCmdFunc,
+	"SUNSUBSCRIBE": RedisCmdFunc,
 
 	"SET":    RedisCmdWrite,
+	"SETEX":  RedisCmdWrite,
+	"APPEND": RedisCmdWrite,
+	"HSET":   RedisCmdWrite,
+	"HMSET":  RedisCmdWrite,
 	"LPUSH":  RedisCmdWrite,
 	"RPUSH":  RedisCmdWrite,
+	"SADD":   RedisCmdWrite,
+	"ZADD":   RedisCmdWrite,
 	"MSET":   RedisCmdWrite,
 	"INCRBY": RedisCmdWrite,
+
+	// commands masters usually propagate to replicas, e.g. expired keys are
+	// propagated as DEL or UNLINK, and EXPIRE as PEXPIREAT
+	"DEL":       RedisCmdWrite,
+	"UNLINK":    RedisCmdWrite,
+	"PEXPIREAT": RedisCmdWrite,
+	"LPOP":      RedisCmdWrite,
+	"RPOP":      RedisCmdWrite,
+	"SREM":      RedisCmdWrite,
+	"ZREM":      RedisCmdWrite,
+	"HDEL":      RedisCmdWrite,
+	"SELECT":    RedisCmdFunc,
+	"ASKING":    RedisCmdFunc,
+
+	"SENTINEL": RedisCmdFunc,
+
+	"BLPOP":      RedisCmdWrite,
+	"BRPOP":      RedisCmdWrite,
+	"BRPOPLPUSH": RedisCmdWrite,
+	"BLMOVE":     RedisCmdWrite,
+	"BLMPOP":     RedisCmdWrite,
+	"BZPOPMIN":   RedisCmdWrite,
+	"BZPOPMAX":   RedisCmdWrite,
+	"BZMPOP":     RedisCmdWrite,
+}
+
+// KeySpec describes the position of keys in command arguments, Last is the
+// index of the last key, a negative value counts from the end of arguments.
+type KeySpec struct {
+	First int
+	Last  int
+	Step  int
+}
+
+var RedisCmdKeys map[string]KeySpec = map[string]KeySpec{
+	"GET":           {1, 1, 1},
+	"GETRANGE":      {1, 1, 1},
+	"STRLEN":        {1, 1, 1},
+	"EXISTS":        {1, -1, 1},
+	"HGET":          {1, 1, 1},
+	"HGETALL":       {1, 1, 1},
+	"HEXISTS":       {1, 1, 1},
+	"HKEYS":         {1, 1, 1},
+	"HVALS":         {1, 1, 1},
+	"HLEN":          {1, 1, 1},
+	"HMGET":         {1, 1, 1},
+	"HSTRLEN":       {1, 1, 1},
+	"LINDEX":        {1, 1, 1},
+	"LLEN":          {1, 1, 1},
+	"LRANGE":        {1, 1, 1},
+	"MGET":          {1, -1, 1},
+	"SCARD":         {1, 1, 1},
+	"SISMEMBER":     {1, 1, 1},
+	"SMEMBERS":      {1, 1, 1},
+	"SRANDMEMBER":   {1, 1, 1},
+	"ZCARD":         {1, 1, 1},
+	"ZSCORE":        {1, 1, 1},
+	"ZRANGE":        {1, 1, 1},
+	"ZREVRANGE":     {1, 1, 1},
+	"ZRANGEBYSCORE": {1, 1, 1},
+
+	"SET":    {1, 1, 1},
+	"SETEX":  {1, 1, 1},
+	"APPEND": {1, 1, 1},
+	"HSET":   {1, 1, 1},
+	"HMSET":  {1, 1, 1},
+	"LPUSH":  {1, 1, 1},
+	"RPUSH":  {1, 1, 1},
+	"SADD":   {1, 1, 1},
+	"ZADD":   {1, 1, 1},
+	"MSET":   {1, -1, 2},
+	"INCRBY": {1, 1, 1},
+
+	"DEL":       {1, -1, 1},
+	"UNLINK":    {1, -1, 1},
+	"PEXPIREAT": {1, 1, 1},
+	"LPOP":      {1, 1, 1},
+	"RPOP":      {1, 1, 1},
+	"SREM":      {1, 1, 1},
+	"ZREM":      {1, 1, 1},
+	"HDEL":      {1, 1, 1},
+
+	"WATCH": {1, -1, 1},
+
+	"BLPOP":      {1, -2, 1},
+	"BRPOP":      {1, -2, 1},
+	"BRPOPLPUSH": {1, 2, 1},
+	"BLMOVE":     {1, 2, 1},
+	"BZPOPMIN":   {1, -2, 1},
+	"BZPOPMAX":   {1, -2, 1},
+}
+
+// redisCmdKeyFuncs extract keys of commands whose key positions depend on
+// other arguments
+var redisCmdKeyFuncs = map[string]func(args []string) []string{
+	"BLMPOP":     numKeysAfterTimeout,
+	"BZMPOP":     numKeysAfterTimeout,
+	"XREAD":      streamsKeys,
+	"XREADGROUP": streamsKeys,
 }
 
 var MsgTypeMapping = map[byte]string{
@@ -53,8 +192,31 @@ func (c *Command) Name() string {
 	return c.Args[0]
 }
 
+// Keys returns the keys accessed by the command, nil if the command is unknown
+func (c *Command) Keys() []string {
+	if keysFunc, ok := redisCmdKeyFuncs[strings.ToUpper(c.Name())]; ok {
+		return keysFunc(c.Args)
+	}
+	spec, ok := RedisCmdKeys[strings.ToUpper(c.Name())]
+	if !ok {
+		return nil
+	}
+	last := spec.Last
+	if last < 0 {
+		last = len(c.Args) + last
+	}
+	keys := make([]string, 0)
+	for i := spec.First; i <= last && i < len(c.Args); i += spec.Step {
+		keys = append(keys, c.Args[i])
+	}
+	return keys
+}
+
 type RespData struct {
-	Msg *resp.Message
+	Msg  *resp.Message
+	Time time.Time // capture time of the packet completing this message
+	Push bool      // RESP3 push frame, which answers no request
+	Repl int       // kind of replication stream frame, such as ReplCmd, 0 if not
 }
 
 func (rd *RespData) MsgType() string {
@@ -92,6 +254,48 @@ func (rd *RespData) GetCommand() (*Command, error) {
 	return NewCommand(args...)
 }
 
+// Size returns the payload bytes of a reply, for array it is the sum of all
+// its elements.
+func (rd *RespData) Size() int {
+	return msgSize(rd.Msg)
+}
+
+// Elements returns the element count of an array reply, 1 for other types.
+func (rd *RespData) Elements() int {
+	if rd.IsArray() {
+		return len(rd.Msg.Array)
+	}
+	return 1
+}
+
+func msgSize(msg *resp.Message) int {
+	switch msg.Type {
+	case resp.BulkHeader:
+		return len(msg.Bytes)
+	case resp.StringHeader:
+		return len(msg.Status)
+	case resp.ArrayHeader:
+		size := 0
+		for _, elem := range msg.Array {
+			size += msgSize(elem)
+		}
+		return size
+	}
+	return 0
+}
+
+// Latency returns the duration between request and this reply, -1 if any
+// capture time is unknown.
+func (rd *RespData) Latency(request *RespData) time.Duration {
+	if rd.Time.IsZero() || request.Time.IsZero() {
+		return -1
+	}
+	if rd.Time.Before(request.Time) {
+		return 0
+	}
+	return rd.Time.Sub(request.Time)
+}
+
 func (rd *RespData) RawPayload() ([]byte, error) {
 	return resp.Marshal(rd.Msg)
 }
@@ -0,0 +1,52 @@
+package rsniffer
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// modes of sampling
+const (
+	SampleUniform = iota + 1 // each command is kept with probability Rate
+	SampleSession            // every command of a sampled session is kept
+	SampleKey                // commands are kept by hash of the first key, consistent across sniffers
+)
+
+var SampleModes = map[string]int{
+	"uniform": SampleUniform,
+	"session": SampleSession,
+	"key":     SampleKey,
+}
+
+// ParseSampleMode returns sampling mode of name, such as "key"
+func ParseSampleMode(name string) (int, error) {
+	mode, ok := SampleModes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown sample mode %q", name)
+	}
+	return mode, nil
+}
+
+// SamplingConfig bounds the per command results emitted, analyzers are fed
+// with every command so aggregates are not affected by sampling.
+type SamplingConfig struct {
+	Mode       int           // SampleUniform, SampleSession or SampleKey
+	Rate       float64       // probability a command, session or key is kept, in [0, 1]
+	KeepErrors bool          // always keep commands replied with error
+	KeepSlow   time.Duration // always keep commands with higher latency, 0 disables
+	Window     time.Duration // window of kept and dropped counts summaries, 0 disables
+}
+
+// HashSampled tells whether a value is sampled with rate, the decision only
+// depends on the value so that sniffers agree on it.
+func HashSampled(value string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	sum := md5.Sum([]byte(value))
+	return float64(binary.BigEndian.Uint64(sum[:8])) < rate*math.MaxUint64
+}
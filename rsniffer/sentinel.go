@@ -0,0 +1,94 @@
+package rsniffer
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// SentinelSwitchChannel is the channel sentinel notifies failover by
+const SentinelSwitchChannel = "+switch-master"
+
+// SentinelConfig enables analysis of clients talking to sentinel
+type SentinelConfig struct {
+	Window time.Duration // window of per client summaries
+}
+
+// SwitchMaster is a failover notification of sentinel, the payload is
+// "<master name> <old ip> <old port> <new ip> <new port>"
+type SwitchMaster struct {
+	Master string
+	From   string // address of the old master
+	To     string // address of the new master
+	Time   time.Time
+}
+
+// ParseSwitchMaster parses +switch-master message, nil is returned if push
+// is not a failover notification.
+func ParseSwitchMaster(push *PushMessage) *SwitchMaster {
+	if push.Channel != SentinelSwitchChannel {
+		return nil
+	}
+	parts := strings.Fields(string(push.Payload))
+	if len(parts) != 5 {
+		return nil
+	}
+	return &SwitchMaster{
+		Master: parts[0],
+		From:   net.JoinHostPort(parts[1], parts[2]),
+		To:     net.JoinHostPort(parts[3], parts[4]),
+		Time:   push.Time,
+	}
+}
+
+// SentinelSubcommand returns the lowercase subcommand and master name of a
+// SENTINEL command, such as "get-master-addr-by-name" and "mymaster".
+func SentinelSubcommand(cmd *Command) (sub, master string) {
+	if strings.ToUpper(cmd.Name()) != "SENTINEL" || len(cmd.Args) < 2 {
+		return "", ""
+	}
+	sub = strings.ToLower(cmd.Args[1])
+	if sub == "slaves" {
+		sub = "replicas"
+	}
+	if len(cmd.Args) > 2 {
+		master = cmd.Args[2]
+	}
+	return sub, master
+}
+
+// ParseMasterAddr parses reply of SENTINEL get-master-addr-by-name, empty
+// string is returned if the master is unknown to sentinel.
+func ParseMasterAddr(rd *RespData) string {
+	if !rd.IsArray() || len(rd.Msg.Array) != 2 {
+		return ""
+	}
+	return net.JoinHostPort(string(rd.Msg.Array[0].Bytes), string(rd.Msg.Array[1].Bytes))
+}
+
+// ParseSentinelEntries parses reply of SENTINEL sentinels and replicas, each
+// entry is a list of field and value pairs, such as "ip" and "flags".
+func ParseSentinelEntries(rd *RespData) []map[string]string {
+	if !rd.IsArray() {
+		return nil
+	}
+	entries := make([]map[string]string, 0, len(rd.Msg.Array))
+	for _, elem := range rd.Msg.Array {
+		entry := map[string]string{}
+		for i := 0; i+1 < len(elem.Array); i += 2 {
+			entry[string(elem.Array[i].Bytes)] = string(elem.Array[i+1].Bytes)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// SentinelEntryDown tells whether sentinel considers the instance down
+func SentinelEntryDown(entry map[string]string) bool {
+	for _, flag := range strings.Split(entry["flags"], ",") {
+		if flag == "s_down" || flag == "o_down" || flag == "disconnected" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package rsniffer
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+// Sink receives output of sniffer, sessions with new data and errors which
+// include session lifecycle events. Both may be called from several
+// goroutines in proxy mode.
+type Sink interface {
+	Data(rs *RedSession)
+	Error(err error)
+}
+
+// chanSink sends sniffer output to channels, see Sniff
+type chanSink struct {
+	c  chan *RedSession
+	ec chan error
+}
+
+// NewChanSink returns a Sink sending sessions to c and errors to ec
+func NewChanSink(c chan *RedSession, ec chan error) Sink {
+	return &chanSink{c: c, ec: ec}
+}
+
+func (cs *chanSink) Data(rs *RedSession) {
+	cs.c <- rs
+}
+
+func (cs *chanSink) Error(err error) {
+	cs.ec <- err
+}
+
+// Delivery is an item of a shard queue, either a session with new data or a
+// lifecycle event of the session if Event is set.
+type Delivery struct {
+	Session *RedSession
+	Event   *SessionEvent
+}
+
+// ShardStats counts deliveries of sessions with new data
+type ShardStats struct {
+	Queued    int64         // sessions queued
+	Coalesced int64         // sessions already queued and not queued again
+	Dropped   int64         // sessions not queued as the shard queue is full
+	Stalls    int64         // sessions waited for the full shard queue
+	Stalled   time.Duration // time waited for full shard queues
+}
+
+// Shards is a Sink which dispatches sessions to queues by session, so that
+// output of a session is always in the same queue and in order. Errors other
+// than lifecycle events are sent to Errors.
+//
+// A session is queued at most once until it is taken by Next, as all its
+// buffered data is decoded then. When a queue is full, the sender waits if
+// block is true, which slows down capture, otherwise the session is not
+// queued and its data is left in buffer until the next packet of it, or
+// dropped by buffer overflow. Lifecycle events always wait.
+type Shards struct {
+	queues []chan *Delivery
+	errs   chan error
+	block  bool
+
+	queued    int64
+	coalesced int64
+	dropped   int64
+	stalls    int64
+	stalled   int64 // nanoseconds
+}
+
+func NewShards(n, size int, block bool) *Shards {
+	if n < 1 {
+		n = 1
+	}
+	s := &Shards{
+		queues: make([]chan *Delivery, n),
+		errs:   make(chan error),
+		block:  block,
+	}
+	for i := range s.queues {
+		s.queues[i] = make(chan *Delivery, size)
+	}
+	return s
+}
+
+// Len returns the number of shards
+func (s *Shards) Len() int {
+	return len(s.queues)
+}
+
+func (s *Shards) shard(rs *RedSession) chan *Delivery {
+	h := fnv.New32a()
+	h.Write(rs.ID)
+	return s.queues[h.Sum32()%uint32(len(s.queues))]
+}
+
+func (s *Shards) Data(rs *RedSession) {
+	if !atomic.CompareAndSwapInt32(&rs.pending, 0, 1) {
+		atomic.AddInt64(&s.coalesced, 1)
+		return
+	}
+	d := &Delivery{Session: rs}
+	q := s.shard(rs)
+	select {
+	case q <- d:
+		atomic.AddInt64(&s.queued, 1)
+		return
+	default:
+	}
+	if !s.block {
+		atomic.StoreInt32(&rs.pending, 0)
+		atomic.AddInt64(&s.dropped, 1)
+		return
+	}
+	start := time.Now()
+	q <- d
+	atomic.AddInt64(&s.queued, 1)
+	atomic.AddInt64(&s.stalls, 1)
+	atomic.AddInt64(&s.stalled, int64(time.Since(start)))
+}
+
+func (s *Shards) Error(err error) {
+	if se, ok := err.(*SessionEvent); ok && se.Session != nil {
+		s.shard(se.Session) <- &Delivery{Session: se.Session, Event: se}
+		return
+	}
+	s.errs <- err
+}
+
+// Errors returns the channel of errors which are not lifecycle events, such
+// as *CaptureError and io.EOF
+func (s *Shards) Errors() <-chan error {
+	return s.errs
+}
+
+// Next takes a delivery from queue i, ok is false if the queue is closed.
+// The session could be queued again once it is taken.
+func (s *Shards) Next(i int) (d *Delivery, ok bool) {
+	d, ok = <-s.queues[i]
+	if ok && d.Event == nil {
+		atomic.StoreInt32(&d.Session.pending, 0)
+	}
+	return d, ok
+}
+
+// Close closes all queues, it should be called after sniffer stops sending.
+func (s *Shards) Close() {
+	for _, q := range s.queues {
+		close(q)
+	}
+}
+
+// Stats returns counts of deliveries since the shards are created
+func (s *Shards) Stats() ShardStats {
+	return ShardStats{
+		Queued:    atomic.LoadInt64(&s.queued),
+		Coalesced: atomic.LoadInt64(&s.coalesced),
+		Dropped:   atomic.LoadInt64(&s.dropped),
+		Stalls:    atomic.LoadInt64(&s.stalls),
+		Stalled:   time.Duration(atomic.LoadInt64(&s.stalled)),
+	}
+}
+
+// Backlog returns deliveries waiting in all queues
+func (s *Shards) Backlog() int {
+	backlog := 0
+	for _, q := range s.queues {
+		backlog += len(q)
+	}
+	return backlog
+}
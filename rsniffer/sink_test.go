@@ -0,0 +1,130 @@
+package rsniffer
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShardsAccounting(t *testing.T) {
+	a := &RedSession{ID: []byte("a")}
+	b := &RedSession{ID: []byte("b")}
+	tests := []struct {
+		name string
+		// sessions sent to a shard queue of one slot, "-" takes a delivery
+		steps []string
+		want  ShardStats
+		// sessions taken by "-" in order
+		taken []string
+	}{
+		{"queued", []string{"a", "-", "b", "-"},
+			ShardStats{Queued: 2}, []string{"a", "b"}},
+		{"coalesced until taken", []string{"a", "a", "a", "-", "a", "-"},
+			ShardStats{Queued: 2, Coalesced: 2}, []string{"a", "a"}},
+		{"dropped when full", []string{"a", "b", "b", "-", "b", "-"},
+			ShardStats{Queued: 2, Dropped: 2}, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		s := NewShards(1, 1, false)
+		taken := make([]string, 0)
+		for _, step := range tt.steps {
+			switch step {
+			case "a":
+				s.Data(a)
+			case "b":
+				s.Data(b)
+			case "-":
+				d, ok := s.Next(0)
+				if !ok {
+					t.Fatalf("%s: queue is closed", tt.name)
+				}
+				taken = append(taken, string(d.Session.ID))
+			}
+		}
+		if stats := s.Stats(); stats != tt.want {
+			t.Errorf("%s: stats %+v, want %+v", tt.name, stats, tt.want)
+		}
+		if !reflect.DeepEqual(taken, tt.taken) {
+			t.Errorf("%s: taken %q, want %q", tt.name, taken, tt.taken)
+		}
+		if s.Backlog() != 0 {
+			t.Errorf("%s: backlog %d", tt.name, s.Backlog())
+		}
+	}
+}
+
+func TestShardsBlock(t *testing.T) {
+	s := NewShards(1, 1, true)
+	a := &RedSession{ID: []byte("a")}
+	b := &RedSession{ID: []byte("b")}
+	s.Data(a)
+	sent := make(chan struct{})
+	go func() {
+		// waits for the full queue
+		s.Data(b)
+		close(sent)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if d, _ := s.Next(0); d.Session != a {
+		t.Fatal("first delivery is not a")
+	}
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("sender is not released by Next")
+	}
+	if d, _ := s.Next(0); d.Session != b {
+		t.Fatal("second delivery is not b")
+	}
+	stats := s.Stats()
+	if stats.Queued != 2 || stats.Stalls != 1 || stats.Dropped != 0 || stats.Stalled <= 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestShardsOrder(t *testing.T) {
+	s := NewShards(4, 32, false)
+	sessions := make([]*RedSession, 8)
+	for i := range sessions {
+		sessions[i] = &RedSession{ID: []byte{byte(i)}}
+	}
+	// data and lifecycle events of a session are queued to the same shard
+	// in order, other errors are sent to Errors
+	go func() {
+		for _, rs := range sessions {
+			s.Error(newSessionEvent(SessionOpen, rs, nil, time.Now()))
+			s.Data(rs)
+			s.Error(newSessionEvent(SessionClose, rs, nil, time.Now()))
+		}
+		s.Error(io.EOF)
+	}()
+	if err := <-s.Errors(); err != io.EOF {
+		t.Fatalf("error %v, want io.EOF", err)
+	}
+	s.Close()
+
+	kinds := map[string][]string{}
+	for i := 0; i < s.Len(); i++ {
+		for {
+			d, ok := s.Next(i)
+			if !ok {
+				break
+			}
+			kind := "data"
+			if d.Event != nil {
+				kind = SessionEventNames[d.Event.Kind]
+			}
+			kinds[string(d.Session.ID)] = append(kinds[string(d.Session.ID)], kind)
+		}
+	}
+	want := []string{SessionEventNames[SessionOpen], "data", SessionEventNames[SessionClose]}
+	for _, rs := range sessions {
+		if got := kinds[string(rs.ID)]; !reflect.DeepEqual(got, want) {
+			t.Errorf("session %v: deliveries %q, want %q", rs.ID, got, want)
+		}
+	}
+	if stats := s.Stats(); stats.Queued != int64(len(sessions)) || stats.Dropped != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
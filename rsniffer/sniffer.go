@@ -1,23 +1,34 @@
 package rsniffer
 
 import (
-	"fmt"
 	"github.com/google/gopacket"
 	_ "github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type SniffConfig struct {
 	Device      string
+	PcapFile    string // read packets from pcap file instead of Device if set
 	Snaplen     int32
 	Promiscuous bool
 	Timeout     time.Duration
 	UseZeroCopy bool
 	Host        string
 	Port        int
+	Targets     []*Endpoint  // redis servers to sniff, overrides Host and Port
+	Encap       int          // encapsulations to capture, EncapVLAN | EncapVXLAN ...
+	Proxy       *ProxyConfig // relay traffic instead of capturing packets if set
 	MaxBufSize  int
+	SessionIdle time.Duration // idle sessions are evicted, never if zero
 	AzConfig    *AnalyzeConfig
+
+	endpoints     []*Endpoint
+	endpointsErr  error
+	endpointsOnce sync.Once
 }
 
 func DefaultSniffConfig() *SniffConfig {
@@ -30,6 +41,7 @@ func DefaultSniffConfig() *SniffConfig {
 		Host:        "127.0.0.1",
 		Port:        6379,
 		MaxBufSize:  10240,
+		SessionIdle: 10 * time.Minute,
 		AzConfig: &AnalyzeConfig{
 			ReadHitAnalyze: true,
 			SaveCmdTypes:   []int{RedisCmdRead},
@@ -38,45 +50,137 @@ func DefaultSniffConfig() *SniffConfig {
 	}
 }
 
-func PacketSniff(snifCfg *SniffConfig, c chan *RedSession, ec chan error) {
-	// Open device
-	handle, err := pcap.OpenLive(
-		snifCfg.Device, snifCfg.Snaplen, snifCfg.Promiscuous, snifCfg.Timeout)
+// Sniff sends redis sessions with new data to c, traffic is relayed by proxy
+// if snifCfg.Proxy is set, otherwise packets are captured.
+func Sniff(snifCfg *SniffConfig, c chan *RedSession, ec chan error) {
+	NewSniffer(snifCfg).Run(NewChanSink(c, ec))
+}
+
+// SniffTo is like Sniff but sends the output to sink, such as Shards
+func SniffTo(snifCfg *SniffConfig, sink Sink) {
+	NewSniffer(snifCfg).Run(sink)
+}
+
+// PacketSniff captures packets and sends redis sessions with new data to
+// sink. Session lifecycle events are sent as *SessionEvent, a *CaptureError
+// is sent if capture fails. When reading from a pcap file, io.EOF is sent
+// after all packets are processed.
+func PacketSniff(snifCfg *SniffConfig, sink Sink) {
+	NewSniffer(snifCfg).packetSniff(sink)
+}
+
+// Sniffer captures packets or relays traffic by proxy and keeps statistics
+// of capture, see Stats.
+type Sniffer struct {
+	cfg *SniffConfig
+
+	mu      sync.Mutex
+	handle  *pcap.Handle         // nil if capture is not started or finished
+	packetc chan gopacket.Packet // decoded packets waiting to be processed
+
+	packets  int64
+	bytes    int64
+	opened   int64
+	closed   int64 // closed, reset and evicted sessions
+	evicted  int64
+	overflow int64
+	kernel   pcap.Stats // the last statistics of pcap handle
+}
+
+func NewSniffer(snifCfg *SniffConfig) *Sniffer {
+	return &Sniffer{cfg: snifCfg}
+}
+
+// Run sends output of sniffer to sink until capture fails, or all packets
+// of pcap file are processed
+func (s *Sniffer) Run(sink Sink) {
+	sink = &statsSink{Sink: sink, s: s}
+	if s.cfg.Proxy != nil {
+		s.proxySniff(sink)
+		return
+	}
+	s.packetSniff(sink)
+}
+
+func (s *Sniffer) packetSniff(sink Sink) {
+	snifCfg := s.cfg
+	filter, err := snifCfg.BPFFilter()
 	if err != nil {
-		ec <- err
+		sink.Error(&CaptureError{err})
 		return
 	}
-	defer handle.Close()
+	var handle *pcap.Handle
+	if snifCfg.PcapFile != "" {
+		handle, err = pcap.OpenOffline(snifCfg.PcapFile)
+	} else {
+		// Open device
+		handle, err = pcap.OpenLive(
+			snifCfg.Device, snifCfg.Snaplen, snifCfg.Promiscuous, snifCfg.Timeout)
+	}
+	if err != nil {
+		sink.Error(&CaptureError{err})
+		return
+	}
+	defer s.closeHandle()
 
 	// Set filter
-	filter := fmt.Sprintf("host %s and port %d", snifCfg.Host, snifCfg.Port)
 	err = handle.SetBPFFilter(filter)
 	if err != nil {
-		ec <- err
+		sink.Error(&CaptureError{err})
 		return
 	}
 
 	sp := NewRedSessionPool()
 
+	var packets chan gopacket.Packet
 	if snifCfg.UseZeroCopy {
-		packetSource := NewZeroCopyPacketSource(handle, handle.LinkType())
-		for packet := range packetSource.Packets() {
-			rs, err := PacketProcess(packet, sp, snifCfg)
-			if err != nil {
-				ec <- err
-			} else if rs != nil {
-				c <- rs
-			}
-		}
+		packets = NewZeroCopyPacketSource(handle, linkDecoder(handle.LinkType())).Packets()
 	} else {
-		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-		for packet := range packetSource.Packets() {
-			rs, err := PacketProcess(packet, sp, snifCfg)
-			if err != nil {
-				ec <- err
-			} else if rs != nil {
-				c <- rs
-			}
-		}
+		packets = gopacket.NewPacketSource(handle, linkDecoder(handle.LinkType())).Packets()
+	}
+	s.mu.Lock()
+	s.handle, s.packetc = handle, packets
+	s.mu.Unlock()
+	for packet := range packets {
+		s.deliver(packet, sp, sink)
+	}
+	// packet source is closed only when reaching the end of pcap file
+	sink.Error(io.EOF)
+}
+
+// closeHandle closes pcap handle, statistics of it are kept
+func (s *Sniffer) closeHandle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handle == nil {
+		return
+	}
+	if stats, err := s.handle.Stats(); err == nil {
+		s.kernel = *stats
+	}
+	s.handle.Close()
+	s.handle, s.packetc = nil, nil
+}
+
+// deliver processes a packet, sends the session with new data and lifecycle
+// events to sink, idle sessions are evicted by packet time.
+func (s *Sniffer) deliver(packet gopacket.Packet, sp *RedSessionPool, sink Sink) {
+	atomic.AddInt64(&s.packets, 1)
+	rs, err := PacketProcess(packet, sp, s.cfg)
+	if rs != nil && rs.Counter == 1 {
+		sink.Error(newSessionEvent(SessionOpen, rs, nil, rs.lastSeen))
+	}
+	if err != nil {
+		sink.Error(err)
+	} else if rs != nil {
+		atomic.AddInt64(&s.bytes, int64(len(packet.ApplicationLayer().Payload())))
+		sink.Data(rs)
+	}
+	now := packet.Metadata().Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	for _, evicted := range sp.Evict(now, s.cfg.SessionIdle) {
+		sink.Error(newSessionEvent(SessionEvicted, evicted, nil, now))
 	}
 }
@@ -0,0 +1,71 @@
+package rsniffer
+
+import (
+	"sync/atomic"
+)
+
+// CaptureStats is a snapshot of sniffer statistics. Kernel statistics are
+// from pcap and are zero in proxy mode or when reading from pcap file.
+type CaptureStats struct {
+	Received        int64 // packets received by kernel filter
+	Dropped         int64 // packets dropped by kernel as capture buffer is full
+	IfDropped       int64 // packets dropped by network interface
+	Packets         int64 // packets processed, or reads relayed in proxy mode
+	Bytes           int64 // payload bytes of redis sessions
+	Backlog         int   // packets decoded and waiting to be processed
+	SessionsActive  int64 // sessions opened and not ended yet
+	SessionsOpened  int64
+	SessionsEvicted int64 // sessions evicted as idle, e.g. FIN is not captured
+	Overflows       int64 // buffered data dropped by overflow
+}
+
+// statsSink counts session lifecycle events sent to sink
+type statsSink struct {
+	Sink
+	s *Sniffer
+}
+
+func (ss *statsSink) Error(err error) {
+	if se, ok := err.(*SessionEvent); ok {
+		switch se.Kind {
+		case SessionOpen:
+			atomic.AddInt64(&ss.s.opened, 1)
+		case SessionEvicted:
+			atomic.AddInt64(&ss.s.evicted, 1)
+			atomic.AddInt64(&ss.s.closed, 1)
+		case SessionClose, SessionReset:
+			atomic.AddInt64(&ss.s.closed, 1)
+		case SessionOverflow:
+			atomic.AddInt64(&ss.s.overflow, 1)
+		}
+	}
+	ss.Sink.Error(err)
+}
+
+// Stats returns statistics of capture, it is safe to call while sniffer is
+// running.
+func (s *Sniffer) Stats() CaptureStats {
+	s.mu.Lock()
+	kernel := s.kernel
+	if s.handle != nil {
+		if stats, err := s.handle.Stats(); err == nil {
+			kernel = *stats
+		}
+	}
+	backlog := len(s.packetc)
+	s.mu.Unlock()
+
+	opened := atomic.LoadInt64(&s.opened)
+	return CaptureStats{
+		Received:        int64(kernel.PacketsReceived),
+		Dropped:         int64(kernel.PacketsDropped),
+		IfDropped:       int64(kernel.PacketsIfDropped),
+		Packets:         atomic.LoadInt64(&s.packets),
+		Bytes:           atomic.LoadInt64(&s.bytes),
+		Backlog:         backlog,
+		SessionsActive:  opened - atomic.LoadInt64(&s.closed),
+		SessionsOpened:  opened,
+		SessionsEvicted: atomic.LoadInt64(&s.evicted),
+		Overflows:       atomic.LoadInt64(&s.overflow),
+	}
+}
@@ -0,0 +1,90 @@
+package rsniffer
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TrackingConfig enables client side caching invalidation analysis
+type TrackingConfig struct {
+	Matcher   *KeyPatternMatcher // buckets invalidated keys into patterns
+	Window    time.Duration      // window of per client and per pattern summaries
+	StormRate float64            // invalidated keys per second of a client regarded as a storm
+}
+
+// Tracking is the client side caching mode set by CLIENT TRACKING
+type Tracking struct {
+	On       bool
+	Redirect int64 // id of the client receiving invalidations, 0 for the tracking client itself
+	BCast    bool
+	Prefixes []string // prefixes of BCAST mode
+	OptIn    bool
+	OptOut   bool
+	NoLoop   bool
+}
+
+// Mode names the tracking mode
+func (t *Tracking) Mode() string {
+	switch {
+	case !t.On:
+		return "off"
+	case t.BCast:
+		return "bcast"
+	case t.OptIn:
+		return "optin"
+	case t.OptOut:
+		return "optout"
+	}
+	return "default"
+}
+
+// ParseClientTracking parses CLIENT TRACKING ON|OFF [REDIRECT id]
+// [PREFIX prefix ...] [BCAST] [OPTIN] [OPTOUT] [NOLOOP], nil is returned if
+// cmd is not a valid CLIENT TRACKING.
+func ParseClientTracking(cmd *Command) *Tracking {
+	args := cmd.Args
+	if len(args) < 3 || strings.ToUpper(args[0]) != "CLIENT" || strings.ToUpper(args[1]) != "TRACKING" {
+		return nil
+	}
+	t := &Tracking{}
+	switch strings.ToUpper(args[2]) {
+	case "ON":
+		t.On = true
+	case "OFF":
+		return t
+	default:
+		return nil
+	}
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REDIRECT":
+			if i+1 >= len(args) {
+				return nil
+			}
+			id, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return nil
+			}
+			t.Redirect = id
+			i++
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return nil
+			}
+			t.Prefixes = append(t.Prefixes, args[i+1])
+			i++
+		case "BCAST":
+			t.BCast = true
+		case "OPTIN":
+			t.OptIn = true
+		case "OPTOUT":
+			t.OptOut = true
+		case "NOLOOP":
+			t.NoLoop = true
+		default:
+			return nil
+		}
+	}
+	return t
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/google/gopacket/layers"
 	"net"
+	"strconv"
 )
 
 type TCPMeta struct {
@@ -14,15 +15,25 @@ type TCPMeta struct {
 }
 
 func (tm *TCPMeta) FromSrcToDst(dstHost string, dstPort int) bool {
-	return tm.DstIP.String() == dstHost && int(tm.DstPort) == dstPort
+	return tm.DstIP.Equal(net.ParseIP(dstHost)) && int(tm.DstPort) == dstPort
 }
 
-// TCPIdentify returns an identification for a TCP session, and data direction.
-// As TCP is full-duplex we treat the in and out TCP traffic in a same session
-func TCPIdentify(tm *TCPMeta, Host string, Port int) string {
-	if tm.FromSrcToDst(Host, Port) {
-		return fmt.Sprintf("%s:%d-%s:%d", tm.SrcIP, tm.SrcPort, tm.DstIP, tm.DstPort)
+// TCPIdentify returns an identification for a TCP session, toServer is the
+// data direction. As TCP is full-duplex we treat the in and out TCP traffic
+// in a same session
+func TCPIdentify(tm *TCPMeta, toServer bool) string {
+	if toServer {
+		return fmt.Sprintf("%s-%s", hostPort(tm.SrcIP, tm.SrcPort), hostPort(tm.DstIP, tm.DstPort))
 	} else {
-		return fmt.Sprintf("%s:%d-%s:%d", tm.DstIP, tm.DstPort, tm.SrcIP, tm.SrcPort)
+		return fmt.Sprintf("%s-%s", hostPort(tm.DstIP, tm.DstPort), hostPort(tm.SrcIP, tm.SrcPort))
 	}
 }
+
+// hostPort returns address in form of "ip:port" or "[ipv6]:port", an
+// IPv4-mapped IPv6 address is unmapped so that both forms are the same.
+func hostPort(ip net.IP, port layers.TCPPort) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}